@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -11,6 +12,36 @@ import (
 )
 
 func main() {
+	// note-to-self: `forumd migrate up|down|status` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := app.Migrate(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// note-to-self: `forumd role <username> admin` is how the first admin gets made
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		if err := app.SetRole(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// note-to-self: `forumd import-goodreads [-commit] <username> <file.csv>` is a dry run unless -commit
+	if len(os.Args) > 1 && os.Args[1] == "import-goodreads" {
+		if err := app.ImportGoodreads(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// note-to-self: `forumd mail-test <address>` checks the SMTP (or MAIL_DIR) setup without the queue
+	if len(os.Args) > 1 && os.Args[1] == "mail-test" {
+		if err := app.MailTest(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// note-to-self: read PORT from env, default to 8080 for local dev
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -23,6 +54,9 @@ func main() {
 		log.Fatal(err) // if templates fail to parse, crash fast
 	}
 
+	// note-to-self: background jobs (club read sections opening on their date, the mail queue) tick once a minute
+	go a.RunScheduler(context.Background())
+
 	log.Printf("listening on :%s", port)
 
 	// note-to-self: hand off to the HTTP server using my router
@@ -4,7 +4,10 @@ import (
 	"database/sql"
 	"html/template"
 	"net/http"
+	"net/url"
 	"fmt"
+	"strings"
+	"sync"
 	"github.com/google/uuid"
 )
 
@@ -12,7 +15,17 @@ type App struct {
 	tpl map[string]*template.Template
 	mux *http.ServeMux
 	db  *sql.DB
+	csrfMu sync.Mutex // guards csrf; requests read and write it concurrently
 	csrf map[string]string
+
+	// outgoing email (mail.go)
+	mailer  Mailer
+	mailTpl map[string]*mailTemplate
+	siteURL string
+
+	verifyKey []byte // signs email verification links (verify.go)
+
+	limits rateLimits // login, signup and posting limits (ratelimit.go)
 }
 
 func New() (*App, error) {
@@ -38,12 +51,183 @@ func New() (*App, error) {
 		); err != nil {
 		return nil, err
 	}
+	if tpls["edit_post.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/edit_post.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["post_revisions.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/post_revisions.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["admin.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/admin.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["report.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/report.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["spoiler_gate.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/spoiler_gate.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["books.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/books.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["book.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/book.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["clubs.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/clubs.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["club.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/club.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["club_new.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/club_new.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["events.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/events.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["event.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/event.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["event_new.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/event_new.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["quotes.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/quotes.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["quote.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/quote.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["quote_new.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/quote_new.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["challenges.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/challenges.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["challenge.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/challenge.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["challenge_new.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/challenge_new.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["notifications.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/notifications.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["me_import.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/me_import.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["book_new.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/book_new.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["mod_queue.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/mod_queue.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["mod_log.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/mod_log.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["search.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/search.html",
+	); err != nil {
+		return nil, err
+	}
 	if tpls["login.html"], err = template.ParseFiles("web/templates/login.html"); err != nil {
 		return nil, err
 	}
 	if tpls["register.html"], err = template.ParseFiles("web/templates/register.html"); err != nil {
 		return nil, err
 	}
+	if tpls["forgot.html"], err = template.ParseFiles("web/templates/forgot.html"); err != nil {
+		return nil, err
+	}
+	if tpls["reset.html"], err = template.ParseFiles("web/templates/reset.html"); err != nil {
+		return nil, err
+	}
+	if tpls["login_2fa.html"], err = template.ParseFiles("web/templates/login_2fa.html"); err != nil {
+		return nil, err
+	}
+	if tpls["sessions.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/sessions.html",
+	); err != nil {
+		return nil, err
+	}
+	if tpls["twofactor.html"], err = template.ParseFiles(
+		"web/templates/base.html",
+		"web/templates/twofactor.html",
+	); err != nil {
+		return nil, err
+	}
 	if tpls["error.html"], err = template.ParseFiles("web/templates/error.html"); err != nil {
 		return nil, err
 	}
@@ -52,12 +236,21 @@ func New() (*App, error) {
 	if err != nil { return nil, err }
 
 	mux := http.NewServeMux()
-	a := &App{tpl: tpls, mux: mux, db: db, csrf: make(map[string]string)}
+	a := &App{tpl: tpls, mux: mux, db: db, csrf: make(map[string]string), limits: defaultRateLimits()}
+	if a.mailTpl, err = loadMailTemplates(mailTemplateDir); err != nil {
+		return nil, err
+	}
+	a.mailer = mailerFromEnv()
+	a.siteURL = siteURLFromEnv()
+	if a.verifyKey, err = loadSecret(db, "email_verify"); err != nil {
+		return nil, err
+	}
 
 	// pages
 	mux.HandleFunc("/", a.Home)
 	mux.HandleFunc("/health", a.Health)
 	mux.HandleFunc("/dbcheck", a.DBCheck)
+	mux.HandleFunc("/search", a.SearchGET) // GET /search?q=...
 
 	// auth
 	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
@@ -68,26 +261,92 @@ func New() (*App, error) {
 		if r.Method == http.MethodPost { a.LoginPOST(w, r); return }
 		a.LoginGET(w, r)
 	})
+	mux.HandleFunc("/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost { a.LoginTwoFactorPOST(w, r); return }
+		a.LoginTwoFactorGET(w, r)
+	})
 	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
 		a.LogoutPOST(w, r)
 	})
+	mux.HandleFunc("/forgot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost { a.ForgotPOST(w, r); return }
+		a.ForgotGET(w, r)
+	})
+	mux.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost { a.ResetPOST(w, r); return }
+		a.ResetGET(w, r)
+	})
+	mux.HandleFunc("/verify", a.VerifyGET)
+	mux.HandleFunc("/verify/resend", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.VerifyResendPOST(w, r)
+	})
 
 	// posts
 	mux.HandleFunc("/posts/new", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost { a.NewPostPOST(w, r); return }
 		a.NewPostGET(w, r)
 	})
+	mux.HandleFunc("/posts/edit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost { a.PostEditPOST(w, r); return }
+		a.PostEditGET(w, r)
+	})
+	mux.HandleFunc("/posts/preview", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.PostPreviewPOST(w, r)
+	})
+	mux.HandleFunc("/posts/revisions", a.PostRevisionsGET) // GET /posts/revisions?id=123
+	mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.ContentDeletePOST(w, r)
+	})
+	mux.HandleFunc("/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.ContentRestorePOST(w, r)
+	})
 	mux.HandleFunc("/post", a.PostViewGET)      // GET /post?id=123
 	mux.HandleFunc("/comment", a.CommentPOST)   // POST add comment
+	mux.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.ProgressPOST(w, r)
+	})
 	// reactions (POST only)
 	mux.HandleFunc("/react", func(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
 	a.ReactPOST(w, r)
 })
 
+	// books
+	mux.HandleFunc("/books", a.BooksRouter)  // GET list
+	mux.HandleFunc("/books/", a.BooksRouter) // /books/new, /books/{id}
+	mux.HandleFunc("/events", a.EventsRouter)
+	mux.HandleFunc("/events/", a.EventsRouter)
+	mux.HandleFunc("/quotes", a.QuotesRouter)
+	mux.HandleFunc("/quotes/", a.QuotesRouter)
+	mux.HandleFunc("/challenges", a.ChallengesRouter)
+	mux.HandleFunc("/challenges/", a.ChallengesRouter)
+	mux.HandleFunc("/clubs", a.ClubsRouter)
+	mux.HandleFunc("/clubs/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/clubs/read" {
+			if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+			a.ClubSectionReadPOST(w, r)
+			return
+		}
+		a.ClubsRouter(w, r) // /clubs/new, /clubs/{id}
+	})
+	mux.HandleFunc("/shelf", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.ShelfPOST(w, r)
+	})
+	mux.HandleFunc("/shelf/remove", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.ShelfRemovePOST(w, r)
+	})
+
 	// profile routes
 	mux.HandleFunc("/u/", a.ProfileRouter) // handles /u/{username}/...
+	mux.HandleFunc("/users/suggest", a.MentionSuggestGET) // @mention autocomplete (JSON)
 	mux.HandleFunc("/me/settings", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			a.MeSettingsPOST(w, r)
@@ -95,30 +354,82 @@ func New() (*App, error) {
 		}
 		a.MeSettingsGET(w, r)
 	})
+	mux.HandleFunc("/me/settings/2fa", a.TwoFactorRouter)
+	mux.HandleFunc("/me/sessions", a.SessionsRouter)
+	mux.HandleFunc("/me/sessions/", a.SessionsRouter)
+	mux.HandleFunc("/me/settings/2fa/", a.TwoFactorRouter)
 	mux.HandleFunc("/me/avatar", a.MeAvatarPOST)
+	mux.HandleFunc("/me/notifications", a.NotificationsRouter)
+	mux.HandleFunc("/me/notifications/", a.NotificationsRouter)
+	mux.HandleFunc("/me/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			a.MeImportPOST(w, r)
+			return
+		}
+		a.MeImportGET(w, r)
+	})
+
+	// reports + moderation
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost { a.ReportPOST(w, r); return }
+		a.ReportGET(w, r)
+	})
+	mux.HandleFunc("/mod/queue", a.ModQueueGET)
+	mux.HandleFunc("/mod/log", a.ModLogGET)
+	mux.HandleFunc("/mod/action", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.ModActionPOST(w, r)
+	})
+	mux.HandleFunc("/mod/unhide", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.ModUnhidePOST(w, r)
+	})
+
+	// admin (each handler checks its own permission)
+	mux.HandleFunc("/admin", a.requirePerm(PermAdminArea, a.AdminGET))
+	mux.HandleFunc("/admin/role", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.AdminRolePOST(w, r)
+	})
+	mux.HandleFunc("/admin/catmod", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+		a.AdminCategoryModPOST(w, r)
+	})
 
 	// static
 	fs := http.FileServer(http.Dir("web/assets"))
 	mux.Handle("/assets/", http.StripPrefix("/assets/", fs))
 
-	// uploaded avatars served with cache headers
+	// uploaded avatars and book covers served with cache headers
 	avatars := http.StripPrefix("/uploads/avatars/", http.FileServer(http.Dir("web/uploads/avatars")))
 	mux.Handle("/uploads/avatars/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "public, max-age=86400")
 		avatars.ServeHTTP(w, r)
 	}))
+	covers := http.StripPrefix("/uploads/covers/", http.FileServer(http.Dir("web/uploads/covers")))
+	mux.Handle("/uploads/covers/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		covers.ServeHTTP(w, r)
+	}))
 
 	return a, nil
 }
 
-// generateCSRF creates a token for the current session and stores it in memory.
+// generateCSRF returns the token for the current session, creating it the
+// first time. It stays the same for the session so forms open in several
+// tabs all keep working.
 func (a *App) generateCSRF(r *http.Request) string {
 	c, err := r.Cookie(sessionCookieName)
 	if err != nil || c.Value == "" {
 		return ""
 	}
-	tok := uuid.NewString()
-	a.csrf[c.Value] = tok
+	a.csrfMu.Lock()
+	defer a.csrfMu.Unlock()
+	tok, ok := a.csrf[c.Value]
+	if !ok {
+		tok = uuid.NewString()
+		a.csrf[c.Value] = tok
+	}
 	return tok
 }
 
@@ -129,7 +440,27 @@ func (a *App) checkCSRF(r *http.Request) bool {
 		return false
 	}
 	tok := r.FormValue("csrf")
-	return tok != "" && a.csrf[c.Value] == tok
+	a.csrfMu.Lock()
+	want := a.csrf[c.Value]
+	a.csrfMu.Unlock()
+	return tok != "" && want == tok
+}
+
+// dropCSRF forgets the token of a session that has ended.
+func (a *App) dropCSRF(session string) {
+	a.csrfMu.Lock()
+	delete(a.csrf, session)
+	a.csrfMu.Unlock()
+}
+
+// isLocalPath reports whether s is a path on this site, safe to redirect
+// to. Browsers treat "//host" and "/\host" as links to another site.
+func isLocalPath(s string) bool {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.Contains(s, `\`) {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "" && u.Host == ""
 }
 
 // renderError shows a friendly error page with the given status code.
@@ -19,6 +19,10 @@ type User struct {
 	DisplayName string
 	Bio         string
 	AvatarPath  string
+	Role        string // member, moderator or admin; see rbac.go
+	SuspendedUntil int64 // unix seconds; 0 or past means not suspended
+	Unread         int   // unread notifications, for the nav badge
+	Unverified     bool  // email not confirmed yet; see verify.go
 }
 
 // hash a plaintext password
@@ -31,12 +35,18 @@ func checkPassword(hash []byte, pw string) error {
 	return bcrypt.CompareHashAndPassword(hash, []byte(pw))
 }
 
-// create a session row + return token and expiry
-func createSession(db *sql.DB, userID int64) (token string, expires time.Time, err error) {
+// create a session row + return token and expiry; the device details are
+// for /me/sessions (sessions.go)
+func createSession(db *sql.DB, userID int64, r *http.Request) (token string, expires time.Time, err error) {
 	token = uuid.NewString()
-	expires = time.Now().Add(7 * 24 * time.Hour)
-	_, err = db.Exec(`INSERT INTO sessions (token, user_id, expires_at) VALUES (?, ?, ?)`,
-		token, userID, expires.Unix()) // <-- store as INTEGER
+	now := time.Now()
+	expires = now.Add(7 * 24 * time.Hour)
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLen {
+		ua = ua[:maxUserAgentLen]
+	}
+	_, err = db.Exec(`INSERT INTO sessions (token, user_id, expires_at, user_agent, ip, last_seen_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		token, userID, expires.Unix(), ua, clientIP(r), now.Unix()) // <-- store as INTEGER
 	return
 }
 // delete a session row
@@ -77,13 +87,14 @@ func (a *App) currentUser(r *http.Request) (*User, error) {
 		return nil, nil
 	}
 	var u User
-	var expiresUnix int64
+	var expiresUnix, lastSeen int64
 	err = a.db.QueryRow(`
-		SELECT u.id, u.email, u.username, COALESCE(u.display_name,''), COALESCE(u.bio,''), COALESCE(u.avatar_path,''), s.expires_at
+		SELECT u.id, u.email, u.username, COALESCE(u.display_name,''), COALESCE(u.bio,''), COALESCE(u.avatar_path,''), u.role, u.suspended_until, s.expires_at, COALESCE(s.last_seen_at, 0),
+		       (SELECT COUNT(*) FROM notifications n WHERE n.user_id = u.id AND n.read_at IS NULL), u.email_verified_at IS NULL
                 FROM sessions s
                 JOIN users u ON u.id = s.user_id
                 WHERE s.token = ?`, c.Value).
-		Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.Bio, &u.AvatarPath, &expiresUnix)
+		Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.Bio, &u.AvatarPath, &u.Role, &u.SuspendedUntil, &expiresUnix, &lastSeen, &u.Unread, &u.Unverified)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -92,7 +103,9 @@ func (a *App) currentUser(r *http.Request) (*User, error) {
 	}
 	if time.Now().Unix() > expiresUnix {
 		_ = deleteSession(a.db, c.Value)
+		a.dropCSRF(c.Value)
 		return nil, nil
 	}
+	a.touchSession(c.Value, lastSeen, time.Now())
 	return &u, nil
 }
\ No newline at end of file
@@ -0,0 +1,437 @@
+package app
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Book is one edition-independent book that posts can be about.
+type Book struct {
+	ID        int64
+	Title     string
+	Authors   string // comma-separated, as entered
+	ISBN      string // normalized ISBN-13, "" if unknown
+	Year      int    // 0 if unknown
+	Pages     int    // 0 if unknown
+	CoverPath string // web path, "" if no cover
+	PostCount int
+}
+
+// errBadISBN is returned for ISBNs with the wrong length, stray characters
+// or a failing check digit.
+var errBadISBN = errors.New("not a valid ISBN-10 or ISBN-13")
+
+// maxBookPages bounds the page count field.
+const maxBookPages = 20000
+
+// normalizeISBN validates an ISBN-10 or ISBN-13 (hyphens and spaces
+// allowed) and returns it as a bare ISBN-13.
+func normalizeISBN(s string) (string, error) {
+	s = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+	switch len(s) {
+	case 10:
+		sum := 0
+		for i := 0; i < 10; i++ {
+			var d int
+			switch {
+			case s[i] >= '0' && s[i] <= '9':
+				d = int(s[i] - '0')
+			case s[i] == 'X' && i == 9:
+				d = 10
+			default:
+				return "", errBadISBN
+			}
+			sum += d * (10 - i)
+		}
+		if sum%11 != 0 {
+			return "", errBadISBN
+		}
+		isbn := "978" + s[:9]
+		return isbn + string(rune('0'+isbn13Check(isbn))), nil
+	case 13:
+		for i := 0; i < 13; i++ {
+			if s[i] < '0' || s[i] > '9' {
+				return "", errBadISBN
+			}
+		}
+		if !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+			return "", errBadISBN
+		}
+		if isbn13Check(s[:12]) != int(s[12]-'0') {
+			return "", errBadISBN
+		}
+		return s, nil
+	}
+	return "", errBadISBN
+}
+
+// isbn13Check computes the check digit for the first 12 digits of an
+// ISBN-13.
+func isbn13Check(first12 string) int {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(first12[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
+
+// getBook loads one book with the number of visible posts about it.
+func getBook(db dbtx, id int64) (*Book, error) {
+	var b Book
+	var isbn sql.NullString
+	var year, pages sql.NullInt64
+	err := db.QueryRow(`
+		SELECT b.id, b.title, b.authors, b.isbn, b.year, b.pages, b.cover_path,
+		       (SELECT COUNT(*) FROM posts p WHERE p.book_id = b.id AND p.hidden_at IS NULL AND p.deleted_at IS NULL)
+		FROM books b WHERE b.id = ?`, id).
+		Scan(&b.ID, &b.Title, &b.Authors, &isbn, &year, &pages, &b.CoverPath, &b.PostCount)
+	if err != nil {
+		return nil, err
+	}
+	b.ISBN, b.Year, b.Pages = isbn.String, int(year.Int64), int(pages.Int64)
+	return &b, nil
+}
+
+// listBooks returns all books ordered by title, optionally filtered by a
+// title/author substring.
+func listBooks(db *sql.DB, q string) ([]Book, error) {
+	query := `
+		SELECT b.id, b.title, b.authors, COALESCE(b.isbn, ''), COALESCE(b.year, 0), COALESCE(b.pages, 0), b.cover_path,
+		       (SELECT COUNT(*) FROM posts p WHERE p.book_id = b.id AND p.hidden_at IS NULL AND p.deleted_at IS NULL)
+		FROM books b`
+	args := []any{}
+	if q != "" {
+		query += ` WHERE b.title LIKE ? OR b.authors LIKE ?`
+		like := "%" + q + "%"
+		args = append(args, like, like)
+	}
+	query += ` ORDER BY b.title COLLATE NOCASE`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Book
+	for rows.Next() {
+		var b Book
+		if err := rows.Scan(&b.ID, &b.Title, &b.Authors, &b.ISBN, &b.Year, &b.Pages, &b.CoverPath, &b.PostCount); err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	return list, rows.Err()
+}
+
+// parseBookID reads the optional book field of the post forms. Blank means
+// the post isn't about a particular book.
+func parseBookID(db dbtx, s string) (sql.NullInt64, error) {
+	id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || id <= 0 {
+		return sql.NullInt64{}, nil
+	}
+	var n int
+	_ = db.QueryRow(`SELECT COUNT(*) FROM books WHERE id = ?`, id).Scan(&n)
+	if n == 0 {
+		return sql.NullInt64{}, errors.New("unknown book")
+	}
+	return sql.NullInt64{Int64: id, Valid: true}, nil
+}
+
+// BooksRouter handles /books, /books/new and /books/{id}.
+func (a *App) BooksRouter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/books"), "/")
+	switch {
+	case rest == "":
+		a.BookListGET(w, r)
+	case rest == "new" && r.Method == http.MethodPost:
+		a.BookNewPOST(w, r)
+	case rest == "new":
+		a.BookNewGET(w, r)
+	default:
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			a.renderError(w, http.StatusNotFound, "Book not found.")
+			return
+		}
+		a.BookViewGET(w, r, id)
+	}
+}
+
+// BookListGET — GET /books?q=...
+func (a *App) BookListGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	books, err := listBooks(a.db, q)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	data := map[string]any{
+		"Title": "Books",
+		"User":  u,
+		"Query": q,
+		"Books": books,
+	}
+	a.render(w, "books.html", data)
+}
+
+// BookNewGET — GET /books/new
+func (a *App) BookNewGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
+		return
+	}
+	data := map[string]any{
+		"Title":     "Add a book",
+		"User":      u,
+		"CSRFToken": a.generateCSRF(r),
+		"Form":      map[string]string{},
+	}
+	a.render(w, "book_new.html", data)
+}
+
+// BookNewPOST — POST /books/new (multipart)
+// Form fields: title, authors, isbn, year, pages, cover (optional JPEG/PNG)
+// A book whose ISBN is already known redirects to the existing entry.
+func (a *App) BookNewPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
+		return
+	}
+	if err := r.ParseMultipartForm(2<<20 + 1024); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	form := map[string]string{
+		"Title":   strings.TrimSpace(r.FormValue("title")),
+		"Authors": strings.TrimSpace(r.FormValue("authors")),
+		"ISBN":    strings.TrimSpace(r.FormValue("isbn")),
+		"Year":    strings.TrimSpace(r.FormValue("year")),
+		"Pages":   strings.TrimSpace(r.FormValue("pages")),
+	}
+	fail := func(msg string) {
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "book_new.html", map[string]any{
+			"Title":     "Add a book",
+			"User":      u,
+			"CSRFToken": a.generateCSRF(r),
+			"Form":      form,
+			"Error":     msg,
+		})
+	}
+
+	if form["Title"] == "" {
+		fail("The title is required.")
+		return
+	}
+	var isbn sql.NullString
+	if form["ISBN"] != "" {
+		n, err := normalizeISBN(form["ISBN"])
+		if err != nil {
+			fail("ISBN " + form["ISBN"] + " is " + err.Error() + ".")
+			return
+		}
+		var existing int64
+		if err := a.db.QueryRow(`SELECT id FROM books WHERE isbn = ?`, n).Scan(&existing); err == nil {
+			http.Redirect(w, r, fmt.Sprintf("/books/%d", existing), http.StatusSeeOther)
+			return
+		}
+		isbn = sql.NullString{String: n, Valid: true}
+	}
+	var year sql.NullInt64
+	if form["Year"] != "" {
+		y, err := strconv.Atoi(form["Year"])
+		if err != nil || y < 1 || y > time.Now().Year()+1 {
+			fail("The publication year doesn't look right.")
+			return
+		}
+		year = sql.NullInt64{Int64: int64(y), Valid: true}
+	}
+	var pages sql.NullInt64
+	if form["Pages"] != "" {
+		n, err := strconv.Atoi(form["Pages"])
+		if err != nil || n < 1 || n > maxBookPages {
+			fail("The page count doesn't look right.")
+			return
+		}
+		pages = sql.NullInt64{Int64: int64(n), Valid: true}
+	}
+
+	res, err := a.db.Exec(`INSERT INTO books (title, authors, isbn, year, pages, created_by) VALUES (?, ?, ?, ?, ?, ?)`,
+		form["Title"], form["Authors"], isbn, year, pages, u.ID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	bookID, _ := res.LastInsertId()
+
+	if f, _, err := r.FormFile("cover"); err == nil {
+		defer f.Close()
+		path, err := saveCover(f, bookID)
+		if err != nil {
+			// the book itself is saved; say why the cover wasn't
+			http.Redirect(w, r, fmt.Sprintf("/books/%d?err=%s", bookID, url.QueryEscape("The cover couldn't be used: "+err.Error())), http.StatusSeeOther)
+			return
+		}
+		_, _ = a.db.Exec(`UPDATE books SET cover_path = ? WHERE id = ?`, path, bookID)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", bookID), http.StatusSeeOther)
+}
+
+// saveCover decodes an uploaded JPEG or PNG, scales it to coverWidth and
+// stores it as web/uploads/covers/{bookID}.jpg. It returns the web path.
+func saveCover(f io.Reader, bookID int64) (string, error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(f, 2<<20+1)); err != nil {
+		return "", errors.New("read error")
+	}
+	if buf.Len() > 2<<20 {
+		return "", errors.New("file too large")
+	}
+	mime := http.DetectContentType(buf.Bytes())
+	if mime != "image/jpeg" && mime != "image/png" {
+		return "", errors.New("only JPEG and PNG covers are supported")
+	}
+	// a small file can still declare enormous dimensions, so check them
+	// before decoding allocates the pixels
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return "", errors.New("could not decode image")
+	}
+	if cfg.Width*cfg.Height > maxCoverPixels {
+		return "", fmt.Errorf("image too large (at most %d megapixels)", maxCoverPixels/1_000_000)
+	}
+	img, _, err := image.Decode(&buf)
+	if err != nil {
+		return "", errors.New("could not decode image")
+	}
+	img = resizeToWidth(img, coverWidth)
+
+	dir := "web/uploads/covers"
+	_ = os.MkdirAll(dir, 0755)
+	name := fmt.Sprintf("%d.jpg", bookID)
+	out, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return "", errors.New("save error")
+	}
+	defer out.Close()
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: 85}); err != nil {
+		return "", errors.New("encode error")
+	}
+	return "/uploads/covers/" + name, nil
+}
+
+// coverWidth is the width covers are stored at; height keeps the aspect.
+const coverWidth = 240
+
+// maxCoverPixels bounds the width times height of an uploaded cover.
+const maxCoverPixels = 16_000_000
+
+// resizeToWidth scales the image to the given width with the same
+// nearest-neighbor approach as resizeTo256.
+func resizeToWidth(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= width {
+		return img
+	}
+	height := b.Dy() * width / b.Dx()
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			out.Set(x, y, img.At(b.Min.X+x*b.Dx()/width, b.Min.Y+y*b.Dy()/height))
+		}
+	}
+	return out
+}
+
+// BookViewGET — GET /books/{id}
+// The hub for one book: its details and every visible post about it.
+func (a *App) BookViewGET(w http.ResponseWriter, r *http.Request, id int64) {
+	u, _ := a.currentUser(r)
+	book, err := getBook(a.db, id)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Book not found.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+
+	type postItem struct {
+		ID             int64
+		Title          string
+		Username       string
+		CreatedAt      string
+		Comments       int
+		SpoilerChapter int
+		Rating         Rating // 0 unless the post is a review
+	}
+	rows, err := a.db.Query(`
+		SELECT p.id, p.title, u.username, p.created_at,
+		       (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id AND c.hidden_at IS NULL AND c.deleted_at IS NULL),
+		       COALESCE(p.spoiler_chapter, 0), COALESCE(rv.rating, 0)
+		FROM posts p
+		JOIN users u ON u.id = p.user_id
+		LEFT JOIN reviews rv ON rv.post_id = p.id
+		WHERE p.book_id = ? AND p.hidden_at IS NULL AND p.deleted_at IS NULL
+		ORDER BY p.created_at DESC`, id)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	defer rows.Close()
+	var posts []postItem
+	for rows.Next() {
+		var it postItem
+		if err := rows.Scan(&it.ID, &it.Title, &it.Username, &it.CreatedAt, &it.Comments, &it.SpoilerChapter, &it.Rating); err == nil {
+			posts = append(posts, it)
+		}
+	}
+
+	ratings, err := bookRatings(a.db, id)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+
+	var shelf *ShelfEntry
+	var viewerID int64
+	if u != nil {
+		shelf, _ = getShelfEntry(a.db, u.ID, id)
+		viewerID = u.ID
+	}
+	quotes, _ := listQuotes(a.db, quoteFilter{BookID: id, Top: true, ViewerID: viewerID, Limit: 5})
+
+	data := map[string]any{
+		"Title":         book.Title,
+		"User":          u,
+		"Book":          book,
+		"Posts":         posts,
+		"Ratings":       ratings,
+		"Quotes":        quotes,
+		"Shelf":         shelf,
+		"ShelfStatuses": shelfStatuses,
+		"ShelfLabels":   shelfLabels,
+		"RatingChoices": ratingChoices,
+		"CSRFToken":     a.generateCSRF(r),
+		"Error":         r.URL.Query().Get("err"),
+	}
+	a.render(w, "book.html", data)
+}
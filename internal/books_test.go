@@ -0,0 +1,58 @@
+package app
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" for errBadISBN
+	}{
+		{"9780306406157", "9780306406157"},
+		{"978-0-306-40615-7", "9780306406157"},
+		{"0-306-40615-2", "9780306406157"},
+		{"0306406152", "9780306406157"},
+		{"080442957X", "9780804429573"},
+		{"080442957x", "9780804429573"},
+		{"979-10-90636-07-1", "9791090636071"},
+		{" 0 306 40615 2 ", "9780306406157"},
+		{"0306406153", ""},    // ISBN-10 check digit
+		{"9780306406158", ""}, // ISBN-13 check digit
+		{"X306406152", ""},    // X only as the last digit
+		{"1234567890128", ""}, // neither 978 nor 979
+		{"97803064061a7", ""}, // stray letter
+		{"030640615", ""},     // too short
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := normalizeISBN(tt.in)
+		if tt.want == "" {
+			if err != errBadISBN {
+				t.Errorf("normalizeISBN(%q) = %q, %v; want errBadISBN", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeISBN(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestSaveCoverRejectsHugeImages(t *testing.T) {
+	// 4000x4001 compresses to a few kilobytes but is over maxCoverPixels
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4000, 4001))); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 2<<20 {
+		t.Fatalf("test image is %d bytes, over the upload limit", buf.Len())
+	}
+	if _, err := saveCover(&buf, 1); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("saveCover error = %v, want too large", err)
+	}
+}
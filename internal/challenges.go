@@ -0,0 +1,629 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Yearly goal units.
+const (
+	GoalBooks = "books"
+	GoalPages = "pages"
+)
+
+// Limits for goals and themed challenges.
+const (
+	maxGoalTarget = 100000
+	maxCriteria   = 50
+	maxRepeat     = 20 // "5x translated novel" expands to at most this many items
+)
+
+// ReadingGoal is a member's goal for one year with their progress so far.
+// Progress comes from the finished shelf: books finished that year, and
+// their page counts (or the last page recorded when the book has none).
+type ReadingGoal struct {
+	Username string
+	Year     int
+	Unit     string
+	Target   int
+	Books    int
+	Pages    int
+}
+
+// Done is the progress in the goal's unit.
+func (g ReadingGoal) Done() int {
+	if g.Unit == GoalPages {
+		return g.Pages
+	}
+	return g.Books
+}
+
+// Percent is the progress as a percentage, capped at 100 for the bar.
+func (g ReadingGoal) Percent() int {
+	if g.Target <= 0 {
+		return 0
+	}
+	if p := g.Done() * 100 / g.Target; p < 100 {
+		return p
+	}
+	return 100
+}
+
+// Met reports whether the goal is reached.
+func (g ReadingGoal) Met() bool { return g.Target > 0 && g.Done() >= g.Target }
+
+// finishedInYear aggregates a year's finished shelf entries per member.
+// Entries without a finish date count in the year they were last updated.
+const finishedInYear = `
+	SELECT s.user_id, COUNT(*) AS books,
+	       SUM(COALESCE(b.pages, CASE WHEN s.progress_unit = 'page' THEN s.progress END, 0)) AS pages
+	FROM shelf_entries s JOIN books b ON b.id = s.book_id
+	WHERE s.status = 'finished' AND substr(COALESCE(s.finished_on, s.updated_at), 1, 4) = ?
+	GROUP BY s.user_id`
+
+// getReadingGoal returns the member's goal for year, or nil if they haven't
+// set one.
+func getReadingGoal(db dbtx, userID int64, year int) (*ReadingGoal, error) {
+	g := ReadingGoal{Year: year}
+	err := db.QueryRow(`
+		SELECT u.username, g.unit, g.target, COALESCE(f.books, 0), COALESCE(f.pages, 0)
+		FROM reading_goals g
+		JOIN users u ON u.id = g.user_id
+		LEFT JOIN (`+finishedInYear+`) f ON f.user_id = g.user_id
+		WHERE g.user_id = ? AND g.year = ?`, strconv.Itoa(year), userID, year).
+		Scan(&g.Username, &g.Unit, &g.Target, &g.Books, &g.Pages)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// goalLeaderboard ranks everyone with a goal for year: furthest along
+// first, then by amount read.
+func goalLeaderboard(db *sql.DB, year int) ([]ReadingGoal, error) {
+	rows, err := db.Query(`
+		SELECT u.username, g.unit, g.target, COALESCE(f.books, 0), COALESCE(f.pages, 0)
+		FROM reading_goals g
+		JOIN users u ON u.id = g.user_id
+		LEFT JOIN (`+finishedInYear+`) f ON f.user_id = g.user_id
+		WHERE g.year = ?`, strconv.Itoa(year), year)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ReadingGoal
+	for rows.Next() {
+		g := ReadingGoal{Year: year}
+		if err := rows.Scan(&g.Username, &g.Unit, &g.Target, &g.Books, &g.Pages); err != nil {
+			return nil, err
+		}
+		list = append(list, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// uncapped ratio, so 150% beats 100%
+	ratio := func(g ReadingGoal) float64 { return float64(g.Done()) / float64(g.Target) }
+	sort.SliceStable(list, func(i, j int) bool {
+		if ri, rj := ratio(list[i]), ratio(list[j]); ri != rj {
+			return ri > rj
+		}
+		if list[i].Books != list[j].Books {
+			return list[i].Books > list[j].Books
+		}
+		return list[i].Username < list[j].Username
+	})
+	return list, nil
+}
+
+// Challenge is a themed challenge defined by moderators.
+type Challenge struct {
+	ID           int64
+	Title        string
+	Description  string
+	StartsOn     string // YYYY-MM-DD
+	EndsOn       string // YYYY-MM-DD, inclusive
+	CreatedBy    string
+	Items        int // number of criteria
+	Participants int
+	MyChecks     int // criteria the viewer ticked
+	Criteria     []Criterion
+}
+
+// Open reports whether members can tick items on the given day.
+func (c Challenge) Open(today string) bool { return c.StartsOn <= today && today <= c.EndsOn }
+
+// Completed reports whether the viewer ticked every item.
+func (c Challenge) Completed() bool { return c.Items > 0 && c.MyChecks >= c.Items }
+
+// Criterion is one checklist item of a challenge, with the viewer's tick.
+type Criterion struct {
+	ID        int64
+	Label     string
+	Checked   bool
+	BookID    int64 // the book the viewer ticked it with, 0 if none
+	BookTitle string
+}
+
+// challengeColumns selects a Challenge; the first placeholder is the viewer.
+const challengeColumns = `
+	c.id, c.title, c.description, c.starts_on, c.ends_on, u.username,
+	(SELECT COUNT(*) FROM challenge_criteria cc WHERE cc.challenge_id = c.id),
+	(SELECT COUNT(DISTINCT k.user_id) FROM challenge_checks k JOIN challenge_criteria cc ON cc.id = k.criterion_id WHERE cc.challenge_id = c.id),
+	(SELECT COUNT(*) FROM challenge_checks k JOIN challenge_criteria cc ON cc.id = k.criterion_id WHERE cc.challenge_id = c.id AND k.user_id = ?)
+	FROM challenges c JOIN users u ON u.id = c.created_by`
+
+func scanChallenge(sc interface{ Scan(...any) error }) (Challenge, error) {
+	var c Challenge
+	err := sc.Scan(&c.ID, &c.Title, &c.Description, &c.StartsOn, &c.EndsOn, &c.CreatedBy,
+		&c.Items, &c.Participants, &c.MyChecks)
+	return c, err
+}
+
+// listChallenges returns all themed challenges, latest ending first.
+func listChallenges(db *sql.DB, viewerID int64) ([]Challenge, error) {
+	rows, err := db.Query(`SELECT `+challengeColumns+` ORDER BY c.ends_on DESC, c.id DESC`, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Challenge
+	for rows.Next() {
+		c, err := scanChallenge(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// getChallenge loads one challenge with its criteria and the viewer's ticks.
+func getChallenge(db *sql.DB, id, viewerID int64) (*Challenge, error) {
+	c, err := scanChallenge(db.QueryRow(`SELECT `+challengeColumns+` WHERE c.id = ?`, viewerID, id))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`
+		SELECT cc.id, cc.label, k.user_id IS NOT NULL, COALESCE(b.id, 0), COALESCE(b.title, '')
+		FROM challenge_criteria cc
+		LEFT JOIN challenge_checks k ON k.criterion_id = cc.id AND k.user_id = ?
+		LEFT JOIN books b ON b.id = k.book_id
+		WHERE cc.challenge_id = ?
+		ORDER BY cc.position`, viewerID, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cr Criterion
+		if err := rows.Scan(&cr.ID, &cr.Label, &cr.Checked, &cr.BookID, &cr.BookTitle); err != nil {
+			return nil, err
+		}
+		c.Criteria = append(c.Criteria, cr)
+	}
+	return &c, rows.Err()
+}
+
+// ChallengeStanding is one participant of a themed challenge.
+type ChallengeStanding struct {
+	Username string
+	Checks   int
+}
+
+// challengeStandings ranks participants by items ticked, earliest first on
+// ties.
+func challengeStandings(db *sql.DB, challengeID int64) ([]ChallengeStanding, error) {
+	rows, err := db.Query(`
+		SELECT u.username, COUNT(*)
+		FROM challenge_checks k
+		JOIN challenge_criteria cc ON cc.id = k.criterion_id
+		JOIN users u ON u.id = k.user_id
+		WHERE cc.challenge_id = ?
+		GROUP BY k.user_id
+		ORDER BY COUNT(*) DESC, MAX(k.checked_at), u.username
+		LIMIT 100`, challengeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ChallengeStanding
+	for rows.Next() {
+		var s ChallengeStanding
+		if err := rows.Scan(&s.Username, &s.Checks); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// finishedBooks lists the books on the member's finished shelf, for the
+// "ticked with" picker.
+func finishedBooks(db *sql.DB, userID int64) ([]Book, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b.title, b.authors FROM shelf_entries s JOIN books b ON b.id = s.book_id
+		WHERE s.user_id = ? AND s.status = 'finished'
+		ORDER BY COALESCE(s.finished_on, s.updated_at) DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Book
+	for rows.Next() {
+		var b Book
+		if err := rows.Scan(&b.ID, &b.Title, &b.Authors); err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	return list, rows.Err()
+}
+
+var repeatRe = regexp.MustCompile(`^(\d+)\s*[x×]\s+(.+)$`)
+
+// parseCriteria reads the criteria textarea: one item per line. A line like
+// "5x translated novel" stands for five numbered items.
+func parseCriteria(s string) ([]string, error) {
+	var items []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if m := repeatRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			if n < 1 || n > maxRepeat {
+				return nil, fmt.Errorf("repeat an item at most %d times", maxRepeat)
+			}
+			for i := 1; i <= n; i++ {
+				label := m[2]
+				if n > 1 {
+					label = fmt.Sprintf("%s (%d of %d)", m[2], i, n)
+				}
+				items = append(items, label)
+			}
+			continue
+		}
+		items = append(items, line)
+	}
+	if len(items) == 0 {
+		return nil, errors.New("add at least one item")
+	}
+	if len(items) > maxCriteria {
+		return nil, fmt.Errorf("at most %d items", maxCriteria)
+	}
+	return items, nil
+}
+
+// ChallengesRouter handles everything under /challenges:
+//
+//	/challenges           goals, leaderboard and themed challenges (?year=)
+//	/challenges/goal      POST, set or clear a yearly goal
+//	/challenges/new       create a themed challenge (moderators)
+//	/challenges/check     POST, tick or untick an item
+//	/challenges/{id}      one themed challenge
+func (a *App) ChallengesRouter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/challenges"), "/")
+	post := r.Method == http.MethodPost
+	switch {
+	case rest == "" && !post:
+		a.ChallengeListGET(w, r)
+	case rest == "goal" && post:
+		a.GoalPOST(w, r)
+	case rest == "check" && post:
+		a.ChallengeCheckPOST(w, r)
+	case rest == "new" && post:
+		a.ChallengeNewPOST(w, r)
+	case rest == "new":
+		a.ChallengeNewGET(w, r)
+	case post:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			a.renderError(w, http.StatusNotFound, "Challenge not found.")
+			return
+		}
+		a.ChallengeViewGET(w, r, id)
+	}
+}
+
+// ChallengeListGET — GET /challenges?year=2025
+func (a *App) ChallengeListGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+	thisYear := time.Now().Year()
+	year := thisYear
+	if y, err := strconv.Atoi(r.URL.Query().Get("year")); err == nil && y >= 2000 && y <= thisYear+1 {
+		year = y
+	}
+	board, err := goalLeaderboard(a.db, year)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	var viewerID int64
+	var goal *ReadingGoal
+	if u != nil {
+		viewerID = u.ID
+		goal, _ = getReadingGoal(a.db, u.ID, year)
+	}
+	challenges, err := listChallenges(a.db, viewerID)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	today := time.Now().Format(dateLayout)
+	var current, past []Challenge
+	for _, c := range challenges {
+		if c.EndsOn < today {
+			past = append(past, c)
+		} else {
+			current = append(current, c)
+		}
+	}
+	data := map[string]any{
+		"Title":       fmt.Sprintf("Reading challenges %d", year),
+		"User":        u,
+		"Year":        year,
+		"PrevYear":    year - 1,
+		"NextYear":    year + 1,
+		"HasNext":     year < thisYear+1,
+		"Goal":        goal,
+		"Leaderboard": board,
+		"Current":     current,
+		"Past":        past,
+		"Today":       today,
+		"Error":       r.URL.Query().Get("err"),
+		"CanCreate":   u.Can(PermModerate),
+		"CSRFToken":   a.generateCSRF(r),
+	}
+	a.render(w, "challenges.html", data)
+}
+
+// GoalPOST — POST /challenges/goal
+// Form fields: year, unit=books|pages, target (empty or 0 removes the goal)
+func (a *App) GoalPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	thisYear := time.Now().Year()
+	year, err := strconv.Atoi(r.Form.Get("year"))
+	if err != nil || year < thisYear-1 || year > thisYear+1 {
+		http.Error(w, "goals can be set for last year, this year or next year", http.StatusBadRequest)
+		return
+	}
+	back := fmt.Sprintf("/challenges?year=%d", year)
+	target := 0
+	if t := strings.TrimSpace(r.Form.Get("target")); t != "" {
+		if target, err = strconv.Atoi(t); err != nil || target < 0 || target > maxGoalTarget {
+			http.Redirect(w, r, back+"&err="+url.QueryEscape("The goal must be a whole number."), http.StatusSeeOther)
+			return
+		}
+	}
+	if target == 0 {
+		_, err = a.db.Exec(`DELETE FROM reading_goals WHERE user_id = ? AND year = ?`, u.ID, year)
+	} else {
+		unit := r.Form.Get("unit")
+		if unit != GoalBooks && unit != GoalPages {
+			http.Error(w, "invalid unit", http.StatusBadRequest)
+			return
+		}
+		_, err = a.db.Exec(`
+			INSERT INTO reading_goals (user_id, year, unit, target) VALUES (?, ?, ?, ?)
+			ON CONFLICT(user_id, year) DO UPDATE SET unit = excluded.unit, target = excluded.target, updated_at = CURRENT_TIMESTAMP`,
+			u.ID, year, unit, target)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// ChallengeViewGET — GET /challenges/{id}
+func (a *App) ChallengeViewGET(w http.ResponseWriter, r *http.Request, id int64) {
+	u, _ := a.currentUser(r)
+	var viewerID int64
+	if u != nil {
+		viewerID = u.ID
+	}
+	c, err := getChallenge(a.db, id, viewerID)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Challenge not found.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	standings, err := challengeStandings(a.db, id)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	var books []Book
+	if u != nil {
+		books, _ = finishedBooks(a.db, u.ID)
+	}
+	today := time.Now().Format(dateLayout)
+	data := map[string]any{
+		"Title":     c.Title,
+		"User":      u,
+		"Challenge": c,
+		"Standings": standings,
+		"Books":     books,
+		"Open":      c.Open(today),
+		"Today":     today,
+		"Error":     r.URL.Query().Get("err"),
+		"CSRFToken": a.generateCSRF(r),
+	}
+	a.render(w, "challenge.html", data)
+}
+
+// ChallengeCheckPOST — POST /challenges/check
+// Form fields: criterion_id, done=1 to tick (0 to untick), book (optional,
+// one of the member's finished books)
+func (a *App) ChallengeCheckPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	critID, _ := strconv.ParseInt(r.Form.Get("criterion_id"), 10, 64)
+	var challengeID int64
+	var startsOn, endsOn string
+	err := a.db.QueryRow(`
+		SELECT c.id, c.starts_on, c.ends_on FROM challenge_criteria cc JOIN challenges c ON c.id = cc.challenge_id
+		WHERE cc.id = ?`, critID).Scan(&challengeID, &startsOn, &endsOn)
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such item", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	back := fmt.Sprintf("/challenges/%d", challengeID)
+	fail := func(msg string) {
+		http.Redirect(w, r, back+"?err="+url.QueryEscape(msg), http.StatusSeeOther)
+	}
+	if today := time.Now().Format(dateLayout); today < startsOn || today > endsOn {
+		fail("This challenge isn't running right now.")
+		return
+	}
+
+	if r.Form.Get("done") != "1" {
+		_, err = a.db.Exec(`DELETE FROM challenge_checks WHERE user_id = ? AND criterion_id = ?`, u.ID, critID)
+	} else {
+		var book sql.NullInt64
+		if id, _ := strconv.ParseInt(r.Form.Get("book"), 10, 64); id > 0 {
+			var n int
+			_ = a.db.QueryRow(`SELECT COUNT(*) FROM shelf_entries WHERE user_id = ? AND book_id = ? AND status = 'finished'`, u.ID, id).Scan(&n)
+			if n == 0 {
+				fail("Only books on your finished shelf can count.")
+				return
+			}
+			book = sql.NullInt64{Int64: id, Valid: true}
+		}
+		_, err = a.db.Exec(`
+			INSERT INTO challenge_checks (user_id, criterion_id, book_id) VALUES (?, ?, ?)
+			ON CONFLICT(user_id, criterion_id) DO UPDATE SET book_id = excluded.book_id`,
+			u.ID, critID, book)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// ChallengeNewGET — GET /challenges/new
+func (a *App) ChallengeNewGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermModerate)
+	if !ok {
+		return
+	}
+	year := strconv.Itoa(time.Now().Year())
+	data := map[string]any{
+		"Title":     "New challenge",
+		"User":      u,
+		"CSRFToken": a.generateCSRF(r),
+		"Form":      map[string]string{"StartsOn": time.Now().Format(dateLayout), "EndsOn": year + "-12-31"},
+	}
+	a.render(w, "challenge_new.html", data)
+}
+
+// ChallengeNewPOST — POST /challenges/new
+// Form fields: csrf, title, description, starts_on, ends_on, criteria
+func (a *App) ChallengeNewPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermModerate)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	form := map[string]string{
+		"Title":       strings.TrimSpace(r.Form.Get("title")),
+		"Description": strings.TrimSpace(r.Form.Get("description")),
+		"StartsOn":    strings.TrimSpace(r.Form.Get("starts_on")),
+		"EndsOn":      strings.TrimSpace(r.Form.Get("ends_on")),
+		"Criteria":    r.Form.Get("criteria"),
+	}
+	fail := func(msg string) {
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "challenge_new.html", map[string]any{
+			"Title":     "New challenge",
+			"User":      u,
+			"CSRFToken": a.generateCSRF(r),
+			"Form":      form,
+			"Error":     msg,
+		})
+	}
+
+	if form["Title"] == "" {
+		fail("The title is required.")
+		return
+	}
+	start, err1 := time.Parse(dateLayout, form["StartsOn"])
+	end, err2 := time.Parse(dateLayout, form["EndsOn"])
+	if err1 != nil || err2 != nil {
+		fail("Dates must look like 2024-03-31.")
+		return
+	}
+	if end.Before(start) {
+		fail("The challenge has to end after it starts.")
+		return
+	}
+	items, err := parseCriteria(form["Criteria"])
+	if err != nil {
+		fail("Checklist: " + err.Error() + ".")
+		return
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO challenges (title, description, starts_on, ends_on, created_by) VALUES (?, ?, ?, ?, ?)`,
+		form["Title"], form["Description"], form["StartsOn"], form["EndsOn"], u.ID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	for i, label := range items {
+		if _, err := tx.Exec(`INSERT INTO challenge_criteria (challenge_id, position, label) VALUES (?, ?, ?)`, id, i+1, label); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/challenges/%d", id), http.StatusSeeOther)
+}
@@ -0,0 +1,481 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClubRead is a scheduled group read of one book.
+type ClubRead struct {
+	ID         int64
+	BookID     int64
+	BookTitle  string
+	Title      string
+	StartsOn   string // YYYY-MM-DD
+	EndsOn     string // opening date of the last milestone
+	CreatedBy  string
+	Milestones []Milestone
+}
+
+// Milestone is one section of a club read. Its discussion post is opened
+// by the scheduler on OpensOn.
+type Milestone struct {
+	ID          int64
+	Position    int
+	Label       string
+	UpToChapter int // 0 if the section isn't chapter-based
+	OpensOn     string
+	PostID      int64 // 0 until opened
+	Readers     []string
+	ReadByMe    bool
+}
+
+// Opened reports whether the milestone's discussion post exists yet.
+func (m Milestone) Opened() bool { return m.PostID > 0 }
+
+// maxMilestones bounds the schedule of one club read.
+const maxMilestones = 52
+
+// milestoneInput is one parsed line of the schedule textarea.
+type milestoneInput struct {
+	Label       string
+	UpToChapter sql.NullInt64
+	OpensOn     string
+}
+
+// parseSchedule reads the milestones textarea: one section per line as
+// "label | last chapter | date", where chapter and date are optional.
+// The first section opens on start by default, and each later one
+// intervalDays after the previous.
+func parseSchedule(raw string, start time.Time, intervalDays int) ([]milestoneInput, error) {
+	var out []milestoneInput
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "|")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		m := milestoneInput{Label: parts[0]}
+		if m.Label == "" {
+			return nil, fmt.Errorf("%q: every section needs a label", line)
+		}
+		if len(parts) > 1 && parts[1] != "" {
+			ch, err := parseSpoilerChapter(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("%q: %v", line, err)
+			}
+			m.UpToChapter = ch
+		}
+		opens := start
+		if n := len(out); n > 0 {
+			prev, _ := time.Parse(dateLayout, out[n-1].OpensOn)
+			opens = prev.AddDate(0, 0, intervalDays)
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			d, err := time.Parse(dateLayout, parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("%q: dates must look like 2024-03-31", line)
+			}
+			if d.Before(start) {
+				return nil, fmt.Errorf("%q: opens before the club read starts", line)
+			}
+			opens = d
+		}
+		m.OpensOn = opens.Format(dateLayout)
+		if n := len(out); n > 0 && m.OpensOn < out[n-1].OpensOn {
+			return nil, fmt.Errorf("%q: sections must be in date order", line)
+		}
+		out = append(out, m)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("add at least one section")
+	}
+	if len(out) > maxMilestones {
+		return nil, fmt.Errorf("a club read can have at most %d sections", maxMilestones)
+	}
+	return out, nil
+}
+
+// listClubReads returns every club read, newest start first, without
+// milestones.
+func listClubReads(db *sql.DB) ([]ClubRead, error) {
+	rows, err := db.Query(`
+		SELECT cr.id, cr.book_id, b.title, cr.title, cr.starts_on,
+		       COALESCE((SELECT MAX(opens_on) FROM club_milestones WHERE club_read_id = cr.id), cr.starts_on),
+		       u.username
+		FROM club_reads cr
+		JOIN books b ON b.id = cr.book_id
+		JOIN users u ON u.id = cr.created_by
+		ORDER BY cr.starts_on DESC, cr.id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ClubRead
+	for rows.Next() {
+		var c ClubRead
+		if err := rows.Scan(&c.ID, &c.BookID, &c.BookTitle, &c.Title, &c.StartsOn, &c.EndsOn, &c.CreatedBy); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// getClubRead loads a club read with its milestones and who has read each
+// section. viewerID marks the viewer's own progress; 0 for guests.
+func getClubRead(db *sql.DB, id, viewerID int64) (*ClubRead, error) {
+	var c ClubRead
+	err := db.QueryRow(`
+		SELECT cr.id, cr.book_id, b.title, cr.title, cr.starts_on, u.username
+		FROM club_reads cr
+		JOIN books b ON b.id = cr.book_id
+		JOIN users u ON u.id = cr.created_by
+		WHERE cr.id = ?`, id).
+		Scan(&c.ID, &c.BookID, &c.BookTitle, &c.Title, &c.StartsOn, &c.CreatedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT m.id, m.position, m.label, COALESCE(m.up_to_chapter, 0), m.opens_on, COALESCE(m.post_id, 0),
+		       COALESCE((SELECT GROUP_CONCAT(u.username, ',') FROM club_section_reads sr
+		                 JOIN users u ON u.id = sr.user_id WHERE sr.milestone_id = m.id), ''),
+		       EXISTS(SELECT 1 FROM club_section_reads WHERE milestone_id = m.id AND user_id = ?)
+		FROM club_milestones m
+		WHERE m.club_read_id = ?
+		ORDER BY m.position`, viewerID, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m Milestone
+		var readers string
+		if err := rows.Scan(&m.ID, &m.Position, &m.Label, &m.UpToChapter, &m.OpensOn, &m.PostID, &readers, &m.ReadByMe); err != nil {
+			return nil, err
+		}
+		if readers != "" {
+			m.Readers = strings.Split(readers, ",")
+		}
+		c.Milestones = append(c.Milestones, m)
+		c.EndsOn = m.OpensOn
+	}
+	return &c, rows.Err()
+}
+
+// openDueMilestones creates the discussion post of every milestone whose
+// date has come. The post is written as the moderator who set up the club
+// read, tagged with the book and a spoiler warning up to the section's last
+// chapter.
+func openDueMilestones(db *sql.DB, now time.Time) (int, error) {
+	rows, err := db.Query(`
+		SELECT m.id, m.label, m.up_to_chapter, cr.id, cr.title, cr.book_id, b.title, cr.created_by
+		FROM club_milestones m
+		JOIN club_reads cr ON cr.id = m.club_read_id
+		JOIN books b ON b.id = cr.book_id
+		WHERE m.post_id IS NULL AND m.opens_on <= ?
+		ORDER BY m.opens_on, m.position`, now.Format(dateLayout))
+	if err != nil {
+		return 0, err
+	}
+	type due struct {
+		id, clubID, bookID, authorID int64
+		label, club, book            string
+		chapter                      sql.NullInt64
+	}
+	var list []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.label, &d.chapter, &d.clubID, &d.club, &d.bookID, &d.book, &d.authorID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		list = append(list, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	opened := 0
+	for _, d := range list {
+		title := d.club + ": " + d.label
+		content := fmt.Sprintf("This is the club read discussion for **%s** of *%s*.\n\n"+
+			"Mark the section as read on the [schedule](/clubs/%d) once you're done, and share your thoughts below.",
+			d.label, d.book, d.clubID)
+		if err := openMilestone(db, d.id, d.authorID, d.bookID, title, content, d.chapter); err != nil {
+			return opened, err
+		}
+		opened++
+	}
+	return opened, nil
+}
+
+// openMilestone inserts one milestone's post and links it, in a
+// transaction so a milestone is never opened twice.
+func openMilestone(db *sql.DB, milestoneID, authorID, bookID int64, title, content string, chapter sql.NullInt64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO posts (user_id, title, content, content_html, content_masked, spoiler_chapter, book_id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		authorID, title, content, renderMarkdown(content), maskSpoilers(content), chapter, bookID)
+	if err != nil {
+		return err
+	}
+	postID, _ := res.LastInsertId()
+	res, err = tx.Exec(`UPDATE club_milestones SET post_id = ? WHERE id = ? AND post_id IS NULL`, postID, milestoneID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil // opened meanwhile; drop our copy
+	}
+	return tx.Commit()
+}
+
+// openClubMilestonesJob is the scheduler job for club reads.
+func (a *App) openClubMilestonesJob(now time.Time) {
+	n, err := openDueMilestones(a.db, now)
+	if err != nil {
+		log.Printf("club reads: %v", err)
+	}
+	if n > 0 {
+		log.Printf("club reads: opened %d discussion(s)", n)
+	}
+}
+
+// ClubsRouter handles /clubs, /clubs/new and /clubs/{id}.
+func (a *App) ClubsRouter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/clubs"), "/")
+	switch {
+	case rest == "":
+		a.ClubListGET(w, r)
+	case rest == "new" && r.Method == http.MethodPost:
+		a.ClubNewPOST(w, r)
+	case rest == "new":
+		a.ClubNewGET(w, r)
+	default:
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			a.renderError(w, http.StatusNotFound, "Club read not found.")
+			return
+		}
+		a.ClubViewGET(w, r, id)
+	}
+}
+
+// ClubListGET — GET /clubs
+func (a *App) ClubListGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+	clubs, err := listClubReads(a.db)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	today := time.Now().Format(dateLayout)
+	var current, upcoming, past []ClubRead
+	for _, c := range clubs {
+		switch {
+		case c.StartsOn > today:
+			upcoming = append(upcoming, c)
+		case c.EndsOn < today:
+			past = append(past, c)
+		default:
+			current = append(current, c)
+		}
+	}
+	data := map[string]any{
+		"Title":    "Club reads",
+		"User":     u,
+		"Current":  current,
+		"Upcoming": upcoming,
+		"Past":     past,
+	}
+	a.render(w, "clubs.html", data)
+}
+
+// ClubNewGET — GET /clubs/new (moderators)
+func (a *App) ClubNewGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermModerate)
+	if !ok {
+		return
+	}
+	books, _ := listBooks(a.db, "")
+	data := map[string]any{
+		"Title":     "New club read",
+		"User":      u,
+		"Books":     books,
+		"CSRFToken": a.generateCSRF(r),
+		"Form": map[string]string{
+			"Book":     r.URL.Query().Get("book"),
+			"StartsOn": time.Now().Format(dateLayout),
+			"Interval": "7",
+		},
+	}
+	a.render(w, "club_new.html", data)
+}
+
+// ClubNewPOST — POST /clubs/new (moderators)
+// Form fields: book, title, starts_on, interval (days), schedule
+func (a *App) ClubNewPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermModerate)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	form := map[string]string{
+		"Book":     r.Form.Get("book"),
+		"Title":    strings.TrimSpace(r.Form.Get("title")),
+		"StartsOn": strings.TrimSpace(r.Form.Get("starts_on")),
+		"Interval": strings.TrimSpace(r.Form.Get("interval")),
+		"Schedule": r.Form.Get("schedule"),
+	}
+	fail := func(msg string) {
+		books, _ := listBooks(a.db, "")
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "club_new.html", map[string]any{
+			"Title":     "New club read",
+			"User":      u,
+			"Books":     books,
+			"CSRFToken": a.generateCSRF(r),
+			"Form":      form,
+			"Error":     msg,
+		})
+	}
+
+	bookID, err := parseBookID(a.db, form["Book"])
+	if err != nil || !bookID.Valid {
+		fail("Pick the book the club is reading.")
+		return
+	}
+	book, err := getBook(a.db, bookID.Int64)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if form["Title"] == "" {
+		form["Title"] = book.Title + " club read"
+	}
+	start, err := time.Parse(dateLayout, form["StartsOn"])
+	if err != nil {
+		fail("The start date must look like 2024-03-31.")
+		return
+	}
+	interval, err := strconv.Atoi(form["Interval"])
+	if err != nil || interval < 1 || interval > 90 {
+		fail("Sections open every 1 to 90 days.")
+		return
+	}
+	schedule, err := parseSchedule(form["Schedule"], start, interval)
+	if err != nil {
+		fail("Schedule: " + err.Error() + ".")
+		return
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO club_reads (book_id, title, starts_on, created_by) VALUES (?, ?, ?, ?)`,
+		bookID.Int64, form["Title"], form["StartsOn"], u.ID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	clubID, _ := res.LastInsertId()
+	for i, m := range schedule {
+		if _, err := tx.Exec(`INSERT INTO club_milestones (club_read_id, position, label, up_to_chapter, opens_on) VALUES (?, ?, ?, ?, ?)`,
+			clubID, i+1, m.Label, m.UpToChapter, m.OpensOn); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	// sections due today open right away rather than on the next tick
+	a.openClubMilestonesJob(time.Now())
+	http.Redirect(w, r, fmt.Sprintf("/clubs/%d", clubID), http.StatusSeeOther)
+}
+
+// ClubViewGET — GET /clubs/{id}
+// The schedule, with links to opened discussions and who has read what.
+func (a *App) ClubViewGET(w http.ResponseWriter, r *http.Request, id int64) {
+	u, _ := a.currentUser(r)
+	var viewerID int64
+	if u != nil {
+		viewerID = u.ID
+	}
+	club, err := getClubRead(a.db, id, viewerID)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Club read not found.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	events, _ := listEvents(a.db, eventFilter{ClubID: id, ViewerID: viewerID})
+	data := map[string]any{
+		"Title":     club.Title,
+		"User":      u,
+		"Club":      club,
+		"Events":    events,
+		"Today":     time.Now().Format(dateLayout),
+		"CSRFToken": a.generateCSRF(r),
+	}
+	a.render(w, "club.html", data)
+}
+
+// ClubSectionReadPOST — POST /clubs/read
+// Form fields: milestone_id, undo=1
+// Marks a section of a club read as read (or not) for the current user.
+func (a *App) ClubSectionReadPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	milestoneID, _ := strconv.ParseInt(r.Form.Get("milestone_id"), 10, 64)
+	var clubID int64
+	err := a.db.QueryRow(`SELECT club_read_id FROM club_milestones WHERE id = ?`, milestoneID).Scan(&clubID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "unknown section", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if r.Form.Get("undo") == "1" {
+		_, err = a.db.Exec(`DELETE FROM club_section_reads WHERE milestone_id = ? AND user_id = ?`, milestoneID, u.ID)
+	} else {
+		_, err = a.db.Exec(`INSERT OR IGNORE INTO club_section_reads (milestone_id, user_id) VALUES (?, ?)`, milestoneID, u.ID)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/clubs/%d#section-%d", clubID, milestoneID), http.StatusSeeOther)
+}
@@ -3,135 +3,97 @@ package app
 import (
 	"database/sql"
 	"os"
+	"strings"
 
 	_ "modernc.org/sqlite" // pure-Go SQLite driver (no CGO)
 )
 
-// openDB opens forum.db and ensures the schema exists.
-func openDB() (*sql.DB, error) {
+// openRawDB opens forum.db without touching the schema.
+func openRawDB() (*sql.DB, error) {
 	path := os.Getenv("DB_PATH")
 	if path == "" {
 		path = "forum.db" // default for local dev
 	}
-	// DSN for modernc: use driver name "sqlite"
-	db, err := sql.Open("sqlite", "file:"+ path)
+	// DSN for modernc: use driver name "sqlite"; the pragma is applied to
+	// every pooled connection, not just the first one
+	return sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)")
+}
+
+// openDB opens forum.db and applies any pending migrations.
+func openDB() (*sql.DB, error) {
+	db, err := openRawDB()
 	if err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec(schemaSQL); err != nil {
-		_ = db.Close()
-		return nil, err
-	}
-  	if err := migrateUserProfile(db); err != nil {
+	if _, err := migrateUp(db); err != nil {
 		_ = db.Close()
 		return nil, err
 	}
 	return db, nil
 }
 
-const schemaSQL = `
-PRAGMA foreign_keys = ON;
-
-CREATE TABLE IF NOT EXISTS users (
-  id INTEGER PRIMARY KEY AUTOINCREMENT,
-  email TEXT NOT NULL UNIQUE,
-  username TEXT NOT NULL UNIQUE,
-  password_hash BLOB NOT NULL,
-  display_name TEXT NOT NULL DEFAULT '',
-  bio TEXT NOT NULL DEFAULT '',
-  avatar_path TEXT NOT NULL DEFAULT '',
-  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-);
-
-
-CREATE TABLE IF NOT EXISTS sessions (
-  token TEXT PRIMARY KEY,
-  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-  expires_at INTEGER NOT NULL, -- store unix seconds
-  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-);
-
-
-CREATE TABLE IF NOT EXISTS categories (
-  id INTEGER PRIMARY KEY AUTOINCREMENT,
-  name TEXT NOT NULL UNIQUE
-);
-
-CREATE TABLE IF NOT EXISTS posts (
-  id INTEGER PRIMARY KEY AUTOINCREMENT,
-  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-  title TEXT NOT NULL,
-  content TEXT NOT NULL,
-  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-);
-
-CREATE TABLE IF NOT EXISTS post_categories (
-  post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
-  category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
-  PRIMARY KEY (post_id, category_id)
-);
-
-CREATE TABLE IF NOT EXISTS comments (
-  id INTEGER PRIMARY KEY AUTOINCREMENT,
-  post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
-  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-  content TEXT NOT NULL,
-  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-);
-
-CREATE TABLE IF NOT EXISTS post_reactions (
-  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-  post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
-  value INTEGER NOT NULL CHECK (value IN (-1, 1)),
-  PRIMARY KEY (user_id, post_id)
-);
-
-CREATE TABLE IF NOT EXISTS comment_reactions (
-  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-  comment_id INTEGER NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
-  value INTEGER NOT NULL CHECK (value IN (-1, 1)),
-  PRIMARY KEY (user_id, comment_id)
-);
-`
-// migrateUserProfile ensures the users table has profile columns.
-func migrateUserProfile(db *sql.DB) error {
-	rows, err := db.Query(`PRAGMA table_info(users)`)
-	if err != nil {
+// dbtx is what *sql.DB and *sql.Tx have in common, so helpers can run
+// either standalone or inside a transaction.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// setPostCategories replaces a post's categories with the comma-separated
+// names in raw, creating categories that don't exist yet.
+func setPostCategories(db dbtx, postID int64, raw string) error {
+	if _, err := db.Exec(`DELETE FROM post_categories WHERE post_id = ?`, postID); err != nil {
 		return err
 	}
-	defer rows.Close()
-	cols := map[string]bool{}
-	for rows.Next() {
-		var cid int
-		var name, ctype string
-		var notnull, pk int
-		var dflt sql.NullString
-		_ = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
-		cols[name] = true
-	}
-	if !cols["display_name"] {
-		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT ''`); err != nil {
+	for _, c := range strings.Split(raw, ",") {
+		name := strings.TrimSpace(c)
+		if name == "" {
+			continue
+		}
+		// create category if missing
+		if _, err := db.Exec(`INSERT OR IGNORE INTO categories (name) VALUES (?)`, name); err != nil {
 			return err
 		}
-	}
-	if !cols["bio"] {
-		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT ''`); err != nil {
+		var catID int64
+		if err := db.QueryRow(`SELECT id FROM categories WHERE name = ?`, name).Scan(&catID); err != nil {
 			return err
 		}
-	}
-	if !cols["avatar_path"] {
-		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN avatar_path TEXT NOT NULL DEFAULT ''`); err != nil {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO post_categories (post_id, category_id) VALUES (?, ?)`, postID, catID); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// postCategoryNames returns the names of a post's categories.
+func postCategoryNames(db dbtx, postID int64) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT c.name
+		FROM categories c
+		JOIN post_categories pc ON pc.category_id = c.id
+		WHERE pc.post_id = ?
+		ORDER BY c.name`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	return names, rows.Err()
+}
+
 // GetUserByUsername returns full user information by username.
 func GetUserByUsername(db *sql.DB, username string) (*User, error) {
 	var u User
-	err := db.QueryRow(`SELECT id, email, username, display_name, bio, avatar_path FROM users WHERE username = ?`, username).
-		Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.Bio, &u.AvatarPath)
+	err := db.QueryRow(`SELECT id, email, username, display_name, bio, avatar_path, role, suspended_until FROM users WHERE username = ?`, username).
+		Scan(&u.ID, &u.Email, &u.Username, &u.DisplayName, &u.Bio, &u.AvatarPath, &u.Role, &u.SuspendedUntil)
 	if err != nil {
 		return nil, err
 	}
@@ -153,14 +115,14 @@ func UpdateUserAvatar(db *sql.DB, userID int64, path string) error {
 // CountUserPosts returns number of posts by user.
 func CountUserPosts(db *sql.DB, userID int64) (int, error) {
 	var c int
-	err := db.QueryRow(`SELECT COUNT(*) FROM posts WHERE user_id=?`, userID).Scan(&c)
+	err := db.QueryRow(`SELECT COUNT(*) FROM posts WHERE user_id=? AND hidden_at IS NULL AND deleted_at IS NULL`, userID).Scan(&c)
 	return c, err
 }
 
 // CountUserComments returns number of comments by user.
 func CountUserComments(db *sql.DB, userID int64) (int, error) {
 	var c int
-	err := db.QueryRow(`SELECT COUNT(*) FROM comments WHERE user_id=?`, userID).Scan(&c)
+	err := db.QueryRow(`SELECT COUNT(*) FROM comments WHERE user_id=? AND hidden_at IS NULL AND deleted_at IS NULL`, userID).Scan(&c)
 	return c, err
 }
 
@@ -193,7 +155,7 @@ type CommentWithPost struct {
 
 // ListPostsByAuthor returns posts for a user with total count.
 func ListPostsByAuthor(db *sql.DB, userID int64, offset, limit int) ([]Post, int, error) {
-	rows, err := db.Query(`SELECT id, title, created_at FROM posts WHERE user_id=? ORDER BY created_at DESC LIMIT ? OFFSET ?`, userID, limit, offset)
+	rows, err := db.Query(`SELECT id, title, created_at FROM posts WHERE user_id=? AND hidden_at IS NULL AND deleted_at IS NULL ORDER BY created_at DESC LIMIT ? OFFSET ?`, userID, limit, offset)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -206,7 +168,7 @@ func ListPostsByAuthor(db *sql.DB, userID int64, offset, limit int) ([]Post, int
 		}
 	}
 	var total int
-	_ = db.QueryRow(`SELECT COUNT(*) FROM posts WHERE user_id=?`, userID).Scan(&total)
+	_ = db.QueryRow(`SELECT COUNT(*) FROM posts WHERE user_id=? AND hidden_at IS NULL AND deleted_at IS NULL`, userID).Scan(&total)
 	return list, total, nil
 }
 
@@ -216,7 +178,7 @@ func ListCommentsByAuthor(db *sql.DB, userID int64, offset, limit int) ([]Commen
                 SELECT c.id, c.post_id, p.title, c.content, c.created_at
                 FROM comments c
                 JOIN posts p ON p.id = c.post_id
-                WHERE c.user_id=?
+                WHERE c.user_id=? AND c.hidden_at IS NULL AND c.deleted_at IS NULL AND p.hidden_at IS NULL AND p.deleted_at IS NULL
                 ORDER BY c.created_at DESC
                 LIMIT ? OFFSET ?`, userID, limit, offset)
 	if err != nil {
@@ -227,10 +189,13 @@ func ListCommentsByAuthor(db *sql.DB, userID int64, offset, limit int) ([]Commen
 	for rows.Next() {
 		var cmt CommentWithPost
 		if err := rows.Scan(&cmt.ID, &cmt.PostID, &cmt.PostTitle, &cmt.Content, &cmt.CreatedAt); err == nil {
+			cmt.Content = maskSpoilers(cmt.Content) // the listing shows source, not rendered HTML
 			list = append(list, cmt)
 		}
 	}
 	var total int
-	_ = db.QueryRow(`SELECT COUNT(*) FROM comments WHERE user_id=?`, userID).Scan(&total)
+	_ = db.QueryRow(`
+                SELECT COUNT(*) FROM comments c JOIN posts p ON p.id = c.post_id
+                WHERE c.user_id=? AND c.hidden_at IS NULL AND c.deleted_at IS NULL AND p.hidden_at IS NULL AND p.deleted_at IS NULL`, userID).Scan(&total)
 	return list, total, nil
 }
\ No newline at end of file
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"html/template"
+	"strings"
+	"unicode"
+)
+
+// diffOp is one run of a word-level diff.
+type diffOp struct {
+	Kind byte // '=', '+' or '-'
+	Text string
+}
+
+// maxDiffCells caps the LCS table; beyond it the changed middle is shown as
+// one delete plus one insert instead of burning memory on a huge table.
+const maxDiffCells = 4_000_000
+
+// diffTokens splits s into alternating runs of whitespace and non-whitespace
+// so that joining the tokens gives back s exactly.
+func diffTokens(s string) []string {
+	var toks []string
+	start := 0
+	var inSpace bool
+	for i, r := range s {
+		sp := unicode.IsSpace(r)
+		if i > 0 && sp != inSpace {
+			toks = append(toks, s[start:i])
+			start = i
+		}
+		inSpace = sp
+	}
+	if start < len(s) {
+		toks = append(toks, s[start:])
+	}
+	return toks
+}
+
+// wordDiff returns the word-level edit script that turns a into b.
+func wordDiff(a, b string) []diffOp {
+	at, bt := diffTokens(a), diffTokens(b)
+
+	// strip the common prefix and suffix; most edits are small
+	pre := 0
+	for pre < len(at) && pre < len(bt) && at[pre] == bt[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(at)-pre && suf < len(bt)-pre && at[len(at)-1-suf] == bt[len(bt)-1-suf] {
+		suf++
+	}
+
+	var ops []diffOp
+	push := func(kind byte, text string) {
+		if text == "" {
+			return
+		}
+		if n := len(ops); n > 0 && ops[n-1].Kind == kind {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, diffOp{Kind: kind, Text: text})
+	}
+
+	push('=', strings.Join(at[:pre], ""))
+	am, bm := at[pre:len(at)-suf], bt[pre:len(bt)-suf]
+	if len(am)*len(bm) > maxDiffCells {
+		push('-', strings.Join(am, ""))
+		push('+', strings.Join(bm, ""))
+	} else {
+		// lcs[i][j] = length of the LCS of am[i:] and bm[j:]
+		lcs := make([][]int32, len(am)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(bm)+1)
+		}
+		for i := len(am) - 1; i >= 0; i-- {
+			for j := len(bm) - 1; j >= 0; j-- {
+				if am[i] == bm[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(am) && j < len(bm) {
+			switch {
+			case am[i] == bm[j]:
+				push('=', am[i])
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				push('-', am[i])
+				i++
+			default:
+				push('+', bm[j])
+				j++
+			}
+		}
+		push('-', strings.Join(am[i:], ""))
+		push('+', strings.Join(bm[j:], ""))
+	}
+	push('=', strings.Join(at[len(at)-suf:], ""))
+	return ops
+}
+
+// diffHTML renders a word diff with <del>/<ins> around changed runs.
+func diffHTML(a, b string) template.HTML {
+	var sb strings.Builder
+	for _, op := range wordDiff(a, b) {
+		text := template.HTMLEscapeString(op.Text)
+		switch op.Kind {
+		case '+':
+			sb.WriteString("<ins>" + text + "</ins>")
+		case '-':
+			sb.WriteString("<del>" + text + "</del>")
+		default:
+			sb.WriteString(text)
+		}
+	}
+	return template.HTML(sb.String())
+}
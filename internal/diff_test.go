@@ -0,0 +1,61 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWordDiff(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []diffOp
+	}{
+		{"", "", nil},
+		{"same text", "same text", []diffOp{{'=', "same text"}}},
+		{"", "new", []diffOp{{'+', "new"}}},
+		{"old", "", []diffOp{{'-', "old"}}},
+		{"the quick fox", "the slow fox", []diffOp{{'=', "the "}, {'-', "quick"}, {'+', "slow"}, {'=', " fox"}}},
+		{"a b c", "a c", []diffOp{{'=', "a "}, {'-', "b "}, {'=', "c"}}},
+		{"a c", "a b c", []diffOp{{'=', "a "}, {'+', "b "}, {'=', "c"}}},
+		{"one two", "one  two", []diffOp{{'=', "one"}, {'-', " "}, {'+', "  "}, {'=', "two"}}},
+	}
+	for _, tt := range tests {
+		if got := wordDiff(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wordDiff(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// TestWordDiffRebuilds checks that every script turns a into b, including
+// one past maxDiffCells that falls back to a single delete and insert.
+func TestWordDiffRebuilds(t *testing.T) {
+	long := func(word string) string { return strings.Repeat(word+" ", 2100) }
+	pairs := [][2]string{
+		{"It was the best of times,\nit was the worst of times", "It was the best of times;\nit was the age of wisdom"},
+		{"Call me Ishmael.", "Call me, please, Ishmael!"},
+		{"x " + long("a") + "y", "x " + long("b") + "y"},
+	}
+	for _, p := range pairs {
+		var a, b strings.Builder
+		for _, op := range wordDiff(p[0], p[1]) {
+			if op.Kind != '+' {
+				a.WriteString(op.Text)
+			}
+			if op.Kind != '-' {
+				b.WriteString(op.Text)
+			}
+		}
+		if a.String() != p[0] || b.String() != p[1] {
+			t.Errorf("wordDiff(%.30q…, %.30q…) doesn't rebuild its inputs", p[0], p[1])
+		}
+	}
+}
+
+func TestDiffHTML(t *testing.T) {
+	got := diffHTML("<b>bold</b> & more", "<i>bold</i> & more")
+	want := "<del>&lt;b&gt;bold&lt;/b&gt;</del><ins>&lt;i&gt;bold&lt;/i&gt;</ins> &amp; more"
+	if string(got) != want {
+		t.Errorf("diffHTML = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,614 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // event time zones work on hosts without a zoneinfo database
+
+	"github.com/google/uuid"
+)
+
+// RSVP states. A user with no row hasn't answered.
+const (
+	RSVPGoing    = "going"
+	RSVPMaybe    = "maybe"
+	RSVPDeclined = "declined"
+)
+
+// dbTimeLayout is how event times are stored: UTC, in the format SQLite's
+// datetime() produces, so they compare directly with datetime('now').
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+// formTimeLayout is what <input type="datetime-local"> submits.
+const formTimeLayout = "2006-01-02T15:04"
+
+// maxEventCapacity bounds the capacity field; 0 means unlimited.
+const maxEventCapacity = 100000
+
+// commonTimeZones are suggested in the event form; any IANA name works.
+var commonTimeZones = []string{
+	"UTC", "Europe/London", "Europe/Berlin", "Europe/Helsinki", "Europe/Tallinn",
+	"America/New_York", "America/Chicago", "America/Los_Angeles", "Asia/Tokyo", "Australia/Sydney",
+}
+
+// Event is a meetup tied to a category or a club read.
+type Event struct {
+	ID           int64
+	Title        string
+	Description  string
+	CategoryID   int64
+	CategoryName string
+	ClubID       int64
+	ClubTitle    string
+	Start        time.Time // in the event's time zone
+	End          time.Time
+	TimeZone     string
+	Location     string
+	URL          string // virtual meeting link
+	Capacity     int    // 0 = unlimited
+	Going        int
+	Maybe        int
+	MyRSVP       string
+	CreatedBy    string
+}
+
+// WhenText is the event's time as shown on pages, in its own time zone.
+func (e Event) WhenText() string {
+	start := e.Start.Format("Mon 2 Jan 2006, 15:04")
+	if e.End.Format("2006-01-02") == e.Start.Format("2006-01-02") {
+		return start + "–" + e.End.Format("15:04 MST")
+	}
+	return e.Start.Format("Mon 2 Jan 2006, 15:04 MST") + " – " + e.End.Format("Mon 2 Jan 2006, 15:04 MST")
+}
+
+// StartISO is the start as RFC 3339, for <time datetime>.
+func (e Event) StartISO() string { return e.Start.Format(time.RFC3339) }
+
+// Full reports whether every place is taken.
+func (e Event) Full() bool { return e.Capacity > 0 && e.Going >= e.Capacity }
+
+// SpotsLeft is the number of free places; meaningless when Capacity is 0.
+func (e Event) SpotsLeft() int { return e.Capacity - e.Going }
+
+// Past reports whether the event is over.
+func (e Event) Past() bool { return e.End.Before(time.Now()) }
+
+// eventColumns selects everything scanEvent reads; viewerID goes first in
+// the arguments for the viewer's own RSVP.
+const eventColumns = `
+	e.id, e.title, e.description, COALESCE(e.category_id, 0), COALESCE(c.name, ''),
+	COALESCE(e.club_read_id, 0), COALESCE(cr.title, ''), e.starts_at, e.ends_at, e.time_zone,
+	e.location, e.url, e.capacity,
+	(SELECT COUNT(*) FROM event_rsvps r WHERE r.event_id = e.id AND r.status = 'going'),
+	(SELECT COUNT(*) FROM event_rsvps r WHERE r.event_id = e.id AND r.status = 'maybe'),
+	COALESCE((SELECT status FROM event_rsvps r WHERE r.event_id = e.id AND r.user_id = ?), ''),
+	u.username
+	FROM events e
+	LEFT JOIN categories c ON c.id = e.category_id
+	LEFT JOIN club_reads cr ON cr.id = e.club_read_id
+	JOIN users u ON u.id = e.created_by`
+
+func scanEvent(sc interface{ Scan(...any) error }) (Event, error) {
+	var e Event
+	var start, end string
+	err := sc.Scan(&e.ID, &e.Title, &e.Description, &e.CategoryID, &e.CategoryName,
+		&e.ClubID, &e.ClubTitle, &start, &end, &e.TimeZone,
+		&e.Location, &e.URL, &e.Capacity, &e.Going, &e.Maybe, &e.MyRSVP, &e.CreatedBy)
+	if err != nil {
+		return e, err
+	}
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	s, _ := time.ParseInLocation(dbTimeLayout, start, time.UTC)
+	t, _ := time.ParseInLocation(dbTimeLayout, end, time.UTC)
+	e.Start, e.End = s.In(loc), t.In(loc)
+	return e, nil
+}
+
+// Category is a forum category, for pickers.
+type Category struct {
+	ID   int64
+	Name string
+}
+
+// listCategories returns all categories by name.
+func listCategories(db *sql.DB) ([]Category, error) {
+	rows, err := db.Query(`SELECT id, name FROM categories ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// eventFilter narrows listEvents. Zero fields don't filter.
+type eventFilter struct {
+	CategoryID int64
+	ClubID     int64
+	AttendeeID int64 // events the user is going to or might go to
+	Past       bool  // ended events, newest first, instead of upcoming ones
+	ViewerID   int64
+}
+
+// listEvents returns events matching f.
+func listEvents(db *sql.DB, f eventFilter) ([]Event, error) {
+	where := []string{"e.ends_at >= datetime('now')"}
+	order := "e.starts_at"
+	if f.Past {
+		where[0] = "e.ends_at < datetime('now')"
+		order = "e.starts_at DESC"
+	}
+	args := []any{f.ViewerID}
+	if f.CategoryID > 0 {
+		where = append(where, "e.category_id = ?")
+		args = append(args, f.CategoryID)
+	}
+	if f.ClubID > 0 {
+		where = append(where, "e.club_read_id = ?")
+		args = append(args, f.ClubID)
+	}
+	if f.AttendeeID > 0 {
+		where = append(where, "EXISTS (SELECT 1 FROM event_rsvps r WHERE r.event_id = e.id AND r.user_id = ? AND r.status IN ('going', 'maybe'))")
+		args = append(args, f.AttendeeID)
+	}
+	rows, err := db.Query(`SELECT `+eventColumns+` WHERE `+strings.Join(where, " AND ")+` ORDER BY `+order+` LIMIT 200`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Event
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// getEvent loads one event; viewerID fills MyRSVP.
+func getEvent(db dbtx, id, viewerID int64) (*Event, error) {
+	e, err := scanEvent(db.QueryRow(`SELECT `+eventColumns+` WHERE e.id = ?`, viewerID, id))
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// eventAttendees lists who answered going or maybe.
+func eventAttendees(db *sql.DB, eventID int64) (going, maybe []string, err error) {
+	rows, err := db.Query(`
+		SELECT u.username, r.status FROM event_rsvps r JOIN users u ON u.id = r.user_id
+		WHERE r.event_id = ? AND r.status IN ('going', 'maybe')
+		ORDER BY r.updated_at`, eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, status string
+		if err := rows.Scan(&name, &status); err != nil {
+			return nil, nil, err
+		}
+		if status == RSVPGoing {
+			going = append(going, name)
+		} else {
+			maybe = append(maybe, name)
+		}
+	}
+	return going, maybe, rows.Err()
+}
+
+// eventInput is a validated event form.
+type eventInput struct {
+	Title, Description, TimeZone, Location, URL string
+	CategoryID, ClubID                          sql.NullInt64
+	Start, End                                  time.Time
+	Capacity                                    int
+}
+
+// parseEventForm validates the event form. Times are entered as local
+// times in the chosen zone.
+func parseEventForm(db *sql.DB, form map[string]string) (eventInput, error) {
+	in := eventInput{
+		Title:       form["Title"],
+		Description: form["Description"],
+		TimeZone:    form["TimeZone"],
+		Location:    form["Location"],
+		URL:         form["URL"],
+	}
+	if in.Title == "" {
+		return in, errors.New("The title is required.")
+	}
+	if id, _ := strconv.ParseInt(form["Category"], 10, 64); id > 0 {
+		var n int
+		_ = db.QueryRow(`SELECT COUNT(*) FROM categories WHERE id = ?`, id).Scan(&n)
+		if n == 0 {
+			return in, errors.New("That category doesn't exist.")
+		}
+		in.CategoryID = sql.NullInt64{Int64: id, Valid: true}
+	}
+	if id, _ := strconv.ParseInt(form["Club"], 10, 64); id > 0 {
+		var n int
+		_ = db.QueryRow(`SELECT COUNT(*) FROM club_reads WHERE id = ?`, id).Scan(&n)
+		if n == 0 {
+			return in, errors.New("That club read doesn't exist.")
+		}
+		in.ClubID = sql.NullInt64{Int64: id, Valid: true}
+	}
+	if !in.CategoryID.Valid && !in.ClubID.Valid {
+		return in, errors.New("Pick the category or club read the event belongs to.")
+	}
+	loc, err := time.LoadLocation(in.TimeZone)
+	if err != nil || in.TimeZone == "" || in.TimeZone == "Local" {
+		return in, errors.New("Use a time zone name like Europe/Tallinn or UTC.")
+	}
+	if in.Start, err = time.ParseInLocation(formTimeLayout, form["StartsAt"], loc); err != nil {
+		return in, errors.New("The start time is missing or malformed.")
+	}
+	if in.End, err = time.ParseInLocation(formTimeLayout, form["EndsAt"], loc); err != nil {
+		return in, errors.New("The end time is missing or malformed.")
+	}
+	if !in.End.After(in.Start) {
+		return in, errors.New("The event has to end after it starts.")
+	}
+	if in.URL != "" && !strings.HasPrefix(in.URL, "https://") && !strings.HasPrefix(in.URL, "http://") {
+		return in, errors.New("The meeting link must start with https:// or http://.")
+	}
+	if in.Location == "" && in.URL == "" {
+		return in, errors.New("Give a location or a meeting link.")
+	}
+	if form["Capacity"] != "" {
+		in.Capacity, err = strconv.Atoi(form["Capacity"])
+		if err != nil || in.Capacity < 0 || in.Capacity > maxEventCapacity {
+			return in, errors.New("Capacity must be a number of people, or empty for no limit.")
+		}
+	}
+	return in, nil
+}
+
+// EventsRouter handles everything under /events:
+//
+//	/events                      upcoming events (?cat=, ?past=1)
+//	/events/new                  create (moderators)
+//	/events/{id}                 details and RSVP
+//	/events/{id}.ics             one event
+//	/events/category/{id}.ics    a category's events
+//	/events/user/{token}.ics     events a member is going to
+//	/events/rsvp                 POST
+//	/events/feed/reset           POST, new private feed URL
+func (a *App) EventsRouter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/events"), "/")
+	post := r.Method == http.MethodPost
+	switch {
+	case rest == "":
+		a.EventListGET(w, r)
+	case rest == "new" && post:
+		a.EventNewPOST(w, r)
+	case rest == "new":
+		a.EventNewGET(w, r)
+	case rest == "rsvp" && post:
+		a.EventRSVPPOST(w, r)
+	case rest == "feed/reset" && post:
+		a.EventFeedResetPOST(w, r)
+	case strings.HasPrefix(rest, "category/") && strings.HasSuffix(rest, ".ics"):
+		id, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(rest, "category/"), ".ics"), 10, 64)
+		a.CategoryFeedGET(w, r, id)
+	case strings.HasPrefix(rest, "user/") && strings.HasSuffix(rest, ".ics"):
+		a.UserFeedGET(w, r, strings.TrimSuffix(strings.TrimPrefix(rest, "user/"), ".ics"))
+	case strings.HasSuffix(rest, ".ics"):
+		id, _ := strconv.ParseInt(strings.TrimSuffix(rest, ".ics"), 10, 64)
+		a.EventFeedGET(w, r, id)
+	default:
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil || post {
+			a.renderError(w, http.StatusNotFound, "Event not found.")
+			return
+		}
+		a.EventViewGET(w, r, id)
+	}
+}
+
+// EventListGET — GET /events?cat=ID&past=1
+func (a *App) EventListGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+	f := eventFilter{Past: r.URL.Query().Get("past") == "1"}
+	f.CategoryID, _ = strconv.ParseInt(r.URL.Query().Get("cat"), 10, 64)
+	if u != nil {
+		f.ViewerID = u.ID
+	}
+	events, err := listEvents(a.db, f)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	cats, _ := listCategories(a.db)
+	data := map[string]any{
+		"Title":     "Events",
+		"User":      u,
+		"Events":    events,
+		"Cats":      cats,
+		"FilterCat": f.CategoryID,
+		"Past":      f.Past,
+		"CanCreate": u.Can(PermModerate),
+		"CSRFToken": a.generateCSRF(r),
+	}
+	if u != nil {
+		token, err := a.calendarToken(u.ID)
+		if err == nil {
+			data["FeedURL"] = a.siteURL + "/events/user/" + token + ".ics"
+		}
+	}
+	a.render(w, "events.html", data)
+}
+
+// EventViewGET — GET /events/{id}
+func (a *App) EventViewGET(w http.ResponseWriter, r *http.Request, id int64) {
+	u, _ := a.currentUser(r)
+	var viewerID int64
+	if u != nil {
+		viewerID = u.ID
+	}
+	e, err := getEvent(a.db, id, viewerID)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Event not found.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	going, maybe, _ := eventAttendees(a.db, id)
+	data := map[string]any{
+		"Title":     e.Title,
+		"User":      u,
+		"Event":     e,
+		"Going":     going,
+		"Maybe":     maybe,
+		"Error":     r.URL.Query().Get("err"),
+		"CSRFToken": a.generateCSRF(r),
+	}
+	a.render(w, "event.html", data)
+}
+
+// eventFormData is the data the event form renders with.
+func (a *App) eventFormData(r *http.Request, u *User, form map[string]string) map[string]any {
+	cats, _ := listCategories(a.db)
+	clubs, _ := listClubReads(a.db)
+	return map[string]any{
+		"Title":     "New event",
+		"User":      u,
+		"CSRFToken": a.generateCSRF(r),
+		"Cats":      cats,
+		"Clubs":     clubs,
+		"Zones":     commonTimeZones,
+		"Form":      form,
+	}
+}
+
+// EventNewGET — GET /events/new (moderators)
+func (a *App) EventNewGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermModerate)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	a.render(w, "event_new.html", a.eventFormData(r, u, map[string]string{
+		"Category": q.Get("cat"),
+		"Club":     q.Get("club"),
+		"TimeZone": "UTC",
+	}))
+}
+
+// EventNewPOST — POST /events/new (moderators)
+// Form fields: title, description, category, club, starts_at, ends_at,
+// time_zone, location, url, capacity
+func (a *App) EventNewPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermModerate)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	form := map[string]string{}
+	for key, field := range map[string]string{
+		"Title": "title", "Description": "description", "Category": "category", "Club": "club",
+		"StartsAt": "starts_at", "EndsAt": "ends_at", "TimeZone": "time_zone",
+		"Location": "location", "URL": "url", "Capacity": "capacity",
+	} {
+		form[key] = strings.TrimSpace(r.Form.Get(field))
+	}
+	in, err := parseEventForm(a.db, form)
+	if err != nil {
+		data := a.eventFormData(r, u, form)
+		data["Error"] = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "event_new.html", data)
+		return
+	}
+	res, err := a.db.Exec(`
+		INSERT INTO events (title, description, category_id, club_read_id, starts_at, ends_at, time_zone, location, url, capacity, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		in.Title, in.Description, in.CategoryID, in.ClubID,
+		in.Start.UTC().Format(dbTimeLayout), in.End.UTC().Format(dbTimeLayout), in.TimeZone,
+		in.Location, in.URL, in.Capacity, u.ID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	http.Redirect(w, r, fmt.Sprintf("/events/%d", id), http.StatusSeeOther)
+}
+
+// errEventFull is returned when a "going" RSVP would exceed the capacity.
+var errEventFull = errors.New("This event is full. You can still answer maybe.")
+
+// EventRSVPPOST — POST /events/rsvp
+// Form fields: event_id, status=going|maybe|declined, or empty to withdraw
+func (a *App) EventRSVPPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	id, _ := strconv.ParseInt(r.Form.Get("event_id"), 10, 64)
+	status := r.Form.Get("status")
+	if status != "" && status != RSVPGoing && status != RSVPMaybe && status != RSVPDeclined {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+	back := fmt.Sprintf("/events/%d", id)
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	e, err := getEvent(tx, id, u.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "unknown event", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if e.Past() {
+		http.Redirect(w, r, back+"?err="+url.QueryEscape("This event is over."), http.StatusSeeOther)
+		return
+	}
+	if status == RSVPGoing && e.MyRSVP != RSVPGoing && e.Full() {
+		http.Redirect(w, r, back+"?err="+url.QueryEscape(errEventFull.Error()), http.StatusSeeOther)
+		return
+	}
+	if status == "" {
+		_, err = tx.Exec(`DELETE FROM event_rsvps WHERE event_id = ? AND user_id = ?`, id, u.ID)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO event_rsvps (event_id, user_id, status) VALUES (?, ?, ?)
+			ON CONFLICT(event_id, user_id) DO UPDATE SET status = excluded.status, updated_at = CURRENT_TIMESTAMP`,
+			id, u.ID, status)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// calendarToken returns the secret that names the user's private feed,
+// creating it on first use. Calendar apps can't log in, so the URL itself
+// is the credential.
+func (a *App) calendarToken(userID int64) (string, error) {
+	var token sql.NullString
+	if err := a.db.QueryRow(`SELECT calendar_token FROM users WHERE id = ?`, userID).Scan(&token); err != nil {
+		return "", err
+	}
+	if token.Valid {
+		return token.String, nil
+	}
+	t := uuid.NewString()
+	if _, err := a.db.Exec(`UPDATE users SET calendar_token = ? WHERE id = ? AND calendar_token IS NULL`, t, userID); err != nil {
+		return "", err
+	}
+	err := a.db.QueryRow(`SELECT calendar_token FROM users WHERE id = ?`, userID).Scan(&token)
+	return token.String, err
+}
+
+// EventFeedResetPOST — POST /events/feed/reset
+// Replaces the private feed URL, e.g. after it was shared by mistake.
+func (a *App) EventFeedResetPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	if _, err := a.db.Exec(`UPDATE users SET calendar_token = ? WHERE id = ?`, uuid.NewString(), u.ID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/events", http.StatusSeeOther)
+}
+
+// serveICS writes events as a calendar file.
+func (a *App) serveICS(w http.ResponseWriter, name, filename string, events []Event) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	_ = writeICS(w, name, a.siteURL, events, time.Now())
+}
+
+// EventFeedGET — GET /events/{id}.ics
+func (a *App) EventFeedGET(w http.ResponseWriter, r *http.Request, id int64) {
+	e, err := getEvent(a.db, id, 0)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	a.serveICS(w, e.Title, fmt.Sprintf("event-%d.ics", id), []Event{*e})
+}
+
+// CategoryFeedGET — GET /events/category/{id}.ics
+// Upcoming and recent events, so a subscription keeps last week's meetup.
+func (a *App) CategoryFeedGET(w http.ResponseWriter, r *http.Request, id int64) {
+	var name string
+	if err := a.db.QueryRow(`SELECT name FROM categories WHERE id = ?`, id).Scan(&name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	upcoming, err := listEvents(a.db, eventFilter{CategoryID: id})
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	past, _ := listEvents(a.db, eventFilter{CategoryID: id, Past: true})
+	a.serveICS(w, "Literary Lions: "+name, fmt.Sprintf("category-%d.ics", id), append(upcoming, past...))
+}
+
+// UserFeedGET — GET /events/user/{token}.ics
+// The events a member is going to or might go to.
+func (a *App) UserFeedGET(w http.ResponseWriter, r *http.Request, token string) {
+	var userID int64
+	var username string
+	err := a.db.QueryRow(`SELECT id, username FROM users WHERE calendar_token = ?`, token).Scan(&userID, &username)
+	if token == "" || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	upcoming, err := listEvents(a.db, eventFilter{AttendeeID: userID})
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	past, _ := listEvents(a.db, eventFilter{AttendeeID: userID, Past: true})
+	a.serveICS(w, "Literary Lions: "+username, "my-events.ics", append(upcoming, past...))
+}
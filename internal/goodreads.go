@@ -0,0 +1,517 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportSize bounds an uploaded export; years of history fit easily.
+const maxImportSize = 5 << 20
+
+// importRow is one book from a Goodreads or StoryGraph export, already
+// mapped onto our shelves.
+type importRow struct {
+	Line       int
+	Title      string
+	Authors    string
+	ISBN       string // raw, as exported
+	Year       int
+	Pages      int
+	Status     string // one of shelfStatuses, "" if the shelf isn't one we know
+	Shelf      string // the shelf name in the export
+	StartedOn  string
+	FinishedOn string
+	Rating     Rating
+}
+
+// importColumns lists, per field, the header names used by Goodreads and by
+// StoryGraph. The first one present wins.
+var importColumns = map[string][]string{
+	"title":   {"Title"},
+	"authors": {"Author", "Authors"},
+	"isbn13":  {"ISBN13", "ISBN/UID"},
+	"isbn":    {"ISBN"},
+	"year":    {"Original Publication Year", "Year Published"},
+	"pages":   {"Number of Pages"},
+	"shelf":   {"Exclusive Shelf", "Read Status"},
+	"rating":  {"My Rating", "Star Rating"},
+	"read":    {"Date Read", "Last Date Read"},
+	"dates":   {"Dates Read"},
+	"extra":   {"Additional Authors"},
+}
+
+// importShelves maps export shelf names to ours. Goodreads users often name
+// their own "did not finish" shelf, so a few spellings are accepted.
+var importShelves = map[string]string{
+	"read":              ShelfFinished,
+	"currently-reading": ShelfReading,
+	"to-read":           ShelfWant,
+	"did-not-finish":    ShelfAbandoned,
+	"dnf":               ShelfAbandoned,
+	"abandoned":         ShelfAbandoned,
+	"paused":            ShelfReading,
+}
+
+var errNotAnExport = errors.New("this doesn't look like a Goodreads or StoryGraph export: there is no Title or shelf column")
+
+// parseExport reads a Goodreads or StoryGraph library export.
+func parseExport(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errNotAnExport
+	}
+	index := map[string]int{}
+	for i, h := range header {
+		index[strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))] = i
+	}
+	col := map[string]int{}
+	for field, names := range importColumns {
+		col[field] = -1
+		for _, n := range names {
+			if i, ok := index[n]; ok {
+				col[field] = i
+				break
+			}
+		}
+	}
+	if col["title"] < 0 || col["shelf"] < 0 {
+		return nil, errNotAnExport
+	}
+
+	var rows []importRow
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		get := func(field string) string {
+			i := col[field]
+			if i < 0 || i >= len(rec) {
+				return ""
+			}
+			// Goodreads writes ISBNs as ="0441013597" so spreadsheets keep the zeros
+			return strings.Trim(strings.TrimSpace(rec[i]), `="`)
+		}
+		row := importRow{
+			Line:    line,
+			Title:   get("title"),
+			Authors: get("authors"),
+			ISBN:    get("isbn13"),
+			Shelf:   strings.ToLower(get("shelf")),
+		}
+		if row.ISBN == "" {
+			row.ISBN = get("isbn")
+		}
+		if extra := get("extra"); extra != "" {
+			row.Authors += ", " + extra
+		}
+		row.Year, _ = strconv.Atoi(get("year"))
+		row.Pages, _ = strconv.Atoi(get("pages"))
+		row.Status = importShelves[row.Shelf]
+		// StoryGraph allows quarter stars; round to the nearest half
+		if stars, err := strconv.ParseFloat(get("rating"), 64); err == nil && stars > 0 && stars <= 5 {
+			row.Rating = Rating(math.Round(stars * 2))
+		}
+		row.FinishedOn = exportDate(get("read"))
+		// StoryGraph: "2023/01/02-2023/01/09, 2024/03/01-2024/03/20"; the last read counts
+		if dates := get("dates"); dates != "" {
+			ranges := strings.Split(dates, ",")
+			span := strings.SplitN(strings.TrimSpace(ranges[len(ranges)-1]), "-", 2)
+			row.StartedOn = exportDate(span[0])
+			if len(span) == 2 && row.FinishedOn == "" {
+				row.FinishedOn = exportDate(span[1])
+			}
+		}
+		if row.Status != ShelfFinished {
+			// a finish date on a book that isn't finished is a past read
+			row.FinishedOn = ""
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// exportDate converts the yyyy/mm/dd dates of both exports to dateLayout,
+// or "" when the date is missing or malformed.
+func exportDate(s string) string {
+	d, err := time.Parse("2006/01/02", strings.TrimSpace(s))
+	if err != nil {
+		return ""
+	}
+	return d.Format(dateLayout)
+}
+
+// importTitle drops the series suffix Goodreads appends to titles, so
+// "Dune (Dune Chronicles, #1)" matches and creates plain "Dune".
+func importTitle(title string) string {
+	if i := strings.LastIndex(title, " ("); i > 0 && strings.HasSuffix(title, ")") && strings.Contains(title[i:], "#") {
+		return strings.TrimSpace(title[:i])
+	}
+	return title
+}
+
+// Import outcomes, one per row of the report.
+const (
+	ImportAdded     = "added"
+	ImportUpdated   = "updated"
+	ImportUnchanged = "unchanged"
+	ImportConflict  = "conflict"
+	ImportDuplicate = "duplicate"
+	ImportSkipped   = "skipped"
+)
+
+// ImportItem is one line of the import report.
+type ImportItem struct {
+	Line    int
+	Title   string
+	BookID  int64 // 0 if skipped, or new in a dry run
+	NewBook bool
+	Status  string
+	Rating  Rating
+	Outcome string
+	Note    string
+}
+
+// ImportReport is what an import did, or in a dry run would do.
+type ImportReport struct {
+	DryRun   bool
+	Items    []ImportItem
+	NewBooks int
+	Counts   map[string]int // by outcome
+}
+
+// importOptions control how an import treats books already on the shelves.
+type importOptions struct {
+	DryRun bool
+	// Overwrite replaces shelf entries that disagree with the export;
+	// otherwise they are kept and reported as conflicts.
+	Overwrite bool
+}
+
+// runImport matches or creates a book for every row and fills the user's
+// shelves. Everything happens in one transaction, which a dry run rolls
+// back, so the report is exactly what committing would do.
+func runImport(db *sql.DB, userID int64, rows []importRow, opt importOptions) (*ImportReport, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rep := &ImportReport{DryRun: opt.DryRun, Counts: map[string]int{}}
+	seen := map[int64]int{} // book id -> line it was first imported from
+	for _, row := range rows {
+		it := ImportItem{Line: row.Line, Title: row.Title, Status: row.Status, Rating: row.Rating}
+		if err := importOne(tx, userID, row, opt, seen, &it); err != nil {
+			return nil, err
+		}
+		if it.NewBook {
+			rep.NewBooks++
+		}
+		if opt.DryRun && it.NewBook {
+			it.BookID = 0 // the id won't exist after the rollback
+		}
+		rep.Counts[it.Outcome]++
+		rep.Items = append(rep.Items, it)
+	}
+	if opt.DryRun {
+		return rep, nil
+	}
+	return rep, tx.Commit()
+}
+
+// importOne handles a single row, recording the outcome in it.
+func importOne(tx *sql.Tx, userID int64, row importRow, opt importOptions, seen map[int64]int, it *ImportItem) error {
+	title := importTitle(row.Title)
+	if title == "" {
+		it.Outcome, it.Note = ImportSkipped, "no title"
+		return nil
+	}
+	if row.Status == "" {
+		it.Outcome, it.Note = ImportSkipped, fmt.Sprintf("unknown shelf %q", row.Shelf)
+		return nil
+	}
+
+	var isbn sql.NullString
+	if row.ISBN != "" {
+		if n, err := normalizeISBN(row.ISBN); err == nil {
+			isbn = sql.NullString{String: n, Valid: true}
+		} else {
+			it.Note = "ISBN " + row.ISBN + " ignored: " + errBadISBN.Error()
+		}
+	}
+
+	bookID, err := matchBook(tx, title, row.Authors, isbn)
+	if err != nil {
+		return err
+	}
+	if bookID == 0 {
+		var year sql.NullInt64
+		if row.Year > 0 {
+			year = sql.NullInt64{Int64: int64(row.Year), Valid: true}
+		}
+		var pages sql.NullInt64
+		if row.Pages > 0 && row.Pages <= maxBookPages {
+			pages = sql.NullInt64{Int64: int64(row.Pages), Valid: true}
+		}
+		res, err := tx.Exec(`INSERT INTO books (title, authors, isbn, year, pages, created_by) VALUES (?, ?, ?, ?, ?, ?)`,
+			title, row.Authors, isbn, year, pages, userID)
+		if err != nil {
+			return err
+		}
+		bookID, _ = res.LastInsertId()
+		it.NewBook = true
+	}
+	it.BookID = bookID
+
+	if first, ok := seen[bookID]; ok {
+		it.Outcome, it.Note = ImportDuplicate, fmt.Sprintf("same book as line %d; only that line is used", first)
+		return nil
+	}
+	seen[bookID] = row.Line
+
+	in := shelfInput{Status: row.Status, ProgressUnit: "percent"}
+	if row.StartedOn != "" {
+		in.StartedOn = sql.NullString{String: row.StartedOn, Valid: true}
+	}
+	if row.FinishedOn != "" {
+		in.FinishedOn = sql.NullString{String: row.FinishedOn, Valid: true}
+	}
+	if row.Status == ShelfFinished {
+		in.Progress = 100
+	}
+	if row.Rating > 0 {
+		in.Rating = sql.NullInt64{Int64: int64(row.Rating), Valid: true}
+	}
+
+	existing, err := getShelfEntry(tx, userID, bookID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case existing == nil:
+		it.Outcome = ImportAdded
+	case existing.Status != in.Status || existing.Rating > 0 && in.Rating.Valid && int64(existing.Rating) != in.Rating.Int64:
+		note := "already " + strings.ToLower(shelfLabels[existing.Status])
+		if existing.Rating > 0 {
+			note += ", rated " + existing.Rating.String()
+		}
+		if !opt.Overwrite {
+			it.Outcome = ImportConflict
+			it.Note = joinNotes(it.Note, note+"; kept yours")
+			return nil
+		}
+		it.Outcome = ImportUpdated
+		it.Note = joinNotes(it.Note, note+"; replaced")
+	default:
+		// same shelf: only fill in what the entry is missing
+		if existing.StartedOn != "" {
+			in.StartedOn = sql.NullString{String: existing.StartedOn, Valid: true}
+		}
+		if existing.FinishedOn != "" {
+			in.FinishedOn = sql.NullString{String: existing.FinishedOn, Valid: true}
+		}
+		if existing.Rating > 0 {
+			in.Rating = sql.NullInt64{Int64: int64(existing.Rating), Valid: true}
+		}
+		in.Progress, in.ProgressUnit = existing.Progress, existing.ProgressUnit
+		if in.StartedOn.String == existing.StartedOn && in.FinishedOn.String == existing.FinishedOn &&
+			in.Rating.Int64 == int64(existing.Rating) {
+			it.Outcome = ImportUnchanged
+			return nil
+		}
+		it.Outcome = ImportUpdated
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO shelf_entries (user_id, book_id, status, started_on, finished_on, progress, progress_unit, rating)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, book_id) DO UPDATE SET
+		  status = excluded.status, started_on = excluded.started_on, finished_on = excluded.finished_on,
+		  progress = excluded.progress, progress_unit = excluded.progress_unit, rating = excluded.rating,
+		  updated_at = CURRENT_TIMESTAMP`,
+		userID, bookID, in.Status, in.StartedOn, in.FinishedOn, in.Progress, in.ProgressUnit, in.Rating)
+	return err
+}
+
+// matchBook finds an existing book by ISBN, then by title and author. It
+// returns 0 when there is none.
+func matchBook(tx *sql.Tx, title, authors string, isbn sql.NullString) (int64, error) {
+	var id int64
+	if isbn.Valid {
+		err := tx.QueryRow(`SELECT id FROM books WHERE isbn = ?`, isbn.String).Scan(&id)
+		if err != sql.ErrNoRows {
+			return id, err
+		}
+	}
+	err := tx.QueryRow(`
+		SELECT id FROM books
+		WHERE title = ? COLLATE NOCASE AND (authors = ? COLLATE NOCASE OR authors = '' OR ? = '')
+		ORDER BY id LIMIT 1`, title, authors, authors).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+func joinNotes(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "; " + b
+}
+
+// MeImportGET — GET /me/import
+func (a *App) MeImportGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	a.render(w, "me_import.html", map[string]any{
+		"Title":       "Import your reading history",
+		"User":        u,
+		"CSRFToken":   a.generateCSRF(r),
+		"ShelfLabels": shelfLabels,
+	})
+}
+
+// MeImportPOST — POST /me/import
+// Form fields: file (CSV upload) or csv (the text carried over from the
+// preview), overwrite=1, commit=1
+// Without commit the import is a dry run and the report is shown with a
+// button that submits the same file for real.
+func (a *App) MeImportPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	data := map[string]any{
+		"Title":       "Import your reading history",
+		"User":        u,
+		"CSRFToken":   a.generateCSRF(r),
+		"Overwrite":   r.FormValue("overwrite") == "1",
+		"ShelfLabels": shelfLabels,
+	}
+	fail := func(msg string) {
+		data["Error"] = msg
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "me_import.html", data)
+	}
+
+	text := r.FormValue("csv")
+	if f, _, err := r.FormFile("file"); err == nil {
+		b, err := io.ReadAll(io.LimitReader(f, maxImportSize+1))
+		f.Close()
+		if err != nil || len(b) > maxImportSize {
+			fail("The file is too large; exports up to 5 MB are supported.")
+			return
+		}
+		text = string(b)
+	}
+	if strings.TrimSpace(text) == "" {
+		fail("Choose your export file first.")
+		return
+	}
+	rows, err := parseExport(strings.NewReader(text))
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	rep, err := runImport(a.db, u.ID, rows, importOptions{
+		DryRun:    r.FormValue("commit") != "1",
+		Overwrite: r.FormValue("overwrite") == "1",
+	})
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	data["Report"] = rep
+	data["CSV"] = text
+	a.render(w, "me_import.html", data)
+}
+
+// ImportGoodreads is the `forumd import-goodreads` command:
+//
+//	forumd import-goodreads [-commit] [-overwrite] <username> <export.csv>
+//
+// Without -commit it only prints what the import would do.
+func ImportGoodreads(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import-goodreads", flag.ContinueOnError)
+	fs.SetOutput(out)
+	commit := fs.Bool("commit", false, "apply the import (default is a dry run)")
+	overwrite := fs.Bool("overwrite", false, "replace shelf entries that disagree with the export")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: forumd import-goodreads [-commit] [-overwrite] <username> <export.csv>")
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	u, err := GetUserByUsername(db, fs.Arg(0))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user %q", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rows, err := parseExport(f)
+	if err != nil {
+		return err
+	}
+	rep, err := runImport(db, u.ID, rows, importOptions{DryRun: !*commit, Overwrite: *overwrite})
+	if err != nil {
+		return err
+	}
+
+	for _, it := range rep.Items {
+		if it.Note == "" && (it.Outcome == ImportAdded || it.Outcome == ImportUnchanged) {
+			continue
+		}
+		fmt.Fprintf(out, "line %d\t%-9s\t%s", it.Line, it.Outcome, it.Title)
+		if it.Note != "" {
+			fmt.Fprintf(out, " (%s)", it.Note)
+		}
+		fmt.Fprintln(out)
+	}
+	verb := "imported"
+	if rep.DryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(out, "%s %d rows for %s: %d added, %d updated, %d unchanged, %d conflicts, %d duplicates, %d skipped; %d new books\n",
+		verb, len(rep.Items), u.Username, rep.Counts[ImportAdded], rep.Counts[ImportUpdated], rep.Counts[ImportUnchanged],
+		rep.Counts[ImportConflict], rep.Counts[ImportDuplicate], rep.Counts[ImportSkipped], rep.NewBooks)
+	if rep.DryRun {
+		fmt.Fprintln(out, "dry run: nothing was changed; run again with -commit to apply")
+	}
+	return nil
+}
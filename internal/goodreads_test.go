@@ -0,0 +1,70 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExportGoodreads(t *testing.T) {
+	csv := "\ufeffBook Id,Title,Author,Additional Authors,ISBN,ISBN13,My Rating,Original Publication Year,Date Read,Exclusive Shelf\n" +
+		`1,"Dune (Dune Chronicles, #1)",Frank Herbert,,="0441013597",="9780441013593",5,1965,2023/04/01,read` + "\n" +
+		`2,Good Omens,Terry Pratchett,Neil Gaiman,="",="",0,1990,2019/01/01,to-read` + "\n" +
+		`3,Ulysses,James Joyce,,,,0,,,dnf` + "\n" +
+		`4,Notes,Someone,,,,0,,,my-own-shelf` + "\n"
+	rows, err := parseExport(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []importRow{
+		{Line: 2, Title: "Dune (Dune Chronicles, #1)", Authors: "Frank Herbert", ISBN: "9780441013593", Year: 1965,
+			Status: ShelfFinished, Shelf: "read", FinishedOn: "2023-04-01", Rating: 10},
+		// a read date on an unfinished book is dropped
+		{Line: 3, Title: "Good Omens", Authors: "Terry Pratchett, Neil Gaiman", Year: 1990, Status: ShelfWant, Shelf: "to-read"},
+		{Line: 4, Title: "Ulysses", Authors: "James Joyce", Status: ShelfAbandoned, Shelf: "dnf"},
+		{Line: 5, Title: "Notes", Authors: "Someone", Shelf: "my-own-shelf"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("parseExport =\n  %+v\nwant\n  %+v", rows, want)
+	}
+}
+
+func TestParseExportStoryGraph(t *testing.T) {
+	csv := "Title,Authors,ISBN/UID,Read Status,Dates Read,Star Rating\n" +
+		`Piranesi,Susanna Clarke,9781635575637,read,"2021/01/02-2021/01/09, 2024/03/01-2024/03/20",4.25` + "\n" +
+		`Middlemarch,George Eliot,,currently-reading,2024/05/01-,` + "\n"
+	rows, err := parseExport(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []importRow{
+		{Line: 2, Title: "Piranesi", Authors: "Susanna Clarke", ISBN: "9781635575637", Status: ShelfFinished, Shelf: "read",
+			StartedOn: "2024-03-01", FinishedOn: "2024-03-20", Rating: 9},
+		{Line: 3, Title: "Middlemarch", Authors: "George Eliot", Status: ShelfReading, Shelf: "currently-reading",
+			StartedOn: "2024-05-01"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("parseExport =\n  %+v\nwant\n  %+v", rows, want)
+	}
+}
+
+func TestParseExportRejectsOtherFiles(t *testing.T) {
+	for _, in := range []string{"", "name,email\nann,a@b.c\n", "Title,Author\nDune,Herbert\n"} {
+		if _, err := parseExport(strings.NewReader(in)); err != errNotAnExport {
+			t.Errorf("parseExport(%q) error = %v, want errNotAnExport", in, err)
+		}
+	}
+}
+
+func TestImportTitle(t *testing.T) {
+	tests := map[string]string{
+		"Dune (Dune Chronicles, #1)": "Dune",
+		"The Hobbit (Illustrated)":   "The Hobbit (Illustrated)",
+		"Dune":                       "Dune",
+	}
+	for in, want := range tests {
+		if got := importTitle(in); got != want {
+			t.Errorf("importTitle(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
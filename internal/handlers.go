@@ -9,11 +9,13 @@ import (
 	"image/jpeg"
 	_ "image/png"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 func (a *App) render(w http.ResponseWriter, tmpl string, data any) {
 	t, ok := a.tpl[tmpl]
@@ -60,14 +62,15 @@ func (a *App) Home(w http.ResponseWriter, r *http.Request) {
 	// base query — matches what worked in DB Browser
 	q := `
 SELECT p.id, p.title, u.username, COALESCE(u.avatar_path,''), p.created_at,
-       COALESCE(GROUP_CONCAT(c.name, ', '), '') AS cats
+       COALESCE(GROUP_CONCAT(c.name, ', '), '') AS cats, COALESCE(p.spoiler_chapter, 0), COALESCE(rv.rating, 0)
 FROM posts p
 JOIN users u ON u.id = p.user_id
+LEFT JOIN reviews rv ON rv.post_id = p.id
 LEFT JOIN post_categories pc ON pc.post_id = p.id
 LEFT JOIN categories c ON c.id = pc.category_id
 `
 	args := []any{}
-	where := []string{}
+	where := []string{"p.hidden_at IS NULL", "p.deleted_at IS NULL"} // hidden/deleted posts stay out of listings
 
 	// filter by category id
 	if catIDStr != "" {
@@ -109,6 +112,8 @@ LIMIT 100
 		AvatarPath string
 		CreatedAt string
 		Cats      string
+		SpoilerChapter int
+		Rating    Rating // 0 unless the post is a review
 	}
 	rows, err := a.db.Query(q, args...)
 	if err != nil {
@@ -120,16 +125,19 @@ LIMIT 100
 	var posts []postItem
 	for rows.Next() {
 		var it postItem
-		if err := rows.Scan(&it.ID, &it.Title, &it.Username, &it.AvatarPath, &it.CreatedAt, &it.Cats); err == nil {
+		if err := rows.Scan(&it.ID, &it.Title, &it.Username, &it.AvatarPath, &it.CreatedAt, &it.Cats, &it.SpoilerChapter, &it.Rating); err == nil {
 			posts = append(posts, it)
 		}
 	}
 
+	topRated, _ := topRatedThisMonth(a.db, 5)
+
 	data := map[string]any{
 		"Title":       "Literary Lions Forum",
 		"User":        u,
 		"Categories":  cats,
 		"Posts":       posts,
+		"TopRated":    topRated,
 		"FilterCat":   catIDStr,
 		"FilterMine":  mine,
 		"FilterLiked": liked,
@@ -188,6 +196,13 @@ func (a *App) RegisterPOST(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing fields", http.StatusBadRequest)
 		return
 	}
+	if !validEmail(email) {
+		http.Error(w, "invalid email address", http.StatusBadRequest)
+		return
+	}
+	if !limited(w, a.limits.register, "ip:"+clientIP(r), "creating accounts") {
+		return
+	}
 
 	// Hash the password and insert the user.
 	hash, err := hashPassword(pw)
@@ -203,9 +218,12 @@ func (a *App) RegisterPOST(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	uid, _ := res.LastInsertId()
+	if err := a.sendVerification(uid, username, email, time.Now()); err != nil {
+		log.Printf("verification email for user %d: %v", uid, err)
+	}
 
 	// Create session, set cookie, redirect home.
-	token, exp, err := createSession(a.db, uid)
+	token, exp, err := createSession(a.db, uid, r)
 	if err != nil {
 		http.Error(w, "session error", http.StatusInternalServerError)
 		return
@@ -228,7 +246,14 @@ func (a *App) LoginGET(w http.ResponseWriter, r *http.Request) {
 	// 	http.Error(w, err.Error(), http.StatusInternalServerError)
 	// }
 	
-	a.render(w, "login.html", nil)
+	var data map[string]any
+	if r.URL.Query().Get("reset") == "1" {
+		data = map[string]any{"Notice": "Password changed. Log in with your new password."}
+	}
+	if r.URL.Query().Get("verified") == "1" {
+		data = map[string]any{"Notice": "Email confirmed. Log in to start posting."}
+	}
+	a.render(w, "login.html", data)
 }
 
 // LoginPOST — POST /login
@@ -240,13 +265,32 @@ func (a *App) LoginPOST(w http.ResponseWriter, r *http.Request) {
 	}
 	email := strings.TrimSpace(r.Form.Get("email"))
 	pw := strings.TrimSpace(r.Form.Get("password"))
+	ip := clientIP(r)
+	now := time.Now()
+
+	// per-IP and per-address buckets first, so guessing costs nothing but time
+	for _, c := range []struct {
+		l   RateLimiter
+		key string
+	}{
+		{a.limits.loginIP, "ip:" + ip},
+		{a.limits.loginAccount, "email:" + strings.ToLower(email)},
+	} {
+		if ok, wait := c.l.Allow(c.key, now); !ok {
+			recordLoginAttempt(a.db, 0, email, ip, false, "throttled", now)
+			a.loginRefused(w, "login.html", "Too many login attempts. Try again in "+waitText(wait)+".", wait)
+			return
+		}
+	}
 
 	var id int64
 	var username string
 	var hash []byte
-	err := a.db.QueryRow(`SELECT id, username, password_hash FROM users WHERE email = ?`, email).
-		Scan(&id, &username, &hash)
+	var twoFactor bool
+	err := a.db.QueryRow(`SELECT id, username, password_hash, totp_enabled_at IS NOT NULL FROM users WHERE email = ?`, email).
+		Scan(&id, &username, &hash, &twoFactor)
 	if err == sql.ErrNoRows {
+		recordLoginAttempt(a.db, 0, email, ip, false, "unknown_email", now)
 		a.render(w, "login.html", map[string]any{"Error": "Invalid email or password"})
 		return
 	}
@@ -254,16 +298,43 @@ func (a *App) LoginPOST(w http.ResponseWriter, r *http.Request) {
 		a.render(w, "login.html", map[string]any{"Error": "Database error"})
 		return
 	}
+	wait, locked, err := a.loginWait(id, now)
+	if err != nil {
+		a.render(w, "login.html", map[string]any{"Error": "Database error"})
+		return
+	}
+	if locked {
+		recordLoginAttempt(a.db, id, email, ip, false, "locked", now)
+		a.loginRefused(w, "login.html", "This account is locked after too many failed logins. Try again in "+waitText(wait)+" or reset your password.", wait)
+		return
+	}
+	if wait > 0 {
+		recordLoginAttempt(a.db, id, email, ip, false, "throttled", now)
+		a.loginRefused(w, "login.html", "Too many failed attempts. Wait "+waitText(wait)+" before trying again.", wait)
+		return
+	}
 	if err := checkPassword(hash, pw); err != nil {
+		a.loginFailed(id, email, ip, "bad_password", now)
 		a.render(w, "login.html", map[string]any{"Error": "Invalid email or password"})
 		return
 	}
+	// with 2FA on, the session only starts once /login/2fa gets a code
+	if twoFactor {
+		recordLoginAttempt(a.db, id, email, ip, false, "needs_2fa", now)
+		if err := startLoginChallenge(w, a.db, id, now); err != nil {
+			a.render(w, "login.html", map[string]any{"Error": "Session error"})
+			return
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
 
-	token, exp, err := createSession(a.db, id)
+	token, exp, err := createSession(a.db, id, r)
 	if err != nil {
 		a.render(w, "login.html", map[string]any{"Error": "Session error"})
 		return
 	}
+	a.loginSucceeded(id, email, ip, now)
 	setSessionCookie(w, token, exp)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -274,6 +345,7 @@ func (a *App) LogoutPOST(w http.ResponseWriter, r *http.Request) {
 	c, err := r.Cookie(sessionCookieName)
 	if err == nil && c.Value != "" {
 		_ = deleteSession(a.db, c.Value)
+		a.dropCSRF(c.Value)
 	}
 	clearSessionCookie(w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -282,24 +354,31 @@ func (a *App) LogoutPOST(w http.ResponseWriter, r *http.Request) {
 // NewPostGET — GET /posts/new
 // Shows a form to create a post (requires login).
 func (a *App) NewPostGET(w http.ResponseWriter, r *http.Request) {
-	u, _ := a.currentUser(r)
-	if u == nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
 		return
 	}
-	data := map[string]any{"Title": "New Post", "User": u}
+	books, _ := listBooks(a.db, "")
+	data := map[string]any{
+		"Title":         "New Post",
+		"User":          u,
+		"Books":         books,
+		"RatingChoices": ratingChoices,
+		"ReviewAspects": reviewAspects,
+		"Form":          map[string]string{"Book": r.URL.Query().Get("book"), "Kind": r.URL.Query().Get("kind")},
+		"CSRFToken":     a.generateCSRF(r),
+	}
 	a.render(w, "new_post.html", data)
 }
 
 // NewPostPOST — POST /posts/new
 // Inserts the post and redirects to its page.
 func (a *App) NewPostPOST(w http.ResponseWriter, r *http.Request) {
-	u, _ := a.currentUser(r)
-	if u == nil {
-		http.Error(w, "login required", http.StatusUnauthorized)
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
 		return
 	}
-	if err := r.ParseForm(); err != nil {
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
 		http.Error(w, "bad form", http.StatusBadRequest)
 		return
 	}
@@ -310,31 +389,80 @@ func (a *App) NewPostPOST(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "title and content required", http.StatusBadRequest)
 		return
 	}
+	spoiler, err := parseSpoilerChapter(r.Form.Get("spoiler_chapter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bookID, err := parseBookID(a.db, r.Form.Get("book"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review *Review
+	if r.Form.Get("kind") == PostKindReview {
+		rv, err := parseReviewForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !bookID.Valid {
+			http.Error(w, "a review needs a book", http.StatusBadRequest)
+			return
+		}
+		if hasReviewed(a.db, u.ID, bookID.Int64) {
+			http.Error(w, "you have already reviewed this book; edit that review instead", http.StatusBadRequest)
+			return
+		}
+		review = &rv
+	}
+	if !limited(w, a.limits.post, "user:"+strconv.FormatInt(u.ID, 10), "posting") {
+		return
+	}
 
-	// Save and redirect to /post?id={newID}.
-	res, err := a.db.Exec(`INSERT INTO posts (user_id, title, content) VALUES (?, ?, ?)`, u.ID, title, content)
+	// Save and redirect to /post?id={newID}. The post, its review,
+	// categories and mentions go in together or not at all.
+	tx, err := a.db.Begin()
 	if err != nil {
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
-	postID, _ := res.LastInsertId()
+	defer tx.Rollback()
+
+	contentHTML := renderMarkdown(content)
+	res, err := tx.Exec(`INSERT INTO posts (user_id, title, content, content_html, content_masked, spoiler_chapter, book_id) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		u.ID, title, content, contentHTML, maskSpoilers(content), spoiler, bookID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	postID, err := res.LastInsertId()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if review != nil {
+		if err := saveReview(tx, postID, *review); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	// categories: split by comma, trim, ignore empties
 	if catsRaw != "" {
-		for _, c := range strings.Split(catsRaw, ",") {
-			name := strings.TrimSpace(c)
-			if name == "" {
-				continue
-			}
-			// create category if missing
-			_, _ = a.db.Exec(`INSERT OR IGNORE INTO categories (name) VALUES (?)`, name)
-			var catID int64
-			_ = a.db.QueryRow(`SELECT id FROM categories WHERE name = ?`, name).Scan(&catID)
-			if catID > 0 {
-				_, _ = a.db.Exec(`INSERT OR IGNORE INTO post_categories (post_id, category_id) VALUES (?, ?)`, postID, catID)
-			}
+		if err := setPostCategories(tx, postID, catsRaw); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
 		}
 	}
+	if err := recordMentions(tx, u, "post", postID, contentHTML); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
 	http.Redirect(w, r, "/post?id="+strconv.FormatInt(postID, 10), http.StatusSeeOther)
 }
 
@@ -358,16 +486,33 @@ func (a *App) PostViewGET(w http.ResponseWriter, r *http.Request) {
 		ID        int64
 		Title     string
 		Content   string
+		ContentHTML template.HTML
 		Username  string
 		AvatarPath string
 		CreatedAt string
-	}
+		UpdatedAt string
+		UserID    int64
+		Hidden    bool
+		Deleted         bool
+		DeletedByAuthor bool
+		CanRestore      bool
+		SpoilerChapter  int
+		BookID          int64
+		BookTitle       string
+	}
+	var updatedAt, contentHTML sql.NullString
+	var inRestoreWindow bool
 	err = a.db.QueryRow(`
-		SELECT p.id, p.title, p.content, u.username, u.avatar_path, p.created_at
+		SELECT p.id, p.title, p.content, p.content_html, u.username, u.avatar_path, p.created_at, p.updated_at, p.user_id, p.hidden_at IS NOT NULL,
+		       p.deleted_at IS NOT NULL, COALESCE(p.deleted_by = p.user_id, 0), COALESCE(p.deleted_at >= datetime('now', ?), 0),
+		       COALESCE(p.spoiler_chapter, 0), COALESCE(b.id, 0), COALESCE(b.title, '')
 		FROM posts p
 		JOIN users u ON u.id = p.user_id
-		WHERE p.id = ?`, id).
-		Scan(&post.ID, &post.Title, &post.Content, &post.Username, &post.AvatarPath, &post.CreatedAt)
+		LEFT JOIN books b ON b.id = p.book_id
+		WHERE p.id = ?`, restoreWindowSQL, id).
+		Scan(&post.ID, &post.Title, &post.Content, &contentHTML, &post.Username, &post.AvatarPath, &post.CreatedAt, &updatedAt, &post.UserID, &post.Hidden,
+			&post.Deleted, &post.DeletedByAuthor, &inRestoreWindow, &post.SpoilerChapter,
+			&post.BookID, &post.BookTitle)
 	if err == sql.ErrNoRows {
 		a.renderError(w, http.StatusNotFound, "Post not found.")
 		return
@@ -376,6 +521,36 @@ func (a *App) PostViewGET(w http.ResponseWriter, r *http.Request) {
 		a.renderError(w, http.StatusInternalServerError, "Database error.")
 		return
 	}
+	post.UpdatedAt = updatedAt.String
+	var stale bool
+	if post.ContentHTML, stale = cachedHTML(post.Content, contentHTML); stale {
+		_, _ = a.db.Exec(`UPDATE posts SET content_html = ? WHERE id = ?`, string(post.ContentHTML), id)
+	}
+	post.ContentHTML = linkMentions(a.db, expandQuotes(a.db, post.ContentHTML))
+
+	// hidden posts are only visible to the people who can unhide them
+	canModerate := a.canModeratePost(u, id)
+	if post.Hidden && !canModerate {
+		a.renderError(w, http.StatusGone, "This post was hidden by a moderator.")
+		return
+	}
+
+	// deleted posts keep their discussion; only the author and moderators
+	// still see what the post said
+	isAuthor := u != nil && u.ID == post.UserID
+	if post.Deleted {
+		post.CanRestore = canModerate || (isAuthor && post.DeletedByAuthor && inRestoreWindow)
+		if !canModerate && !isAuthor {
+			post.Title, post.Content, post.ContentHTML = "", "", ""
+		}
+	}
+	if post.Content != "" && a.spoilerGate(w, r, u, id, post.Title, post.SpoilerChapter, isAuthor) {
+		return
+	}
+	var review *Review
+	if post.Content != "" {
+		review, _ = getReview(a.db, id)
+	}
 
 	// post categories
 	var postCats []string
@@ -402,49 +577,31 @@ func (a *App) PostViewGET(w http.ResponseWriter, r *http.Request) {
 		FROM post_reactions WHERE post_id=?`, id).
 		Scan(&postLikes, &postDislikes)
 
-	// comments + counts
-	type commentItem struct {
-		ID        int64
-		Username  string
-		AvatarPath string
-		Content   string
-		CreatedAt string
-		Likes     int
-		Dislikes  int
-	}
-	var comments []commentItem
-	cr, err := a.db.Query(`
-		SELECT c.id, u.username, COALESCE(u.avatar_path,''), c.content, c.created_at
-		FROM comments c
-		JOIN users u ON u.id = c.user_id
-		WHERE c.post_id = ?
-		ORDER BY c.created_at ASC`, id)
+	// comments as a reply tree, reaction counts included
+	csrf := a.generateCSRF(r)
+	comments, commentCount, err := loadCommentTree(a.db, id, u, canModerate, csrf)
 	if err != nil {
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
-	defer cr.Close()
-	for cr.Next() {
-		var cmt commentItem
-		if err := cr.Scan(&cmt.ID, &cmt.Username, &cmt.AvatarPath, &cmt.Content, &cmt.CreatedAt); err == nil {
-			_ = a.db.QueryRow(`
-				SELECT
-				  COALESCE(SUM(CASE WHEN value=1 THEN 1 END),0),
-				  COALESCE(SUM(CASE WHEN value=-1 THEN 1 END),0)
-				FROM comment_reactions WHERE comment_id=?`, cmt.ID).
-				Scan(&cmt.Likes, &cmt.Dislikes)
-			comments = append(comments, cmt)
-		}
-	}
 
+	pageTitle := post.Title
+	if pageTitle == "" {
+		pageTitle = "[removed]"
+	}
 	data := map[string]any{
-		"Title":          post.Title,
+		"Title":          pageTitle,
 		"User":           u,
 		"Post":           post,
+		"Review":         review,
+		"IsAuthor":       isAuthor,
+		"CanModerate":    canModerate,
 		"PostCategories": postCats,
 		"PostLikes":      postLikes,
 		"PostDislikes":   postDislikes,
 		"Comments":       comments,
+		"CommentCount":   commentCount,
+		"CSRFToken":      csrf,
 	}
 	a.render(w, "post.html", data)
 }
@@ -452,40 +609,84 @@ func (a *App) PostViewGET(w http.ResponseWriter, r *http.Request) {
 // CommentPOST — POST /comment
 // Adds a comment to a post (requires login).
 func (a *App) CommentPOST(w http.ResponseWriter, r *http.Request) {
-	u, _ := a.currentUser(r)
-	if u == nil {
-		http.Error(w, "login required", http.StatusUnauthorized)
+	u, ok := a.authorize(w, r, PermComment)
+	if !ok {
 		return
 	}
-	if err := r.ParseForm(); err != nil {
-		a.renderError(w, http.StatusInternalServerError, "Could not save comment.")
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
 		return
 	}
 	postID, _ := strconv.ParseInt(r.Form.Get("post_id"), 10, 64)
+	parentID, _ := strconv.ParseInt(r.Form.Get("parent_id"), 10, 64) // optional: reply to a comment
 	content := strings.TrimSpace(r.Form.Get("content"))
 	if postID <= 0 || content == "" {
 		http.Error(w, "invalid input", http.StatusBadRequest)
 		return
 	}
+	var open bool
+	_ = a.db.QueryRow(`SELECT COUNT(*) FROM posts WHERE id = ? AND deleted_at IS NULL AND hidden_at IS NULL`, postID).Scan(&open)
+	if !open {
+		http.Error(w, "this post is closed for comments", http.StatusBadRequest)
+		return
+	}
+	parent, depth, err := resolveReplyParent(a.db, postID, parentID)
+	if err == errBadParent {
+		http.Error(w, "invalid parent comment", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !limited(w, a.limits.comment, "user:"+strconv.FormatInt(u.ID, 10), "commenting") {
+		return
+	}
 
-	// Insert and bounce back to the post page.
-	if _, err := a.db.Exec(`INSERT INTO comments (post_id, user_id, content) VALUES (?, ?, ?)`,
-		postID, u.ID, content); err != nil {
+	// Insert and bounce back to the new comment on the post page. The
+	// comment, its notifications and mentions go in together or not at all.
+	tx, err := a.db.Begin()
+	if err != nil {
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/post?id="+strconv.FormatInt(postID, 10), http.StatusSeeOther)
+	defer tx.Rollback()
+
+	contentHTML := renderMarkdown(content)
+	res, err := tx.Exec(`INSERT INTO comments (post_id, user_id, content, content_html, content_masked, parent_id, depth) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		postID, u.ID, content, contentHTML, maskSpoilers(content), parent, depth)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	commentID, err := res.LastInsertId()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := notifyComment(tx, u, postID, commentID, parent); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := recordMentions(tx, u, "comment", commentID, contentHTML); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/post?id=%d#comment-%d", postID, commentID), http.StatusSeeOther)
 }
 
 // ReactPOST — POST /react
-// Form fields: kind=post|comment, id (int), v=1|-1
+// Form fields: kind=post|comment|quote, id (int), v=1|-1
 func (a *App) ReactPOST(w http.ResponseWriter, r *http.Request) {
-	u, _ := a.currentUser(r)
-	if u == nil {
-		http.Error(w, "login required", http.StatusUnauthorized)
+	u, ok := a.authorize(w, r, PermReact)
+	if !ok {
 		return
 	}
-	if err := r.ParseForm(); err != nil {
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
 		http.Error(w, "bad form", http.StatusBadRequest)
 		return
 	}
@@ -493,7 +694,7 @@ func (a *App) ReactPOST(w http.ResponseWriter, r *http.Request) {
 	kind := r.Form.Get("kind")
 	idStr := r.Form.Get("id")
 	vStr := r.Form.Get("v")
-	if (kind != "post" && kind != "comment") || (vStr != "1" && vStr != "-1") || idStr == "" {
+	if (kind != "post" && kind != "comment" && kind != "quote") || (vStr != "1" && vStr != "-1") || idStr == "" {
 		http.Error(w, "invalid input", http.StatusBadRequest)
 		return
 	}
@@ -503,6 +704,7 @@ func (a *App) ReactPOST(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	val, _ := strconv.Atoi(vStr) // 1 or -1
+	reacted := false // a new or changed reaction, not a removal
 
 	switch kind {
 	case "post":
@@ -510,11 +712,13 @@ func (a *App) ReactPOST(w http.ResponseWriter, r *http.Request) {
 		var existing int
 		err = a.db.QueryRow(`SELECT value FROM post_reactions WHERE user_id=? AND post_id=?`, u.ID, targetID).Scan(&existing)
 		if err == sql.ErrNoRows {
+			reacted = true
 			_, _ = a.db.Exec(`INSERT INTO post_reactions (user_id, post_id, value) VALUES (?, ?, ?)`, u.ID, targetID, val)
 		} else if err == nil {
 			if existing == val {
 				_, _ = a.db.Exec(`DELETE FROM post_reactions WHERE user_id=? AND post_id=?`, u.ID, targetID)
 			} else {
+				reacted = true
 				_, _ = a.db.Exec(`UPDATE post_reactions SET value=? WHERE user_id=? AND post_id=?`, val, u.ID, targetID)
 			}
 		} else {
@@ -525,17 +729,40 @@ func (a *App) ReactPOST(w http.ResponseWriter, r *http.Request) {
 		var existing int
 		err = a.db.QueryRow(`SELECT value FROM comment_reactions WHERE user_id=? AND comment_id=?`, u.ID, targetID).Scan(&existing)
 		if err == sql.ErrNoRows {
+			reacted = true
 			_, _ = a.db.Exec(`INSERT INTO comment_reactions (user_id, comment_id, value) VALUES (?, ?, ?)`, u.ID, targetID, val)
 		} else if err == nil {
 			if existing == val {
 				_, _ = a.db.Exec(`DELETE FROM comment_reactions WHERE user_id=? AND comment_id=?`, u.ID, targetID)
 			} else {
+				reacted = true
 				_, _ = a.db.Exec(`UPDATE comment_reactions SET value=? WHERE user_id=? AND comment_id=?`, val, u.ID, targetID)
 			}
 		} else {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
+	case "quote":
+		var existing int
+		err = a.db.QueryRow(`SELECT value FROM quote_reactions WHERE user_id=? AND quote_id=?`, u.ID, targetID).Scan(&existing)
+		if err == sql.ErrNoRows {
+			reacted = true
+			_, _ = a.db.Exec(`INSERT INTO quote_reactions (user_id, quote_id, value) VALUES (?, ?, ?)`, u.ID, targetID, val)
+		} else if err == nil {
+			if existing == val {
+				_, _ = a.db.Exec(`DELETE FROM quote_reactions WHERE user_id=? AND quote_id=?`, u.ID, targetID)
+			} else {
+				reacted = true
+				_, _ = a.db.Exec(`UPDATE quote_reactions SET value=? WHERE user_id=? AND quote_id=?`, val, u.ID, targetID)
+			}
+		} else {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if reacted {
+		_ = notifyReaction(a.db, u, kind, targetID, val)
 	}
 
 	// bounce back to where the user came from
@@ -545,7 +772,8 @@ func (a *App) ReactPOST(w http.ResponseWriter, r *http.Request) {
 	}
 	http.Redirect(w, r, ref, http.StatusSeeOther)
 }
-// ProfileRouter handles /u/{username}, /u/{username}/posts, /u/{username}/comments
+// ProfileRouter handles /u/{username}, /u/{username}/posts, /u/{username}/comments,
+// /u/{username}/shelves
 func (a *App) ProfileRouter(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/u/")
 	parts := strings.Split(strings.Trim(path, "/"), "/")
@@ -555,8 +783,8 @@ func (a *App) ProfileRouter(w http.ResponseWriter, r *http.Request) {
 	}
 	username := parts[0]
 	tab := "posts"
-	if len(parts) > 1 && parts[1] == "comments" {
-		tab = "comments"
+	if len(parts) > 1 && (parts[1] == "comments" || parts[1] == "shelves") {
+		tab = parts[1]
 	}
 
 	viewer, _ := a.currentUser(r)
@@ -574,6 +802,7 @@ func (a *App) ProfileRouter(w http.ResponseWriter, r *http.Request) {
 	postsCount, _ := CountUserPosts(a.db, prof.ID)
 	commentsCount, _ := CountUserComments(a.db, prof.ID)
 	likesCount, _ := CountUserPostLikes(a.db, prof.ID)
+	goal, _ := getReadingGoal(a.db, prof.ID, time.Now().Year())
 
 	page := 1
 	limit := 10
@@ -608,9 +837,17 @@ func (a *App) ProfileRouter(w http.ResponseWriter, r *http.Request) {
 		"Tab":     tab,
 		"Meta":    &m,
 		"IsOwner": viewer != nil && viewer.ID == prof.ID,
+		"Goal":    goal,
 	}
 
-	if tab == "comments" {
+	if tab == "shelves" {
+		shelves, _, err := listShelves(a.db, prof.ID)
+		if err != nil {
+			a.renderError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		data["Shelves"] = shelves
+	} else if tab == "comments" {
 		comments, total, _ := ListCommentsByAuthor(a.db, prof.ID, offset, limit)
 		m.Total = total
 		m.HasPrev = page > 1
@@ -641,6 +878,7 @@ func (a *App) ProfileRouter(w http.ResponseWriter, r *http.Request) {
 		"web/templates/profile.html",
 		"web/templates/profile_posts.html",
 		"web/templates/profile_comments.html",
+		"web/templates/profile_shelves.html",
 	)
 	if err != nil {
 		http.Error(w, "template error", http.StatusInternalServerError)
@@ -653,16 +891,32 @@ func (a *App) ProfileRouter(w http.ResponseWriter, r *http.Request) {
 
 // MeSettingsGET renders the profile settings form.
 func (a *App) MeSettingsGET(w http.ResponseWriter, r *http.Request) {
-	u, _ := a.currentUser(r)
-	if u == nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
 		return
 	}
 	csrf := a.generateCSRF(r)
+
+	// moderator decisions about this account (dismissed reports aren't news)
+	var notices []ModerationEntry
+	if entries, err := listModerationLog(a.db, u.ID, 50); err == nil {
+		for _, e := range entries {
+			if e.Action == ModWarn || e.Action == ModSuspend || e.Action == ModHide || e.Action == ModDelete {
+				notices = append(notices, e)
+			}
+		}
+	}
+
+	twoFactor, _ := loadTwoFactor(a.db, u.ID)
+
 	data := map[string]any{
 		"Title":     "Settings",
 		"User":      u,
 		"CSRFToken": csrf,
+		"Notices":   notices,
+		"Verify":    r.URL.Query().Get("verify"),
+		"TwoFactor": twoFactor.Enabled,
+		"Error":     r.URL.Query().Get("err"),
 	}
 	tpl, err := template.ParseFiles("web/templates/base.html", "web/templates/me_settings.html")
 	if err != nil {
@@ -676,9 +930,8 @@ func (a *App) MeSettingsGET(w http.ResponseWriter, r *http.Request) {
 
 // MeSettingsPOST updates display name and bio.
 func (a *App) MeSettingsPOST(w http.ResponseWriter, r *http.Request) {
-	u, _ := a.currentUser(r)
-	if u == nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
 		return
 	}
 	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
@@ -700,9 +953,8 @@ func (a *App) MeSettingsPOST(w http.ResponseWriter, r *http.Request) {
 
 // MeAvatarPOST uploads a new avatar for the current user.
 func (a *App) MeAvatarPOST(w http.ResponseWriter, r *http.Request) {
-	u, _ := a.currentUser(r)
-	if u == nil {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
 		return
 	}
 	if err := r.ParseMultipartForm(2<<20 + 1024); err != nil || !a.checkCSRF(r) {
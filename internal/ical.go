@@ -0,0 +1,83 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// icsTime formats a time as an iCalendar UTC date-time. Feeds use UTC so
+// every calendar app places events correctly without VTIMEZONE blocks.
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsEscape escapes a TEXT value (RFC 5545 §3.3.11).
+var icsEscape = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace
+
+// icsWriter writes content lines with CRLF endings, folded at 75 octets.
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (iw *icsWriter) line(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	s := name + ":" + value
+	var b strings.Builder
+	for n := 0; len(s) > 0; {
+		_, size := utf8.DecodeRuneInString(s)
+		if n+size > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteString(s[:size])
+		n += size
+		s = s[size:]
+	}
+	b.WriteString("\r\n")
+	_, iw.err = io.WriteString(iw.w, b.String())
+}
+
+// writeICS writes a calendar with one VEVENT per event. baseURL is used to
+// link each event back to its page.
+func writeICS(w io.Writer, name, baseURL string, events []Event, now time.Time) error {
+	iw := &icsWriter{w: w}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//Literary Lions//Events//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("METHOD", "PUBLISH")
+	iw.line("X-WR-CALNAME", icsEscape(name))
+	for _, e := range events {
+		page := fmt.Sprintf("%s/events/%d", baseURL, e.ID)
+		desc := e.Description
+		if e.URL != "" {
+			desc = strings.TrimSpace(desc + "\n\nJoin: " + e.URL)
+		}
+		desc = strings.TrimSpace(desc + "\n\n" + page)
+
+		iw.line("BEGIN", "VEVENT")
+		iw.line("UID", fmt.Sprintf("event-%d@literary-lions", e.ID))
+		iw.line("DTSTAMP", icsTime(now))
+		iw.line("DTSTART", icsTime(e.Start))
+		iw.line("DTEND", icsTime(e.End))
+		iw.line("SUMMARY", icsEscape(e.Title))
+		iw.line("DESCRIPTION", icsEscape(desc))
+		if loc := e.Location; loc != "" || e.URL != "" {
+			if loc == "" {
+				loc = e.URL
+			}
+			iw.line("LOCATION", icsEscape(loc))
+		}
+		iw.line("URL", page)
+		iw.line("STATUS", "CONFIRMED")
+		iw.line("END", "VEVENT")
+	}
+	iw.line("END", "VCALENDAR")
+	return iw.err
+}
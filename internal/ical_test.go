@@ -0,0 +1,96 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestICSEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{`a\b`, `a\\b`},
+		{"one; two, three", `one\; two\, three`},
+		{"line\nbreak\r\nand\rmore", `line\nbreak\nand\nmore`},
+	}
+	for _, tt := range tests {
+		if got := icsEscape(tt.in); got != tt.want {
+			t.Errorf("icsEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestICSFolding checks that long lines are split at 75 octets without
+// breaking a UTF-8 sequence, and that unfolding gives back the original.
+func TestICSFolding(t *testing.T) {
+	values := []string{
+		"short",
+		strings.Repeat("x", 200),
+		strings.Repeat("é", 100),       // two bytes each
+		"ab" + strings.Repeat("🦁", 40), // four bytes each, off the boundary
+	}
+	for _, v := range values {
+		var b strings.Builder
+		iw := &icsWriter{w: &b}
+		iw.line("DESCRIPTION", v)
+		out := b.String()
+		if !strings.HasSuffix(out, "\r\n") {
+			t.Fatalf("line not CRLF-terminated: %q", out)
+		}
+		lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+		for i, l := range lines {
+			if len(l) > 75 {
+				t.Errorf("line %d is %d octets", i, len(l))
+			}
+			if !utf8.ValidString(l) {
+				t.Errorf("line %d splits a character: %q", i, l)
+			}
+			if i > 0 && !strings.HasPrefix(l, " ") {
+				t.Errorf("continuation line %d doesn't start with a space", i)
+			}
+		}
+		if got := strings.ReplaceAll(strings.TrimSuffix(out, "\r\n"), "\r\n ", ""); got != "DESCRIPTION:"+v {
+			t.Errorf("unfolded = %q, want %q", got, "DESCRIPTION:"+v)
+		}
+	}
+}
+
+func TestWriteICS(t *testing.T) {
+	zone := time.FixedZone("CEST", 2*60*60)
+	events := []Event{{
+		ID:          7,
+		Title:       "Dune, part one",
+		Description: "Bring snacks; and the book",
+		Start:       time.Date(2026, 6, 1, 19, 0, 0, 0, zone),
+		End:         time.Date(2026, 6, 1, 21, 0, 0, 0, zone),
+		URL:         "https://meet.example.org/dune",
+	}}
+	var b strings.Builder
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := writeICS(&b, "Lions", "https://lions.example.org", events, now); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:event-7@literary-lions\r\n",
+		"DTSTAMP:20260501T120000Z\r\n",
+		"DTSTART:20260601T170000Z\r\n",
+		"DTEND:20260601T190000Z\r\n",
+		`SUMMARY:Dune\, part one` + "\r\n",
+		"LOCATION:https://meet.example.org/dune\r\n",
+		"URL:https://lions.example.org/events/7\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("calendar lacks %q:\n%s", want, out)
+		}
+	}
+	unfolded := strings.ReplaceAll(out, "\r\n ", "")
+	if want := `DESCRIPTION:Bring snacks\; and the book\n\nJoin: https://meet.example.org/dune\n\nhttps://lions.example.org/events/7`; !strings.Contains(unfolded, want) {
+		t.Errorf("calendar lacks %q:\n%s", want, unfolded)
+	}
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Login brute-force protection. Every attempt lands in login_attempts.
+// Token buckets (ratelimit.go) cap attempts per IP and per address. On top
+// of that, wrong passwords or 2FA codes for an account make it wait longer
+// and longer between tries. Enough of them lock the account for a while and
+// tell the owner by email. The failure count starts over after a successful
+// login, once a lockout ends, or after a password reset.
+
+const (
+	loginFailureWindow = 15 * time.Minute
+	loginDelayAfter    = 3 // failures before waits kick in
+	loginMaxDelay      = time.Minute
+	loginLockAfter     = 10
+	loginLockDuration  = 15 * time.Minute
+	// loginAttemptRetention is how long the audit rows are kept.
+	loginAttemptRetention = 90 * 24 * time.Hour
+)
+
+// recordLoginAttempt adds a row to login_attempts. userID is 0 when the
+// address didn't match an account.
+func recordLoginAttempt(db *sql.DB, userID int64, email, ip string, success bool, reason string, now time.Time) {
+	var uid any
+	if userID != 0 {
+		uid = userID
+	}
+	if _, err := db.Exec(`
+		INSERT INTO login_attempts (user_id, email, ip, success, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, uid, strings.ToLower(email), ip, success, reason, now.Unix()); err != nil {
+		log.Printf("login attempt for %s: %v", email, err)
+	}
+}
+
+// recentLoginFailures counts the account's wrong passwords and codes that
+// still count against it, and returns when the last one was.
+func recentLoginFailures(db *sql.DB, userID, lockedUntil int64, now time.Time) (n int, last int64, err error) {
+	since := now.Add(-loginFailureWindow).Unix()
+	if lockedUntil > since {
+		since = lockedUntil
+	}
+	err = db.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(created_at), 0) FROM login_attempts
+		WHERE user_id = ? AND reason IN ('bad_password', 'bad_2fa') AND created_at >= ?
+		  AND created_at > COALESCE((SELECT MAX(created_at) FROM login_attempts WHERE user_id = ? AND success = 1), 0)`,
+		userID, since, userID).Scan(&n, &last)
+	return n, last, err
+}
+
+// loginDelay is how long to wait after n failures: nothing for the first
+// few, then 1s, 2s, 4s... up to loginMaxDelay.
+func loginDelay(n int) time.Duration {
+	if n < loginDelayAfter {
+		return 0
+	}
+	d := time.Second << uint(n-loginDelayAfter)
+	if d > loginMaxDelay || d <= 0 {
+		return loginMaxDelay
+	}
+	return d
+}
+
+// loginWait says how long the account must wait before its next attempt.
+// locked is true while a lockout is in force, rather than just a delay.
+func (a *App) loginWait(userID int64, now time.Time) (wait time.Duration, locked bool, err error) {
+	var lockedUntil int64
+	if err := a.db.QueryRow(`SELECT locked_until FROM users WHERE id = ?`, userID).Scan(&lockedUntil); err != nil {
+		return 0, false, err
+	}
+	if lockedUntil > now.Unix() {
+		return time.Duration(lockedUntil-now.Unix()) * time.Second, true, nil
+	}
+	n, last, err := recentLoginFailures(a.db, userID, lockedUntil, now)
+	if err != nil {
+		return 0, false, err
+	}
+	next := time.Unix(last, 0).Add(loginDelay(n))
+	if next.After(now) {
+		return next.Sub(now), false, nil
+	}
+	return 0, false, nil
+}
+
+// loginFailed records a wrong password or code. Reaching loginLockAfter
+// locks the account and emails the owner, once per lockout.
+func (a *App) loginFailed(userID int64, email, ip, reason string, now time.Time) {
+	recordLoginAttempt(a.db, userID, email, ip, false, reason, now)
+	var username, address string
+	var lockedUntil int64
+	if err := a.db.QueryRow(`SELECT username, email, locked_until FROM users WHERE id = ?`, userID).
+		Scan(&username, &address, &lockedUntil); err != nil {
+		log.Printf("login lockout for user %d: %v", userID, err)
+		return
+	}
+	n, _, err := recentLoginFailures(a.db, userID, lockedUntil, now)
+	if err != nil || n < loginLockAfter {
+		return
+	}
+	until := now.Add(loginLockDuration)
+	res, err := a.db.Exec(`UPDATE users SET locked_until = ? WHERE id = ? AND locked_until <= ?`, until.Unix(), userID, now.Unix())
+	if err != nil {
+		log.Printf("login lockout for user %d: %v", userID, err)
+		return
+	}
+	if k, _ := res.RowsAffected(); k != 1 {
+		return
+	}
+	log.Printf("login: locked user %d until %s after %d failures (last from %s)", userID, until.UTC().Format(time.RFC3339), n, ip)
+	if err := a.queueMail(a.db, address, "account_locked", map[string]any{
+		"Username": username,
+		"Failures": n,
+		"IP":       ip,
+		"Until":    until.UTC().Format("15:04 MST, 2 Jan 2006"),
+		"Link":     a.siteURL + "/forgot",
+	}); err != nil {
+		log.Printf("lockout email for user %d: %v", userID, err)
+	}
+}
+
+// loginSucceeded records a completed login and clears the address's
+// token bucket.
+func (a *App) loginSucceeded(userID int64, email, ip string, now time.Time) {
+	recordLoginAttempt(a.db, userID, email, ip, true, "ok", now)
+	a.limits.loginAccount.Reset("email:" + strings.ToLower(email))
+}
+
+// loginRefused renders a login page with msg, a 429 and a Retry-After
+// header.
+func (a *App) loginRefused(w http.ResponseWriter, page, msg string, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	a.render(w, page, map[string]any{"Error": msg})
+}
+
+// pruneLoginAttemptsJob drops audit rows older than loginAttemptRetention.
+func (a *App) pruneLoginAttemptsJob(now time.Time) {
+	if _, err := a.db.Exec(`DELETE FROM login_attempts WHERE created_at < ?`, now.Add(-loginAttemptRetention).Unix()); err != nil {
+		log.Printf("prune login attempts: %v", err)
+	}
+}
@@ -0,0 +1,441 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	ttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Email. Messages are rendered from a text and an HTML template in
+// web/templates/email, queued in mail_queue, and handed to a Mailer by the
+// scheduler, which retries failures with exponential backoff. Without SMTP
+// settings the Mailer writes .eml files to a directory instead, which is what
+// development and tests use.
+//
+// Configuration comes from the environment:
+//
+//	SITE_URL   base URL for links in emails (default http://localhost:8080)
+//	MAIL_FROM  sender address (default Literary Lions <no-reply@localhost>)
+//	SMTP_ADDR  host:port of an SMTP server; unset means write .eml files
+//	SMTP_USER, SMTP_PASS  optional SMTP credentials
+//	MAIL_DIR   where .eml files go (default mail-outbox)
+
+// mailTemplateDir holds <name>.txt (text/template, defines "subject") and
+// optionally <name>.html (html/template, defines "content" for layout.html).
+const mailTemplateDir = "web/templates/email"
+
+// Queue tuning.
+const (
+	maxMailAttempts = 8
+	mailBatchSize   = 20
+	mailRetryBase   = time.Minute
+	mailRetryMax    = 6 * time.Hour
+	// mailRetention is how long sent rows are kept. Their bodies, which
+	// can hold reset and verification links, are cleared on sending.
+	mailRetention = 14 * 24 * time.Hour
+	// smtpTimeout bounds a whole SMTP conversation, connecting included.
+	smtpTimeout = 30 * time.Second
+)
+
+// Message is one outgoing email. The Mailer fills in the sender.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers a message or says why it couldn't.
+type Mailer interface {
+	Send(m Message) error
+}
+
+// SMTPMailer sends through an SMTP server, using STARTTLS when the server
+// offers it.
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+// Send implements Mailer.
+func (s *SMTPMailer) Send(m Message) error {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("MAIL_FROM: %w", err)
+	}
+	raw, err := buildMessage(s.From, m, time.Now())
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("SMTP_ADDR: %w", err)
+	}
+
+	// smtp.SendMail has no timeouts, and a server that stops answering
+	// would hold up the scheduler for good, so dial and talk under one
+	// deadline.
+	conn, err := net.DialTimeout("tcp", s.Addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(raw); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// DirMailer writes each message to Dir as an .eml file instead of sending
+// it. Open them with any mail client.
+type DirMailer struct {
+	Dir  string
+	From string
+}
+
+// Send implements Mailer.
+func (d *DirMailer) Send(m Message) error {
+	now := time.Now()
+	raw, err := buildMessage(d.From, m, now)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.Dir, 0o755); err != nil {
+		return err
+	}
+	name := now.UTC().Format("20060102-150405") + "-" + uuid.NewString()[:8] + ".eml"
+	return os.WriteFile(filepath.Join(d.Dir, name), raw, 0o644)
+}
+
+// mailerFromEnv picks SMTP when SMTP_ADDR is set and a DirMailer otherwise.
+func mailerFromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Literary Lions <no-reply@localhost>"
+	}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return &SMTPMailer{Addr: addr, Username: os.Getenv("SMTP_USER"), Password: os.Getenv("SMTP_PASS"), From: from}
+	}
+	dir := os.Getenv("MAIL_DIR")
+	if dir == "" {
+		dir = "mail-outbox"
+	}
+	return &DirMailer{Dir: dir, From: from}
+}
+
+// siteURLFromEnv is the base URL emails and calendar feeds link back to,
+// without a trailing slash.
+func siteURLFromEnv() string {
+	u := strings.TrimRight(os.Getenv("SITE_URL"), "/")
+	if u == "" {
+		u = "http://localhost:8080"
+	}
+	return u
+}
+
+// buildMessage renders m as a MIME message: multipart/alternative when it
+// has both bodies, a single quoted-printable part otherwise.
+func buildMessage(from string, m Message, now time.Time) ([]byte, error) {
+	if m.To == "" || strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return nil, errors.New("mail: bad recipient or subject")
+	}
+	if _, err := mail.ParseAddress(m.To); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if a, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndexByte(a.Address, '@'); at >= 0 {
+			domain = a.Address[at+1:]
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + m.To + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", m.Subject) + "\r\n")
+	b.WriteString("Date: " + now.Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("Message-ID: <" + uuid.NewString() + "@" + domain + ">\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if m.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQP(&b, m.Text); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ ctype, s string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.ctype},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQP(w, part.s); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteString(`Content-Type: multipart/alternative; boundary="` + mw.Boundary() + "\"\r\n\r\n")
+	b.Write(body.Bytes())
+	return b.Bytes(), nil
+}
+
+func writeQP(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, strings.ReplaceAll(s, "\n", "\r\n")); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// mailTemplate is one kind of email.
+type mailTemplate struct {
+	text *ttemplate.Template
+	html *template.Template // nil for text-only mail
+}
+
+// loadMailTemplates parses every <name>.txt in dir, with <name>.html
+// alongside it if there is one.
+func loadMailTemplates(dir string) (map[string]*mailTemplate, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	tpls := map[string]*mailTemplate{}
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".txt")
+		mt := &mailTemplate{}
+		if mt.text, err = ttemplate.ParseFiles(f); err != nil {
+			return nil, err
+		}
+		if mt.text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("%s: no subject template", f)
+		}
+		htmlFile := filepath.Join(dir, name+".html")
+		if _, err := os.Stat(htmlFile); err == nil {
+			if mt.html, err = template.ParseFiles(filepath.Join(dir, "layout.html"), htmlFile); err != nil {
+				return nil, err
+			}
+		}
+		tpls[name] = mt
+	}
+	return tpls, nil
+}
+
+// renderMail renders the named email for to. data gets a SiteURL entry.
+func renderMail(tpls map[string]*mailTemplate, siteURL, to, name string, data map[string]any) (Message, error) {
+	mt, ok := tpls[name]
+	if !ok {
+		return Message{}, fmt.Errorf("mail: no template %q", name)
+	}
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["SiteURL"] = siteURL
+	var subject, text, htmlBody strings.Builder
+	if err := mt.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, err
+	}
+	if err := mt.text.Execute(&text, data); err != nil {
+		return Message{}, err
+	}
+	if mt.html != nil {
+		if err := mt.html.Execute(&htmlBody, data); err != nil {
+			return Message{}, err
+		}
+	}
+	return Message{
+		To:      to,
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    htmlBody.String(),
+	}, nil
+}
+
+// queueMail renders the named email for to and queues it; the scheduler
+// sends it within a minute. db can be the transaction that made the email
+// necessary, so nothing is queued if it rolls back.
+func (a *App) queueMail(db dbtx, to, name string, data map[string]any) error {
+	m, err := renderMail(a.mailTpl, a.siteURL, to, name, data)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return errors.New("mail: bad recipient or subject")
+	}
+	_, err = db.Exec(`INSERT INTO mail_queue (to_addr, subject, text_body, html_body, next_attempt_at) VALUES (?, ?, ?, ?, ?)`,
+		m.To, m.Subject, m.Text, m.HTML, time.Now().UTC().Format(dbTimeLayout))
+	return err
+}
+
+// mailBackoff is how long to wait before attempt number attempts+1:
+// a minute, then doubling up to mailRetryMax.
+func mailBackoff(attempts int) time.Duration {
+	d := mailRetryBase
+	for i := 1; i < attempts && d < mailRetryMax; i++ {
+		d *= 2
+	}
+	if d > mailRetryMax {
+		d = mailRetryMax
+	}
+	return d
+}
+
+// deliverMail sends up to mailBatchSize due messages. A sent message keeps
+// only its headers; one that fails maxMailAttempts times stays in the queue
+// with its last error for a human to look at.
+func deliverMail(db *sql.DB, m Mailer, now time.Time) (sent, failed int, err error) {
+	rows, err := db.Query(`
+		SELECT id, to_addr, subject, text_body, html_body, attempts FROM mail_queue
+		WHERE sent_at IS NULL AND attempts < ? AND next_attempt_at <= ?
+		ORDER BY next_attempt_at, id LIMIT ?`,
+		maxMailAttempts, now.UTC().Format(dbTimeLayout), mailBatchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	type due struct {
+		id       int64
+		msg      Message
+		attempts int
+	}
+	var list []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.msg.To, &d.msg.Subject, &d.msg.Text, &d.msg.HTML, &d.attempts); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		list = append(list, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, d := range list {
+		if sendErr := m.Send(d.msg); sendErr != nil {
+			failed++
+			d.attempts++
+			next := now.Add(mailBackoff(d.attempts)).UTC().Format(dbTimeLayout)
+			if _, err := db.Exec(`UPDATE mail_queue SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+				d.attempts, sendErr.Error(), next, d.id); err != nil {
+				return sent, failed, err
+			}
+			if d.attempts >= maxMailAttempts {
+				log.Printf("mail: giving up on message %d to %s: %v", d.id, d.msg.To, sendErr)
+			}
+			continue
+		}
+		sent++
+		if _, err := db.Exec(`UPDATE mail_queue SET attempts = attempts + 1, last_error = NULL, sent_at = ?, text_body = '', html_body = '' WHERE id = ?`,
+			now.UTC().Format(dbTimeLayout), d.id); err != nil {
+			return sent, failed, err
+		}
+	}
+	return sent, failed, nil
+}
+
+// sendMailJob is the scheduler job that drains the mail queue.
+func (a *App) sendMailJob(now time.Time) {
+	sent, failed, err := deliverMail(a.db, a.mailer, now)
+	if err != nil {
+		log.Printf("mail: %v", err)
+	}
+	if sent > 0 || failed > 0 {
+		log.Printf("mail: sent %d, failed %d", sent, failed)
+	}
+}
+
+// pruneMailJob drops sent messages older than mailRetention.
+func (a *App) pruneMailJob(now time.Time) {
+	if _, err := a.db.Exec(`DELETE FROM mail_queue WHERE sent_at < ?`, now.Add(-mailRetention).UTC().Format(dbTimeLayout)); err != nil {
+		log.Printf("prune mail queue: %v", err)
+	}
+}
+
+// MailTest sends the "test" email straight through the configured Mailer,
+// skipping the queue, so SMTP settings can be checked from the command line.
+func MailTest(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: forumd mail-test <address>")
+	}
+	tpls, err := loadMailTemplates(mailTemplateDir)
+	if err != nil {
+		return err
+	}
+	m, err := renderMail(tpls, siteURLFromEnv(), args[0], "test", nil)
+	if err != nil {
+		return err
+	}
+	mailer := mailerFromEnv()
+	if err := mailer.Send(m); err != nil {
+		return err
+	}
+	if d, ok := mailer.(*DirMailer); ok {
+		fmt.Fprintf(out, "wrote test message to %s\n", d.Dir)
+		return nil
+	}
+	fmt.Fprintf(out, "sent test message to %s\n", args[0])
+	return nil
+}
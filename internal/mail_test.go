@@ -0,0 +1,121 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingMailer sends to everyone except bad.
+type failingMailer struct {
+	bad  string
+	sent []Message
+}
+
+func (f *failingMailer) Send(m Message) error {
+	if m.To == f.bad {
+		return errors.New("mailbox unavailable")
+	}
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func TestDeliverMailClearsSentBodies(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, to := range []string{"ann@x.y", "bob@x.y"} {
+		mustExec(t, db, `INSERT INTO mail_queue (to_addr, subject, text_body, html_body, next_attempt_at) VALUES (?, 'Reset', ?, ?, ?)`,
+			to, "https://lions.example.org/reset?token=secret", "<a href=\"https://lions.example.org/reset?token=secret\">", now.Format(dbTimeLayout))
+	}
+
+	m := &failingMailer{bad: "bob@x.y"}
+	sent, failed, err := deliverMail(db, m, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || failed != 1 || len(m.sent) != 1 || m.sent[0].Text == "" {
+		t.Fatalf("sent %d, failed %d, delivered %+v", sent, failed, m.sent)
+	}
+
+	bodies := func(to string) (text, html string) {
+		if err := db.QueryRow(`SELECT text_body, html_body FROM mail_queue WHERE to_addr = ?`, to).Scan(&text, &html); err != nil {
+			t.Fatal(err)
+		}
+		return text, html
+	}
+	if text, html := bodies("ann@x.y"); text != "" || html != "" {
+		t.Errorf("sent message kept its bodies: %q, %q", text, html)
+	}
+	if text, _ := bodies("bob@x.y"); text == "" {
+		t.Error("message waiting for a retry lost its body")
+	}
+
+	a := &App{db: db}
+	a.pruneMailJob(now.Add(mailRetention - time.Hour))
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM mail_queue`).Scan(&n); err != nil || n != 2 {
+		t.Fatalf("%d rows before the retention period is over (%v), want 2", n, err)
+	}
+	a.pruneMailJob(now.Add(mailRetention + time.Hour))
+	if err := db.QueryRow(`SELECT COUNT(*) FROM mail_queue`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("%d rows after pruning (%v), want only the unsent one", n, err)
+	}
+}
+
+// TestSMTPMailerSend runs Send against a minimal SMTP server that
+// offers neither STARTTLS nor AUTH.
+func TestSMTPMailerSend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		var lines []string
+		tp.PrintfLine("220 test")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				break
+			}
+			lines = append(lines, line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "EHLO":
+				tp.PrintfLine("250 test")
+			case "DATA":
+				tp.PrintfLine("354 go on")
+				body, _ := tp.ReadDotLines()
+				lines = append(lines, body...)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				got <- strings.Join(lines, "\n")
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+		got <- strings.Join(lines, "\n")
+	}()
+
+	m := &SMTPMailer{Addr: ln.Addr().String(), From: "Lions <no-reply@x.y>"}
+	if err := m.Send(Message{To: "ann@x.y", Subject: "Hi", Text: "hello there"}); err != nil {
+		t.Fatal(err)
+	}
+	session := <-got
+	for _, want := range []string{"MAIL FROM:<no-reply@x.y>", "RCPT TO:<ann@x.y>", "Subject: Hi", "hello there"} {
+		if !strings.Contains(session, want) {
+			t.Errorf("session lacks %q:\n%s", want, session)
+		}
+	}
+}
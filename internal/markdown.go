@@ -0,0 +1,800 @@
+package app
+
+import (
+	"database/sql"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Posts and comments are written in a small CommonMark subset: paragraphs,
+// hard line breaks, *emphasis*, **strong**, `code`, fenced and indented code
+// blocks, > blockquotes, bullet and numbered lists, [links](url), <autolinks>
+// and horizontal rules, plus ||inline spoilers|| and [spoiler]…[/spoiler]
+// blocks (see spoilers.go), [quote:N] lines that embed a saved quote (see
+// quotes.go) and @username mentions (see mentions.go). Raw HTML is never
+// passed through; everything the renderer emits goes through sanitizeHTML as
+// well, so a renderer bug can't turn into an XSS hole.
+//
+// The rendered HTML is cached in posts.content_html / comments.content_html.
+// NULL means "not rendered yet"; a migration that changes what the renderer
+// produces should reset those columns to NULL.
+
+// renderMarkdown turns post or comment source into sanitized HTML.
+func renderMarkdown(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\t", "    ")
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"), false)
+	return sanitizeHTML(b.String())
+}
+
+// cachedHTML returns the stored rendering of src, or renders it when the
+// cache column is NULL. The caller decides whether to write it back.
+func cachedHTML(src string, cached sql.NullString) (template.HTML, bool) {
+	if cached.Valid {
+		return template.HTML(cached.String), false
+	}
+	return template.HTML(renderMarkdown(src)), true
+}
+
+// leadingSpaces counts the spaces a line starts with.
+func leadingSpaces(line string) int {
+	n := 0
+	for n < len(line) && line[n] == ' ' {
+		n++
+	}
+	return n
+}
+
+// isFence reports whether a line opens or closes a fenced code block and
+// returns the fence characters.
+func isFence(line string) (string, bool) {
+	t := strings.TrimLeft(line, " ")
+	if len(line)-len(t) > 3 {
+		return "", false
+	}
+	for _, f := range []string{"```", "~~~"} {
+		if strings.HasPrefix(t, f) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// isRule reports whether a line is a horizontal rule (---, ***, ___).
+func isRule(line string) bool {
+	t := strings.TrimSpace(line)
+	if len(line)-len(strings.TrimLeft(line, " ")) > 3 || len(t) < 3 {
+		return false
+	}
+	c := t[0]
+	if c != '-' && c != '*' && c != '_' {
+		return false
+	}
+	n := 0
+	for i := 0; i < len(t); i++ {
+		switch t[i] {
+		case c:
+			n++
+		case ' ':
+		default:
+			return false
+		}
+	}
+	return n >= 3
+}
+
+// listMarker is a parsed list item marker.
+type listMarker struct {
+	ordered bool
+	start   int
+	content int // column where the item's content begins
+}
+
+// parseListMarker recognises "- ", "* ", "+ ", "1. " and "1) " markers.
+func parseListMarker(line string) (listMarker, bool) {
+	indent := leadingSpaces(line)
+	if indent > 3 || indent == len(line) {
+		return listMarker{}, false
+	}
+	rest := line[indent:]
+	switch rest[0] {
+	case '-', '*', '+':
+		if len(rest) == 1 {
+			return listMarker{content: indent + 1}, true
+		}
+		if rest[1] == ' ' {
+			return listMarker{content: indent + 2}, true
+		}
+		return listMarker{}, false
+	}
+	digits := 0
+	for digits < len(rest) && digits < 9 && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	if digits == 0 || digits >= len(rest) || (rest[digits] != '.' && rest[digits] != ')') {
+		return listMarker{}, false
+	}
+	start, _ := strconv.Atoi(rest[:digits])
+	m := listMarker{ordered: true, start: start, content: indent + digits + 1}
+	if digits+1 == len(rest) {
+		return m, true
+	}
+	if rest[digits+1] != ' ' {
+		return listMarker{}, false
+	}
+	m.content++
+	return m, true
+}
+
+// startsBlock reports whether a line interrupts a running paragraph.
+func startsBlock(line string) bool {
+	t := strings.TrimLeft(line, " ")
+	if len(line)-len(t) > 3 || t == "" {
+		return false
+	}
+	if _, ok := isFence(line); ok {
+		return true
+	}
+	if _, ok := quoteEmbedID(line); ok {
+		return true
+	}
+	if t[0] == '>' || isRule(line) || isSpoilerStart(line) {
+		return true
+	}
+	// only non-empty bullets and lists starting at 1 may interrupt a paragraph
+	if m, ok := parseListMarker(line); ok && m.content < len(line) && (!m.ordered || m.start == 1) {
+		return true
+	}
+	return false
+}
+
+// renderBlocks renders a sequence of lines as block elements. In a tight
+// list item paragraphs are written without <p> wrappers.
+func renderBlocks(b *strings.Builder, lines []string, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		indent := leadingSpaces(line)
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case indent >= 4:
+			// indented code block; blank lines inside it belong to it
+			var code []string
+			for i < len(lines) && (leadingSpaces(lines[i]) >= 4 || strings.TrimSpace(lines[i]) == "") {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+				i++
+			}
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+
+		case isRule(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		default:
+			if fence, ok := isFence(line); ok {
+				i++
+				var code []string
+				for i < len(lines) {
+					if f, ok := isFence(lines[i]); ok && f == fence && strings.Trim(strings.TrimSpace(lines[i]), fence[:1]) == "" {
+						i++
+						break
+					}
+					code = append(code, lines[i])
+					i++
+				}
+				text := strings.Join(code, "\n")
+				if text != "" {
+					text += "\n"
+				}
+				b.WriteString("<pre><code>" + html.EscapeString(text) + "</code></pre>\n")
+				continue
+			}
+			if line[indent] == '>' {
+				i = renderBlockquote(b, lines, i)
+				continue
+			}
+			if id, ok := quoteEmbedID(line); ok {
+				b.WriteString(`<figure data-quote="` + strconv.FormatInt(id, 10) + "\"></figure>\n")
+				i++
+				continue
+			}
+			if next := renderSpoilerBlock(b, lines, i); next > i {
+				i = next
+				continue
+			}
+			if _, ok := parseListMarker(line); ok {
+				i = renderList(b, lines, i)
+				continue
+			}
+			// paragraph: runs until a blank line or another block starts
+			para := []string{strings.TrimLeft(line, " ")}
+			i++
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" && !startsBlock(lines[i]) {
+				para = append(para, strings.TrimLeft(lines[i], " "))
+				i++
+			}
+			text := strings.TrimRight(strings.Join(para, "\n"), " ")
+			if tight {
+				renderInline(b, text)
+				b.WriteString("\n")
+			} else {
+				b.WriteString("<p>")
+				renderInline(b, text)
+				b.WriteString("</p>\n")
+			}
+		}
+	}
+}
+
+// renderBlockquote renders the quote starting at lines[i] and returns the
+// index of the first line after it. Unmarked lines directly below a quoted
+// paragraph continue it, as in CommonMark.
+func renderBlockquote(b *strings.Builder, lines []string, i int) int {
+	var inner []string
+	for i < len(lines) {
+		line := lines[i]
+		t := strings.TrimLeft(line, " ")
+		if len(line)-len(t) <= 3 && strings.HasPrefix(t, ">") {
+			t = strings.TrimPrefix(t[1:], " ")
+			inner = append(inner, t)
+			i++
+			continue
+		}
+		last := ""
+		if len(inner) > 0 {
+			last = inner[len(inner)-1]
+		}
+		if strings.TrimSpace(line) != "" && strings.TrimSpace(last) != "" && !startsBlock(line) {
+			inner = append(inner, line)
+			i++
+			continue
+		}
+		break
+	}
+	b.WriteString("<blockquote>\n")
+	renderBlocks(b, inner, false)
+	b.WriteString("</blockquote>\n")
+	return i
+}
+
+// renderList renders the list starting at lines[i] and returns the index of
+// the first line after it.
+func renderList(b *strings.Builder, lines []string, i int) int {
+	first, _ := parseListMarker(lines[i])
+	var items [][]string
+	loose := false
+	blank := false // saw a blank line since the last content line
+	for i < len(lines) {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" {
+			blank = true
+			if len(items) > 0 {
+				items[len(items)-1] = append(items[len(items)-1], "")
+			}
+			i++
+			continue
+		}
+		m, isItem := parseListMarker(line)
+		if isItem && m.ordered == first.ordered && leadingSpaces(line) < first.content {
+			if blank && len(items) > 0 {
+				loose = true
+			}
+			items = append(items, []string{line[m.content:]})
+			blank = false
+			i++
+			continue
+		}
+		if leadingSpaces(line) >= first.content {
+			cur := items[len(items)-1]
+			if blank && strings.TrimSpace(strings.Join(cur, "")) != "" {
+				loose = true
+			}
+			items[len(items)-1] = append(cur, line[first.content:])
+			blank = false
+			i++
+			continue
+		}
+		if !blank && !startsBlock(line) {
+			// lazy continuation of the item's paragraph
+			items[len(items)-1] = append(items[len(items)-1], strings.TrimLeft(line, " "))
+			i++
+			continue
+		}
+		break
+	}
+
+	tag := "ul"
+	if first.ordered {
+		tag = "ol"
+	}
+	if first.ordered && first.start != 1 {
+		b.WriteString("<ol start=\"" + strconv.Itoa(first.start) + "\">\n")
+	} else {
+		b.WriteString("<" + tag + ">\n")
+	}
+	for _, item := range items {
+		b.WriteString("<li>")
+		var inner strings.Builder
+		renderBlocks(&inner, item, !loose)
+		b.WriteString(strings.TrimSuffix(inner.String(), "\n"))
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func isSpaceByte(c byte) bool { return c == ' ' || c == '\n' }
+
+func isAlnumByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isPunctByte(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// runLength counts how many times s[i] repeats from i.
+func runLength(s string, i int) int {
+	n := 1
+	for i+n < len(s) && s[i+n] == s[i] {
+		n++
+	}
+	return n
+}
+
+// findCloser finds the closing emphasis delimiter run of exactly len(d)
+// characters after from, or -1.
+func findCloser(s string, from int, d string) int {
+	for k := from; k < len(s); k++ {
+		switch s[k] {
+		case '\\':
+			k++
+			continue
+		case '`':
+			// delimiters inside code spans don't count
+			n := runLength(s, k)
+			if end := strings.Index(s[k+n:], s[k:k+n]); end >= 0 {
+				k += n + end + n - 1
+			}
+			continue
+		}
+		if s[k] != d[0] {
+			continue
+		}
+		n := runLength(s, k)
+		if n == len(d) && k > from && !isSpaceByte(s[k-1]) &&
+			(d[0] != '_' || k+n >= len(s) || !isAlnumByte(s[k+n])) {
+			return k
+		}
+		k += n - 1
+	}
+	return -1
+}
+
+// renderInline renders the inline content of one paragraph.
+func renderInline(b *strings.Builder, s string) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch c {
+		case '\\':
+			if i+1 < len(s) && s[i+1] == '\n' {
+				b.WriteString("<br>")
+				i++
+				continue
+			}
+			if i+1 < len(s) && isPunctByte(s[i+1]) {
+				b.WriteString(html.EscapeString(s[i+1 : i+2]))
+				i += 2
+				continue
+			}
+
+		case ' ':
+			// two or more spaces before a newline make a hard break
+			n := runLength(s, i)
+			if i+n < len(s) && s[i+n] == '\n' {
+				if n >= 2 {
+					b.WriteString("<br>")
+				}
+				i += n
+				continue
+			}
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+
+		case '`':
+			n := runLength(s, i)
+			if end := strings.Index(s[i+n:], s[i:i+n]); end >= 0 && runLength(s, i+n+end) == n {
+				code := strings.ReplaceAll(s[i+n:i+n+end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += n + end + n
+				continue
+			}
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+
+		case '*', '_':
+			n := runLength(s, i)
+			opens := i+n < len(s) && !isSpaceByte(s[i+n]) && (c != '_' || i == 0 || !isAlnumByte(s[i-1]))
+			if opens {
+				if done := renderEmphasis(b, s, i, n); done > 0 {
+					i = done
+					continue
+				}
+			}
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+
+		case '|':
+			if done := renderInlineSpoiler(b, s, i, "||", "||"); done > 0 {
+				i = done
+				continue
+			}
+
+		case '[':
+			if done := renderInlineSpoiler(b, s, i, spoilerOpen, spoilerClose); done > 0 {
+				i = done
+				continue
+			}
+			if done := renderLink(b, s, i); done > 0 {
+				i = done
+				continue
+			}
+
+		case '@':
+			if done := renderMention(b, s, i); done > 0 {
+				i = done
+				continue
+			}
+
+		case '<':
+			if end := strings.IndexByte(s[i:], '>'); end > 0 {
+				target := s[i+1 : i+end]
+				if !strings.ContainsAny(target, " \n<") && safeURL(target) != "" && strings.Contains(target, ":") {
+					writeLink(b, target, "", html.EscapeString(target))
+					i += end + 1
+					continue
+				}
+			}
+		}
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+}
+
+// renderEmphasis tries to close a delimiter run of n characters at s[i]
+// with a run of the same length. It returns the index after the closing run,
+// or 0 if there is none.
+func renderEmphasis(b *strings.Builder, s string, i, n int) int {
+	if n > 3 {
+		return 0
+	}
+	k := findCloser(s, i+n, s[i:i+n])
+	if k < 0 {
+		return 0
+	}
+	open, closeTags := "<em>", "</em>"
+	switch n {
+	case 2:
+		open, closeTags = "<strong>", "</strong>"
+	case 3:
+		open, closeTags = "<em><strong>", "</strong></em>"
+	}
+	b.WriteString(open)
+	renderInline(b, s[i+n:k])
+	b.WriteString(closeTags)
+	return k + n
+}
+
+// renderLink parses [text](url "title") at s[i]. It returns the index after
+// the link, or 0 if s[i] doesn't start one. Links to disallowed schemes keep
+// their text but lose the link.
+func renderLink(b *strings.Builder, s string, i int) int {
+	depth := 0
+	textEnd := -1
+	for k := i; k < len(s) && textEnd < 0; k++ {
+		switch s[k] {
+		case '\\':
+			k++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				textEnd = k
+			}
+		}
+	}
+	if textEnd < 0 || textEnd+1 >= len(s) || s[textEnd+1] != '(' {
+		return 0
+	}
+	rest := s[textEnd+2:]
+	j := 0
+	for j < len(rest) && isSpaceByte(rest[j]) {
+		j++
+	}
+	var dest string
+	if j < len(rest) && rest[j] == '<' {
+		end := strings.IndexAny(rest[j:], ">\n")
+		if end < 0 || rest[j+end] != '>' {
+			return 0
+		}
+		dest = rest[j+1 : j+end]
+		j += end + 1
+	} else {
+		start, parens := j, 0
+		for j < len(rest) && !isSpaceByte(rest[j]) {
+			if rest[j] == '(' {
+				parens++
+			} else if rest[j] == ')' {
+				if parens == 0 {
+					break
+				}
+				parens--
+			}
+			j++
+		}
+		dest = rest[start:j]
+	}
+	for j < len(rest) && isSpaceByte(rest[j]) {
+		j++
+	}
+	title := ""
+	if j < len(rest) && (rest[j] == '"' || rest[j] == '\'') {
+		end := strings.IndexByte(rest[j+1:], rest[j])
+		if end < 0 {
+			return 0
+		}
+		title = rest[j+1 : j+1+end]
+		j += end + 2
+		for j < len(rest) && isSpaceByte(rest[j]) {
+			j++
+		}
+	}
+	if j >= len(rest) || rest[j] != ')' {
+		return 0
+	}
+
+	var text strings.Builder
+	renderInline(&text, s[i+1:textEnd])
+	if safeURL(dest) == "" {
+		b.WriteString(text.String())
+	} else {
+		writeLink(b, dest, title, unmarkMentions(text.String()))
+	}
+	return textEnd + 2 + j + 1
+}
+
+// writeLink writes an <a> for user-supplied content; textHTML is already
+// rendered.
+func writeLink(b *strings.Builder, href, title, textHTML string) {
+	b.WriteString(`<a href="` + html.EscapeString(href) + `"`)
+	if title != "" {
+		b.WriteString(` title="` + html.EscapeString(title) + `"`)
+	}
+	b.WriteString(` rel="nofollow ugc noopener">` + textHTML + `</a>`)
+}
+
+// safeURL returns u if it is a relative link or uses http, https or mailto,
+// and "" otherwise.
+func safeURL(u string) string {
+	u = strings.TrimSpace(u)
+	if u == "" || strings.ContainsAny(u, "\x00\r\n\t") {
+		return ""
+	}
+	if i := strings.IndexAny(u, ":/?#"); i >= 0 && u[i] == ':' {
+		switch strings.ToLower(u[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return ""
+		}
+	}
+	return u
+}
+
+// allowedTags maps every tag sanitizeHTML lets through to its allowed
+// attributes.
+var allowedTags = map[string]map[string]bool{
+	"p": {}, "br": {}, "hr": {},
+	"em": {}, "strong": {}, "code": {}, "pre": {},
+	"blockquote": {}, "ul": {}, "li": {},
+	"ol":      {"start": true},
+	"a":       {"href": true, "title": true, "rel": true},
+	"details": {"class": true},
+	"summary": {},
+	"span":    {"class": true, "tabindex": true},
+	"figure":  {"data-quote": true},
+}
+
+var voidTags = map[string]bool{"br": true, "hr": true}
+
+// sanitizeHTML keeps only allowlisted tags and attributes, escapes all text,
+// checks link targets and closes anything left open.
+func sanitizeHTML(s string) string {
+	var b strings.Builder
+	var open []string
+	for len(s) > 0 {
+		lt := strings.IndexByte(s, '<')
+		if lt < 0 {
+			lt = len(s)
+		}
+		b.WriteString(html.EscapeString(html.UnescapeString(s[:lt])))
+		s = s[lt:]
+		if s == "" {
+			break
+		}
+		name, attrs, closing, n := parseTag(s)
+		if n == 0 {
+			b.WriteString("&lt;")
+			s = s[1:]
+			continue
+		}
+		s = s[n:]
+		allowed, ok := allowedTags[name]
+		if !ok {
+			continue
+		}
+		if closing {
+			for k := len(open) - 1; k >= 0; k-- {
+				if open[k] == name {
+					for len(open) > k {
+						b.WriteString("</" + open[len(open)-1] + ">")
+						open = open[:len(open)-1]
+					}
+					break
+				}
+			}
+			continue
+		}
+		b.WriteString("<" + name)
+		for _, a := range attrs {
+			if !allowed[a[0]] {
+				continue
+			}
+			v := a[1]
+			switch a[0] {
+			case "href":
+				if v = safeURL(v); v == "" {
+					continue
+				}
+			case "start", "tabindex", "data-quote":
+				if _, err := strconv.Atoi(v); err != nil {
+					continue
+				}
+			case "class":
+				if v != "spoiler" && v != "mention" {
+					continue
+				}
+			}
+			b.WriteString(" " + a[0] + `="` + html.EscapeString(v) + `"`)
+		}
+		b.WriteString(">")
+		if !voidTags[name] {
+			open = append(open, name)
+		}
+	}
+	for k := len(open) - 1; k >= 0; k-- {
+		b.WriteString("</" + open[k] + ">")
+	}
+	return b.String()
+}
+
+// parseTag reads one start or end tag at the beginning of s. It returns the
+// lower-cased name, the attributes as unescaped name/value pairs, whether it
+// is an end tag, and how many bytes it used (0 if s doesn't start a tag).
+func parseTag(s string) (name string, attrs [][2]string, closing bool, n int) {
+	i := 1
+	if i < len(s) && s[i] == '/' {
+		closing = true
+		i++
+	}
+	start := i
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z' || s[i] >= '0' && s[i] <= '9') {
+		i++
+	}
+	if i == start {
+		return "", nil, false, 0
+	}
+	name = strings.ToLower(s[start:i])
+	for {
+		for i < len(s) && strings.IndexByte(" \t\n\r\f", s[i]) >= 0 {
+			i++
+		}
+		if i >= len(s) {
+			return "", nil, false, 0
+		}
+		if s[i] == '>' {
+			return name, attrs, closing, i + 1
+		}
+		if s[i] == '/' {
+			i++
+			continue
+		}
+		ns := i
+		for i < len(s) && strings.IndexByte(" \t\n\r\f/>=", s[i]) < 0 {
+			i++
+		}
+		attr := strings.ToLower(s[ns:i])
+		val := ""
+		if i < len(s) && s[i] == '=' {
+			i++
+			if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+				end := strings.IndexByte(s[i+1:], s[i])
+				if end < 0 {
+					return "", nil, false, 0
+				}
+				val = s[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				vs := i
+				for i < len(s) && strings.IndexByte(" \t\n\r\f>", s[i]) < 0 {
+					i++
+				}
+				val = s[vs:i]
+			}
+		}
+		if attr != "" {
+			attrs = append(attrs, [2]string{attr, html.UnescapeString(val)})
+		}
+	}
+}
+
+// PostPreviewPOST — POST /posts/preview
+// Form fields: title, content, categories
+// Renders content the way it will look once posted. Script-driven previews
+// (X-Requested-With: fetch) get just the HTML fragment; a plain form submit
+// gets the new post form back with the preview above it.
+func (a *App) PostPreviewPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	preview := linkMentions(a.db, expandQuotes(a.db, template.HTML(renderMarkdown(strings.TrimSpace(r.Form.Get("content"))))))
+	if r.Header.Get("X-Requested-With") == "fetch" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, string(preview))
+		return
+	}
+	books, _ := listBooks(a.db, "")
+	form := map[string]string{
+		"Title":          r.Form.Get("title"),
+		"Content":        r.Form.Get("content"),
+		"Categories":     r.Form.Get("categories"),
+		"SpoilerChapter": r.Form.Get("spoiler_chapter"),
+		"Book":           r.Form.Get("book"),
+		"Kind":           r.Form.Get("kind"),
+		"Rating":         r.Form.Get("rating"),
+	}
+	for _, asp := range reviewAspects {
+		form[asp.Label] = r.Form.Get(asp.Key)
+	}
+	data := map[string]any{
+		"Title":         "New Post",
+		"User":          u,
+		"Books":         books,
+		"Preview":       preview,
+		"Form":          form,
+		"RatingChoices": ratingChoices,
+		"ReviewAspects": reviewAspects,
+		"CSRFToken":     a.generateCSRF(r),
+	}
+	a.render(w, "new_post.html", data)
+}
@@ -0,0 +1,57 @@
+package app
+
+import "testing"
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"https://example.com/a?b=c", "https://example.com/a?b=c"},
+		{"HTTP://example.com", "HTTP://example.com"},
+		{"mailto:lion@example.com", "mailto:lion@example.com"},
+		{"/post?id=1", "/post?id=1"},
+		{"#comment-3", "#comment-3"},
+		{"relative/page", "relative/page"},
+		{"/search?q=a:b", "/search?q=a:b"},
+		{"  https://example.com  ", "https://example.com"},
+		{"javascript:alert(1)", ""},
+		{"JavaScript:alert(1)", ""},
+		{"data:text/html,<b>x</b>", ""},
+		{"vbscript:msgbox", ""},
+		{"java\tscript:alert(1)", ""},
+		{"java\nscript:alert(1)", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := safeURL(tt.in); got != tt.want {
+			t.Errorf("safeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain text", "a < b & c", "a &lt; b &amp; c"},
+		{"allowed tags", "<p><em>hi</em> <strong>there</strong></p>", "<p><em>hi</em> <strong>there</strong></p>"},
+		{"script dropped", "<script>alert(1)</script>", "alert(1)"},
+		{"event handler dropped", `<p onclick="x()">hi</p>`, "<p>hi</p>"},
+		{"safe link", `<a href="https://example.com" title="t">x</a>`, `<a href="https://example.com" title="t">x</a>`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"entity-encoded javascript", `<a href="&#106;avascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"attribute escaped", `<a href="/a&quot;b">x</a>`, `<a href="/a&#34;b">x</a>`},
+		{"unclosed tags closed", "<blockquote><p>quote", "<blockquote><p>quote</p></blockquote>"},
+		{"stray end tag", "text</em>", "text"},
+		{"void tags", "a<br>b<hr>", "a<br>b<hr>"},
+		{"numeric attributes only", `<ol start="3"><li>x</li></ol><ol start="x"></ol>`, `<ol start="3"><li>x</li></ol><ol></ol>`},
+		{"class allowlist", `<span class="spoiler">s</span><span class="evil">e</span>`, `<span class="spoiler">s</span><span>e</span>`},
+		{"img dropped", `<img src=x onerror=alert(1)>`, ""},
+		{"lone angle bracket", "1 <2", "1 &lt;2"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeHTML(tt.in); got != tt.want {
+			t.Errorf("%s: sanitizeHTML(%q) =\n  %q\nwant\n  %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package app
+
+import (
+	"encoding/json"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mentions. "@username" in a post or comment renders as a marker span;
+// linkMentions turns the ones naming a real member into profile links at
+// display time, so the cached HTML doesn't go stale when accounts come and
+// go. saveMentions records who a post or comment mentions, and the first
+// time someone is named they get a notification.
+
+const (
+	// maxMentionLen bounds the name after the @.
+	maxMentionLen = 40
+	// maxMentions is how many distinct members one post or comment can
+	// mention (and notify).
+	maxMentions = 10
+	// maxMentionSuggestions is how many names the autocomplete returns.
+	maxMentionSuggestions = 8
+)
+
+var mentionSpanRe = regexp.MustCompile(`<span class="mention">@([A-Za-z0-9_.\-]+)</span>`)
+
+func isMentionByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '.' || c == '-'
+}
+
+// renderMention renders an @name at s[i] as a mention marker. It returns the
+// index after the name, or 0 if s[i] doesn't start one (e.g. in an email
+// address or a path).
+func renderMention(b *strings.Builder, s string, i int) int {
+	if i > 0 && (isMentionByte(s[i-1]) || isAlnumByte(s[i-1]) || s[i-1] == '@' || s[i-1] == '/') {
+		return 0
+	}
+	j := i + 1
+	for j < len(s) && isMentionByte(s[j]) {
+		j++
+	}
+	// a sentence ending right after the name isn't part of it
+	for j > i+1 && (s[j-1] == '.' || s[j-1] == '-') {
+		j--
+	}
+	name := s[i+1 : j]
+	if name == "" || len(name) > maxMentionLen || name[0] == '.' || name[0] == '-' {
+		return 0
+	}
+	b.WriteString(`<span class="mention">@` + name + `</span>`)
+	return j
+}
+
+// unmarkMentions turns mention markers back into plain text, for link text
+// where a nested profile link would be invalid.
+func unmarkMentions(h string) string {
+	return mentionSpanRe.ReplaceAllString(h, "@$1")
+}
+
+// mentionNames returns the distinct names marked in rendered HTML, in order
+// of appearance, at most limit of them (0 for all).
+func mentionNames(h string, limit int) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range mentionSpanRe.FindAllStringSubmatch(h, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		names = append(names, m[1])
+		if limit > 0 && len(names) == limit {
+			break
+		}
+	}
+	return names
+}
+
+// lookupUsernames maps each name that is a member's username to their id.
+func lookupUsernames(db dbtx, names []string) (map[string]int64, error) {
+	found := map[string]int64{}
+	if len(names) == 0 {
+		return found, nil
+	}
+	args := make([]any, len(names))
+	for i, n := range names {
+		args[i] = n
+	}
+	rows, err := db.Query(`SELECT id, username FROM users WHERE username IN (?`+strings.Repeat(", ?", len(names)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		found[name] = id
+	}
+	return found, rows.Err()
+}
+
+// linkMentions replaces mention markers in rendered post or comment HTML
+// with links to the members' profiles. Names that don't belong to anyone
+// stay plain text.
+func linkMentions(db dbtx, h template.HTML) template.HTML {
+	linkMentionsIn(db, []*template.HTML{&h})
+	return h
+}
+
+// linkMentionsIn is linkMentions for several pieces of HTML at once, such as
+// every comment in a thread, looking all the names up in one query.
+func linkMentionsIn(db dbtx, hs []*template.HTML) {
+	var all strings.Builder
+	for _, h := range hs {
+		if strings.Contains(string(*h), `<span class="mention">`) {
+			all.WriteString(string(*h))
+		}
+	}
+	if all.Len() == 0 {
+		return
+	}
+	found, err := lookupUsernames(db, mentionNames(all.String(), 0))
+	if err != nil {
+		found = nil
+	}
+	for _, h := range hs {
+		*h = template.HTML(mentionSpanRe.ReplaceAllStringFunc(string(*h), func(m string) string {
+			name := mentionSpanRe.FindStringSubmatch(m)[1]
+			if _, ok := found[name]; !ok {
+				return "@" + name
+			}
+			return `<a class="mention" href="/u/` + html.EscapeString(name) + `">@` + name + `</a>`
+		}))
+	}
+}
+
+// saveMentions brings the stored mentions of a post or comment in line with
+// its rendered HTML and returns the members who weren't mentioned before.
+func saveMentions(db dbtx, kind string, id int64, contentHTML string) ([]int64, error) {
+	names := mentionNames(contentHTML, maxMentions)
+	found, err := lookupUsernames(db, names)
+	if err != nil {
+		return nil, err
+	}
+	had := map[int64]bool{}
+	rows, err := db.Query(`SELECT user_id FROM mentions WHERE target_kind = ? AND target_id = ?`, kind, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var uid int64
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		had[uid] = true
+	}
+	rows.Close()
+
+	var added []int64
+	keep := map[int64]bool{}
+	for _, name := range names {
+		uid, ok := found[name]
+		if !ok || keep[uid] {
+			continue
+		}
+		keep[uid] = true
+		if had[uid] {
+			continue
+		}
+		if _, err := db.Exec(`INSERT INTO mentions (target_kind, target_id, user_id) VALUES (?, ?, ?)`, kind, id, uid); err != nil {
+			return nil, err
+		}
+		added = append(added, uid)
+	}
+	for uid := range had {
+		if keep[uid] {
+			continue
+		}
+		if _, err := db.Exec(`DELETE FROM mentions WHERE target_kind = ? AND target_id = ? AND user_id = ?`, kind, id, uid); err != nil {
+			return nil, err
+		}
+	}
+	return added, nil
+}
+
+// recordMentions saves the mentions in a new or edited post or comment and
+// notifies the members named in it for the first time.
+func recordMentions(db dbtx, actor *User, kind string, id int64, contentHTML string) error {
+	added, err := saveMentions(db, kind, id, contentHTML)
+	if err != nil || len(added) == 0 {
+		return err
+	}
+	var postID int64
+	var title string
+	link := ""
+	switch kind {
+	case "post":
+		postID = id
+		err = db.QueryRow(`SELECT title FROM posts WHERE id = ?`, id).Scan(&title)
+	case "comment":
+		err = db.QueryRow(`SELECT p.id, p.title FROM comments c JOIN posts p ON p.id = c.post_id WHERE c.id = ?`, id).Scan(&postID, &title)
+		link = "#comment-" + strconv.FormatInt(id, 10)
+	}
+	if err != nil {
+		return err
+	}
+	link = "/post?id=" + strconv.FormatInt(postID, 10) + link
+	text := actor.Username + " mentioned you in a " + kind + " on “" + snippet(title, 60) + "”"
+	if kind == "post" {
+		text = actor.Username + " mentioned you in “" + snippet(title, 60) + "”"
+	}
+	for _, uid := range added {
+		if err := notify(db, uid, actor.ID, NotifyMention, text, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mentionSuggestion is one autocomplete entry.
+type mentionSuggestion struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// MentionSuggestGET — GET /users/suggest?q=prefix
+// Returns up to maxMentionSuggestions usernames starting with q as JSON,
+// for the @mention autocomplete. Only members can look people up.
+func (a *App) MentionSuggestGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+	if u == nil {
+		http.Error(w, "login required", http.StatusUnauthorized)
+		return
+	}
+	q := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("q")), "@")
+	out := []mentionSuggestion{}
+	if q != "" && len(q) <= maxMentionLen {
+		esc := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q)
+		rows, err := a.db.Query(`
+			SELECT username, COALESCE(display_name, '') FROM users
+			WHERE username LIKE ? ESCAPE '\'
+			ORDER BY username COLLATE NOCASE LIMIT ?`, esc+"%", maxMentionSuggestions*2)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() && len(out) < maxMentionSuggestions {
+			var s mentionSuggestion
+			if err := rows.Scan(&s.Username, &s.DisplayName); err != nil {
+				continue
+			}
+			// names the renderer can't mark aren't worth suggesting
+			var b strings.Builder
+			if renderMention(&b, "@"+s.Username, 0) != len(s.Username)+1 {
+				continue
+			}
+			out = append(out, s)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(out)
+}
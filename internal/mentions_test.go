@@ -0,0 +1,111 @@
+package app
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRenderMention(t *testing.T) {
+	tests := []struct {
+		in   string // the mention candidate is the last @
+		want string // "" when it isn't a mention
+		rest string // what follows the name
+	}{
+		{"@ann", `<span class="mention">@ann</span>`, ""},
+		{"hi @ann_b.c-d!", `<span class="mention">@ann_b.c-d</span>`, "!"},
+		{"thanks @ann.", `<span class="mention">@ann</span>`, "."},
+		{"(@ann)", `<span class="mention">@ann</span>`, ")"},
+		{"mail ann@example.com", "", ""},
+		{"/u/@ann", "", ""},
+		{"@@ann", "", ""},
+		{"@ ann", "", ""},
+		{"@.ann", "", ""},
+		{"@" + strings.Repeat("a", maxMentionLen), `<span class="mention">@` + strings.Repeat("a", maxMentionLen) + `</span>`, ""},
+		{"@" + strings.Repeat("a", maxMentionLen+1), "", ""},
+	}
+	for _, tt := range tests {
+		i := strings.LastIndexByte(tt.in, '@')
+		var b strings.Builder
+		end := renderMention(&b, tt.in, i)
+		if tt.want == "" {
+			if end != 0 || b.Len() != 0 {
+				t.Errorf("renderMention(%q) = %d, %q; want no mention", tt.in, end, b.String())
+			}
+			continue
+		}
+		if b.String() != tt.want || tt.in[end:] != tt.rest {
+			t.Errorf("renderMention(%q) = %q, rest %q; want %q, rest %q", tt.in, b.String(), tt.in[end:], tt.want, tt.rest)
+		}
+	}
+}
+
+func TestSaveMentions(t *testing.T) {
+	db := newTestDB(t)
+	ann := mustExec(t, db, `INSERT INTO users(email, username, password_hash) VALUES('ann@x.y','ann','x')`)
+	bob := mustExec(t, db, `INSERT INTO users(email, username, password_hash) VALUES('bob@x.y','bob','x')`)
+	mention := func(names ...string) string {
+		var b strings.Builder
+		for _, n := range names {
+			b.WriteString(`<p><span class="mention">@` + n + `</span></p>`)
+		}
+		return b.String()
+	}
+	stored := func() []int64 {
+		rows, err := db.Query(`SELECT user_id FROM mentions WHERE target_kind = 'post' AND target_id = 1`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+
+	steps := []struct {
+		html        string
+		added, kept []int64
+	}{
+		// unknown names are ignored, repeats count once
+		{mention("ann", "ghost", "bob", "ann"), []int64{ann, bob}, []int64{ann, bob}},
+		// an edit that keeps a mention doesn't notify again
+		{mention("bob"), nil, []int64{bob}},
+		// naming someone again after removing them is a new mention
+		{mention("bob", "ann"), []int64{ann}, []int64{ann, bob}},
+		{"<p>nobody</p>", nil, nil},
+	}
+	for i, s := range steps {
+		added, err := saveMentions(db, "post", 1, s.html)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(added, s.added) {
+			t.Errorf("step %d: added %v, want %v", i, added, s.added)
+		}
+		if got := stored(); !reflect.DeepEqual(got, s.kept) {
+			t.Errorf("step %d: stored %v, want %v", i, got, s.kept)
+		}
+	}
+
+	var names []string
+	for i := 0; i <= maxMentions; i++ {
+		name := "user" + strings.Repeat("x", i)
+		mustExec(t, db, `INSERT INTO users(email, username, password_hash) VALUES(?,?,'x')`, name+"@x.y", name)
+		names = append(names, name)
+	}
+	added, err := saveMentions(db, "comment", 1, mention(names...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != maxMentions {
+		t.Errorf("%d members mentioned, want at most %d", len(added), maxMentions)
+	}
+}
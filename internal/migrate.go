@@ -0,0 +1,1051 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// migration is one numbered schema step. up/down run inside a transaction
+// together with the schema_migrations bookkeeping, so a step either fully
+// applies or not at all.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// execSQL wraps a plain SQL script as a migration step.
+func execSQL(script string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(script)
+		return err
+	}
+}
+
+// migrations lists every schema step in order. Never edit or renumber an
+// entry that has shipped — add a new one instead.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "baseline schema",
+		Up:      execSQL(baselineSchemaSQL),
+		Down: execSQL(`
+DROP TABLE IF EXISTS comment_reactions;
+DROP TABLE IF EXISTS post_reactions;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS post_categories;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS categories;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
+`),
+	},
+	{
+		Version: 2,
+		Name:    "user profile columns",
+		Up: func(tx *sql.Tx) error {
+			// databases created before migrations existed may already have
+			// some or all of these columns
+			for _, col := range []string{"display_name", "bio", "avatar_path"} {
+				ok, err := columnExists(tx, "users", col)
+				if err != nil {
+					return err
+				}
+				if ok {
+					continue
+				}
+				if _, err := tx.Exec(`ALTER TABLE users ADD COLUMN ` + col + ` TEXT NOT NULL DEFAULT ''`); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: execSQL(`
+ALTER TABLE users DROP COLUMN avatar_path;
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN display_name;
+`),
+	},
+	{
+		Version: 3,
+		Name:    "full-text search index",
+		Up:      execSQL(searchSchemaSQL),
+		Down: execSQL(`
+DROP TRIGGER IF EXISTS comments_search_ad;
+DROP TRIGGER IF EXISTS comments_search_au;
+DROP TRIGGER IF EXISTS comments_search_ai;
+DROP TRIGGER IF EXISTS posts_search_ad;
+DROP TRIGGER IF EXISTS posts_search_au;
+DROP TRIGGER IF EXISTS posts_search_ai;
+DROP TABLE IF EXISTS search_fts;
+`),
+	},
+	{
+		Version: 4,
+		Name:    "post revisions",
+		Up: execSQL(`
+ALTER TABLE posts ADD COLUMN updated_at DATETIME;
+
+CREATE TABLE post_revisions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+  version INTEGER NOT NULL,             -- 1 = the post as first published
+  title TEXT NOT NULL,
+  content TEXT NOT NULL,
+  categories TEXT NOT NULL DEFAULT '',  -- comma-separated names at the time
+  created_at DATETIME NOT NULL,         -- when this version was written
+  UNIQUE (post_id, version)
+);
+`),
+		Down: execSQL(`
+DROP TABLE IF EXISTS post_revisions;
+ALTER TABLE posts DROP COLUMN updated_at;
+`),
+	},
+	{
+		Version: 5,
+		Name:    "threaded comments",
+		Up: execSQL(`
+ALTER TABLE comments ADD COLUMN parent_id INTEGER REFERENCES comments(id) ON DELETE CASCADE;
+ALTER TABLE comments ADD COLUMN depth INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX idx_comments_post ON comments(post_id);
+`),
+		Down: execSQL(`
+DROP INDEX IF EXISTS idx_comments_post;
+ALTER TABLE comments DROP COLUMN depth;
+ALTER TABLE comments DROP COLUMN parent_id;
+`),
+	},
+	{
+		Version: 6,
+		Name:    "roles and category moderators",
+		Up: execSQL(`
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'member'
+  CHECK (role IN ('member', 'moderator', 'admin'));
+
+CREATE TABLE category_moderators (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+  PRIMARY KEY (user_id, category_id)
+);
+`),
+		Down: execSQL(`
+DROP TABLE IF EXISTS category_moderators;
+ALTER TABLE users DROP COLUMN role;
+`),
+	},
+	{
+		Version: 7,
+		Name:    "reports and moderation log",
+		Up: execSQL(`
+ALTER TABLE users ADD COLUMN suspended_until INTEGER NOT NULL DEFAULT 0; -- unix seconds
+ALTER TABLE posts ADD COLUMN hidden_at DATETIME;
+ALTER TABLE posts ADD COLUMN hidden_by INTEGER REFERENCES users(id);
+ALTER TABLE comments ADD COLUMN hidden_at DATETIME;
+ALTER TABLE comments ADD COLUMN hidden_by INTEGER REFERENCES users(id);
+
+CREATE TABLE reports (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  reporter_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  target_kind TEXT NOT NULL CHECK (target_kind IN ('post', 'comment', 'user')),
+  target_id INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  details TEXT NOT NULL DEFAULT '',
+  status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved')),
+  resolution TEXT NOT NULL DEFAULT '',
+  resolved_by INTEGER REFERENCES users(id),
+  resolved_at DATETIME,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_reports_open ON reports(status, created_at);
+
+-- append-only: no foreign keys (so nothing cascades into it) and triggers
+-- that refuse UPDATE and DELETE
+CREATE TABLE moderation_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  moderator_id INTEGER NOT NULL,
+  action TEXT NOT NULL,
+  target_kind TEXT NOT NULL,
+  target_id INTEGER NOT NULL,
+  target_user_id INTEGER NOT NULL,
+  report_id INTEGER,
+  note TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_moderation_log_user ON moderation_log(target_user_id);
+CREATE TRIGGER moderation_log_no_update BEFORE UPDATE ON moderation_log BEGIN
+  SELECT RAISE(ABORT, 'moderation_log is append-only');
+END;
+CREATE TRIGGER moderation_log_no_delete BEFORE DELETE ON moderation_log BEGIN
+  SELECT RAISE(ABORT, 'moderation_log is append-only');
+END;
+`),
+		Down: execSQL(`
+DROP TABLE IF EXISTS moderation_log;
+DROP TABLE IF EXISTS reports;
+ALTER TABLE comments DROP COLUMN hidden_by;
+ALTER TABLE comments DROP COLUMN hidden_at;
+ALTER TABLE posts DROP COLUMN hidden_by;
+ALTER TABLE posts DROP COLUMN hidden_at;
+ALTER TABLE users DROP COLUMN suspended_until;
+`),
+	},
+	{
+		Version: 8,
+		Name:    "soft-delete posts and comments",
+		Up: execSQL(`
+ALTER TABLE posts ADD COLUMN deleted_at DATETIME;
+ALTER TABLE posts ADD COLUMN deleted_by INTEGER REFERENCES users(id);
+ALTER TABLE comments ADD COLUMN deleted_at DATETIME;
+ALTER TABLE comments ADD COLUMN deleted_by INTEGER REFERENCES users(id);
+`),
+		Down: execSQL(`
+ALTER TABLE comments DROP COLUMN deleted_by;
+ALTER TABLE comments DROP COLUMN deleted_at;
+ALTER TABLE posts DROP COLUMN deleted_by;
+ALTER TABLE posts DROP COLUMN deleted_at;
+`),
+	},
+	{
+		// NULL content_html means "render on next view"; see markdown.go
+		Version: 9,
+		Name:    "rendered markdown cache",
+		Up: execSQL(`
+ALTER TABLE posts ADD COLUMN content_html TEXT;
+ALTER TABLE comments ADD COLUMN content_html TEXT;
+`),
+		Down: execSQL(`
+ALTER TABLE comments DROP COLUMN content_html;
+ALTER TABLE posts DROP COLUMN content_html;
+`),
+	},
+	{
+		// reading progress is per category until posts can point at a book;
+		// the renderer learned spoiler markup, so cached HTML is re-rendered
+		Version: 10,
+		Name:    "spoilers and reading progress",
+		Up: execSQL(`
+ALTER TABLE posts ADD COLUMN spoiler_chapter INTEGER;
+CREATE TABLE reading_progress (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+  chapter INTEGER NOT NULL,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, category_id)
+);
+UPDATE posts SET content_html = NULL;
+UPDATE comments SET content_html = NULL;
+`),
+		Down: execSQL(`
+DROP TABLE reading_progress;
+ALTER TABLE posts DROP COLUMN spoiler_chapter;
+UPDATE posts SET content_html = NULL;
+UPDATE comments SET content_html = NULL;
+`),
+	},
+	{
+		Version: 11,
+		Name:    "books",
+		Up: execSQL(`
+CREATE TABLE books (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  title TEXT NOT NULL,
+  authors TEXT NOT NULL DEFAULT '',
+  isbn TEXT UNIQUE,
+  year INTEGER,
+  cover_path TEXT NOT NULL DEFAULT '',
+  created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+ALTER TABLE posts ADD COLUMN book_id INTEGER REFERENCES books(id) ON DELETE SET NULL;
+CREATE INDEX idx_posts_book ON posts(book_id);
+`),
+		Down: execSQL(`
+DROP INDEX idx_posts_book;
+ALTER TABLE posts DROP COLUMN book_id;
+DROP TABLE books;
+`),
+	},
+	{
+		Version: 12,
+		Name:    "bookshelves",
+		Up: execSQL(`
+CREATE TABLE shelf_entries (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+  status TEXT NOT NULL CHECK (status IN ('want', 'reading', 'finished', 'abandoned')),
+  started_on TEXT,
+  finished_on TEXT,
+  progress INTEGER NOT NULL DEFAULT 0,
+  progress_unit TEXT NOT NULL DEFAULT 'percent' CHECK (progress_unit IN ('percent', 'page')),
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, book_id)
+);
+CREATE INDEX idx_shelf_entries_book ON shelf_entries(book_id, status);
+`),
+		Down: execSQL(`DROP TABLE shelf_entries;`),
+	},
+	{
+		Version: 13,
+		Name:    "shelf ratings",
+		Up: execSQL(`
+-- rating is in half-stars, 1..10, so 7 is three and a half stars
+ALTER TABLE shelf_entries ADD COLUMN rating INTEGER CHECK (rating BETWEEN 1 AND 10);
+`),
+		Down: execSQL(`ALTER TABLE shelf_entries DROP COLUMN rating;`),
+	},
+	{
+		Version: 14,
+		Name:    "reviews",
+		Up: execSQL(`
+-- a post with a reviews row is a review of its book; scores are half-stars
+CREATE TABLE reviews (
+  post_id INTEGER PRIMARY KEY REFERENCES posts(id) ON DELETE CASCADE,
+  rating INTEGER NOT NULL CHECK (rating BETWEEN 1 AND 10),
+  prose INTEGER CHECK (prose BETWEEN 1 AND 10),
+  plot INTEGER CHECK (plot BETWEEN 1 AND 10),
+  characters INTEGER CHECK (characters BETWEEN 1 AND 10)
+);
+`),
+		Down: execSQL(`DROP TABLE reviews;`),
+	},
+	{
+		Version: 15,
+		Name:    "club reads",
+		Up: execSQL(`
+CREATE TABLE club_reads (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+  title TEXT NOT NULL,
+  starts_on TEXT NOT NULL,
+  created_by INTEGER NOT NULL REFERENCES users(id),
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE club_milestones (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  club_read_id INTEGER NOT NULL REFERENCES club_reads(id) ON DELETE CASCADE,
+  position INTEGER NOT NULL,
+  label TEXT NOT NULL,
+  up_to_chapter INTEGER,
+  opens_on TEXT NOT NULL,
+  post_id INTEGER REFERENCES posts(id) ON DELETE SET NULL,
+  UNIQUE (club_read_id, position)
+);
+CREATE INDEX idx_club_milestones_due ON club_milestones(opens_on) WHERE post_id IS NULL;
+CREATE TABLE club_section_reads (
+  milestone_id INTEGER NOT NULL REFERENCES club_milestones(id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  read_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (milestone_id, user_id)
+);
+`),
+		Down: execSQL(`
+DROP TABLE club_section_reads;
+DROP TABLE club_milestones;
+DROP TABLE club_reads;
+`),
+	},
+	{
+		Version: 16,
+		Name:    "events",
+		Up: execSQL(`
+-- starts_at/ends_at are UTC "YYYY-MM-DD HH:MM:SS"; time_zone is the IANA
+-- zone the organizer entered them in, used for display
+CREATE TABLE events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  title TEXT NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+  club_read_id INTEGER REFERENCES club_reads(id) ON DELETE SET NULL,
+  starts_at TEXT NOT NULL,
+  ends_at TEXT NOT NULL,
+  time_zone TEXT NOT NULL DEFAULT 'UTC',
+  location TEXT NOT NULL DEFAULT '',
+  url TEXT NOT NULL DEFAULT '',
+  capacity INTEGER NOT NULL DEFAULT 0,
+  created_by INTEGER NOT NULL REFERENCES users(id),
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_events_ends ON events(ends_at);
+CREATE TABLE event_rsvps (
+  event_id INTEGER NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  status TEXT NOT NULL CHECK (status IN ('going', 'maybe', 'declined')),
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (event_id, user_id)
+);
+ALTER TABLE users ADD COLUMN calendar_token TEXT;
+CREATE UNIQUE INDEX idx_users_calendar_token ON users(calendar_token);
+`),
+		Down: execSQL(`
+DROP INDEX idx_users_calendar_token;
+ALTER TABLE users DROP COLUMN calendar_token;
+DROP TABLE event_rsvps;
+DROP TABLE events;
+`),
+	},
+	{
+		Version: 17,
+		Name:    "quotes",
+		Up: execSQL(`
+-- location is a page number or a free-form position ("loc. 1234", "ch. 3")
+CREATE TABLE quotes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  book_id INTEGER NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+  text TEXT NOT NULL,
+  location TEXT NOT NULL DEFAULT '',
+  commentary TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_quotes_book ON quotes(book_id);
+CREATE TABLE quote_reactions (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  quote_id INTEGER NOT NULL REFERENCES quotes(id) ON DELETE CASCADE,
+  value INTEGER NOT NULL CHECK (value IN (-1, 1)),
+  PRIMARY KEY (user_id, quote_id)
+);
+-- the renderer now turns [quote:N] lines into embeds
+UPDATE posts SET content_html = NULL;
+UPDATE comments SET content_html = NULL;
+`),
+		Down: execSQL(`
+DROP TABLE quote_reactions;
+DROP TABLE quotes;
+UPDATE posts SET content_html = NULL;
+UPDATE comments SET content_html = NULL;
+`),
+	},
+	{
+		Version: 18,
+		Name:    "reading challenges",
+		Up: execSQL(`
+ALTER TABLE books ADD COLUMN pages INTEGER;
+CREATE TABLE reading_goals (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  year INTEGER NOT NULL,
+  unit TEXT NOT NULL CHECK (unit IN ('books', 'pages')),
+  target INTEGER NOT NULL CHECK (target > 0),
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, year)
+);
+-- themed challenges: a checklist members tick off, optionally with a book
+CREATE TABLE challenges (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  title TEXT NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  starts_on TEXT NOT NULL,
+  ends_on TEXT NOT NULL,
+  created_by INTEGER NOT NULL REFERENCES users(id),
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE challenge_criteria (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  challenge_id INTEGER NOT NULL REFERENCES challenges(id) ON DELETE CASCADE,
+  position INTEGER NOT NULL,
+  label TEXT NOT NULL,
+  UNIQUE (challenge_id, position)
+);
+CREATE TABLE challenge_checks (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  criterion_id INTEGER NOT NULL REFERENCES challenge_criteria(id) ON DELETE CASCADE,
+  book_id INTEGER REFERENCES books(id) ON DELETE SET NULL,
+  checked_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, criterion_id)
+);
+`),
+		Down: execSQL(`
+DROP TABLE challenge_checks;
+DROP TABLE challenge_criteria;
+DROP TABLE challenges;
+DROP TABLE reading_goals;
+ALTER TABLE books DROP COLUMN pages;
+`),
+	},
+	{
+		Version: 19,
+		Name:    "notifications",
+		Up: execSQL(`
+CREATE TABLE notifications (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+  kind TEXT NOT NULL,
+  text TEXT NOT NULL,
+  link TEXT NOT NULL DEFAULT '',
+  read_at DATETIME,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_notifications_user ON notifications(user_id, read_at);
+-- one row per notification kind a member turned off
+CREATE TABLE notification_mutes (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  kind TEXT NOT NULL,
+  PRIMARY KEY (user_id, kind)
+);
+`),
+		Down: execSQL(`
+DROP TABLE notification_mutes;
+DROP TABLE notifications;
+`),
+	},
+	{
+		Version: 20,
+		Name:    "mentions",
+		Up: execSQL(`
+CREATE TABLE mentions (
+  target_kind TEXT NOT NULL CHECK (target_kind IN ('post','comment')),
+  target_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (target_kind, target_id, user_id)
+);
+CREATE INDEX idx_mentions_user ON mentions(user_id);
+-- the renderer now marks @username mentions
+UPDATE posts SET content_html = NULL;
+UPDATE comments SET content_html = NULL;
+`),
+		Down: execSQL(`
+DROP TABLE mentions;
+UPDATE posts SET content_html = NULL;
+UPDATE comments SET content_html = NULL;
+`),
+	},
+	{
+		Version: 21,
+		Name:    "mail_queue",
+		Up: execSQL(`
+CREATE TABLE mail_queue (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  to_addr TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  text_body TEXT NOT NULL,
+  html_body TEXT NOT NULL DEFAULT '',
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_error TEXT,
+  next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  sent_at DATETIME,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_mail_queue_due ON mail_queue(sent_at, next_attempt_at);
+`),
+		Down: execSQL(`
+DROP TABLE mail_queue;
+`),
+	},
+	{
+		Version: 22,
+		Name:    "password_resets",
+		Up: execSQL(`
+-- token_hash is the hex SHA-256 of the emailed token; times are unix
+-- seconds like sessions.expires_at
+CREATE TABLE password_resets (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash TEXT NOT NULL UNIQUE,
+  expires_at INTEGER NOT NULL,
+  used_at INTEGER,
+  created_at INTEGER NOT NULL
+);
+CREATE INDEX idx_password_resets_user ON password_resets(user_id, created_at);
+`),
+		Down: execSQL(`
+DROP TABLE password_resets;
+`),
+	},
+	{
+		Version: 23,
+		Name:    "email_verification",
+		Up: execSQL(`
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME;
+ALTER TABLE users ADD COLUMN verification_sent_at INTEGER;
+-- everyone who signed up before verification existed keeps full access
+UPDATE users SET email_verified_at = CURRENT_TIMESTAMP;
+-- keys for signed links, created on first use
+CREATE TABLE app_secrets (
+  name TEXT PRIMARY KEY,
+  value BLOB NOT NULL
+);
+`),
+		Down: execSQL(`
+DROP TABLE app_secrets;
+ALTER TABLE users DROP COLUMN verification_sent_at;
+ALTER TABLE users DROP COLUMN email_verified_at;
+`),
+	},
+	{
+		Version: 24,
+		Name:    "two_factor",
+		Up: execSQL(`
+-- totp_secret is base32; it is set during setup and 2FA is on once
+-- totp_enabled_at is. totp_last_step stops a code being replayed.
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+ALTER TABLE users ADD COLUMN totp_enabled_at DATETIME;
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE recovery_codes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at DATETIME
+);
+CREATE INDEX idx_recovery_codes_user ON recovery_codes(user_id);
+-- a correct password waiting for its second factor
+CREATE TABLE login_challenges (
+  token_hash TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at INTEGER NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0
+);
+`),
+		Down: execSQL(`
+DROP TABLE login_challenges;
+DROP TABLE recovery_codes;
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_enabled_at;
+ALTER TABLE users DROP COLUMN totp_secret;
+`),
+	},
+	{
+		Version: 25,
+		Name:    "session_devices",
+		Up: execSQL(`
+ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN last_seen_at INTEGER; -- unix seconds, like expires_at
+CREATE INDEX idx_sessions_user ON sessions(user_id);
+`),
+		Down: execSQL(`
+DROP INDEX idx_sessions_user;
+ALTER TABLE sessions DROP COLUMN last_seen_at;
+ALTER TABLE sessions DROP COLUMN ip;
+ALTER TABLE sessions DROP COLUMN user_agent;
+`),
+	},
+	{
+		Version: 26,
+		Name:    "login_attempts",
+		Up: execSQL(`
+CREATE TABLE login_attempts (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER REFERENCES users(id) ON DELETE CASCADE, -- NULL for unknown addresses
+  email TEXT NOT NULL,
+  ip TEXT NOT NULL,
+  success INTEGER NOT NULL DEFAULT 0,
+  reason TEXT NOT NULL,
+  created_at INTEGER NOT NULL -- unix seconds
+);
+CREATE INDEX idx_login_attempts_user ON login_attempts(user_id, created_at);
+CREATE INDEX idx_login_attempts_ip ON login_attempts(ip, created_at);
+ALTER TABLE users ADD COLUMN locked_until INTEGER NOT NULL DEFAULT 0;
+`),
+		Down: execSQL(`
+ALTER TABLE users DROP COLUMN locked_until;
+DROP TABLE login_attempts;
+`),
+	},
+	{
+		Version: 27,
+		Name:    "search without spoilers",
+		Up: func(tx *sql.Tx) error {
+			// the app stores the masked text next to the source, so the
+			// triggers are plain SQL and work from any sqlite3 client
+			for _, table := range []string{"posts", "comments"} {
+				if _, err := tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN content_masked TEXT NOT NULL DEFAULT ''`); err != nil {
+					return err
+				}
+				if err := backfillMasked(tx, table); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(searchTriggersSQL("content_masked") + searchRebuildSQL("content_masked"))
+			return err
+		},
+		Down: execSQL(searchTriggersSQL("content") + searchRebuildSQL("content") + `
+ALTER TABLE comments DROP COLUMN content_masked;
+ALTER TABLE posts DROP COLUMN content_masked;
+`),
+	},
+}
+
+// backfillMasked fills content_masked for every row of table.
+func backfillMasked(tx *sql.Tx, table string) error {
+	rows, err := tx.Query(`SELECT id, content FROM ` + table)
+	if err != nil {
+		return err
+	}
+	masked := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		masked[id] = maskSpoilers(content)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, m := range masked {
+		if _, err := tx.Exec(`UPDATE `+table+` SET content_masked = ? WHERE id = ?`, m, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchTriggersSQL recreates the triggers that keep search_fts in step with
+// posts and comments, indexing the given column as the text.
+func searchTriggersSQL(column string) string {
+	body := "new." + column
+	return `
+DROP TRIGGER posts_search_ai;
+DROP TRIGGER posts_search_au;
+DROP TRIGGER comments_search_ai;
+DROP TRIGGER comments_search_au;
+CREATE TRIGGER posts_search_ai AFTER INSERT ON posts BEGIN
+  INSERT INTO search_fts (rowid, title, body, kind, ref_id, post_id)
+  VALUES (new.id*2, new.title, ` + body + `, 'post', new.id, new.id);
+END;
+CREATE TRIGGER posts_search_au AFTER UPDATE OF title, ` + column + ` ON posts BEGIN
+  UPDATE search_fts SET title = new.title, body = ` + body + ` WHERE rowid = new.id*2;
+END;
+CREATE TRIGGER comments_search_ai AFTER INSERT ON comments BEGIN
+  INSERT INTO search_fts (rowid, title, body, kind, ref_id, post_id)
+  VALUES (new.id*2+1, '', ` + body + `, 'comment', new.id, new.post_id);
+END;
+CREATE TRIGGER comments_search_au AFTER UPDATE OF ` + column + ` ON comments BEGIN
+  UPDATE search_fts SET body = ` + body + ` WHERE rowid = new.id*2+1;
+END;
+`
+}
+
+// searchRebuildSQL refills search_fts, indexing the given column as the
+// text.
+func searchRebuildSQL(column string) string {
+	return `
+DELETE FROM search_fts;
+INSERT INTO search_fts (rowid, title, body, kind, ref_id, post_id)
+  SELECT id*2, title, ` + column + `, 'post', id, id FROM posts;
+INSERT INTO search_fts (rowid, title, body, kind, ref_id, post_id)
+  SELECT id*2+1, '', ` + column + `, 'comment', id, post_id FROM comments;
+`
+}
+
+// baselineSchemaSQL is the schema as it was before versioned migrations.
+// IF NOT EXISTS keeps it a no-op on databases that already have it.
+const baselineSchemaSQL = `
+CREATE TABLE IF NOT EXISTS users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  email TEXT NOT NULL UNIQUE,
+  username TEXT NOT NULL UNIQUE,
+  password_hash BLOB NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+  token TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at INTEGER NOT NULL, -- store unix seconds
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS categories (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS posts (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  title TEXT NOT NULL,
+  content TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS post_categories (
+  post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+  category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+  PRIMARY KEY (post_id, category_id)
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  content TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS post_reactions (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+  value INTEGER NOT NULL CHECK (value IN (-1, 1)),
+  PRIMARY KEY (user_id, post_id)
+);
+
+CREATE TABLE IF NOT EXISTS comment_reactions (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  comment_id INTEGER NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+  value INTEGER NOT NULL CHECK (value IN (-1, 1)),
+  PRIMARY KEY (user_id, comment_id)
+);
+`
+
+// searchSchemaSQL builds one FTS5 index over posts and comments. Rows are
+// keyed by rowid = id*2 for posts and id*2+1 for comments so the triggers
+// can find their row without scanning the UNINDEXED columns.
+const searchSchemaSQL = `
+CREATE VIRTUAL TABLE search_fts USING fts5(
+  title,
+  body,
+  kind UNINDEXED,    -- 'post' or 'comment'
+  ref_id UNINDEXED,  -- posts.id or comments.id
+  post_id UNINDEXED, -- the post the row belongs to
+  tokenize = 'porter unicode61'
+);
+
+CREATE TRIGGER posts_search_ai AFTER INSERT ON posts BEGIN
+  INSERT INTO search_fts (rowid, title, body, kind, ref_id, post_id)
+  VALUES (new.id*2, new.title, new.content, 'post', new.id, new.id);
+END;
+CREATE TRIGGER posts_search_au AFTER UPDATE OF title, content ON posts BEGIN
+  UPDATE search_fts SET title = new.title, body = new.content WHERE rowid = new.id*2;
+END;
+CREATE TRIGGER posts_search_ad AFTER DELETE ON posts BEGIN
+  DELETE FROM search_fts WHERE rowid = old.id*2;
+END;
+
+CREATE TRIGGER comments_search_ai AFTER INSERT ON comments BEGIN
+  INSERT INTO search_fts (rowid, title, body, kind, ref_id, post_id)
+  VALUES (new.id*2+1, '', new.content, 'comment', new.id, new.post_id);
+END;
+CREATE TRIGGER comments_search_au AFTER UPDATE OF content ON comments BEGIN
+  UPDATE search_fts SET body = new.content WHERE rowid = new.id*2+1;
+END;
+CREATE TRIGGER comments_search_ad AFTER DELETE ON comments BEGIN
+  DELETE FROM search_fts WHERE rowid = old.id*2+1;
+END;
+
+-- backfill everything written before the index existed
+INSERT INTO search_fts (rowid, title, body, kind, ref_id, post_id)
+  SELECT id*2, title, content, 'post', id, id FROM posts;
+INSERT INTO search_fts (rowid, title, body, kind, ref_id, post_id)
+  SELECT id*2+1, '', content, 'comment', id, post_id FROM comments;
+`
+
+// columnExists reports whether table has a column with the given name.
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// ensureMigrationsTable creates the bookkeeping table if needed.
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`)
+	return err
+}
+
+// appliedMigrations returns version -> applied_at for every applied step.
+func appliedMigrations(db *sql.DB) (map[int]string, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]string{}
+	for rows.Next() {
+		var v int
+		var at string
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+// sortedMigrations returns the registered migrations ordered by version and
+// rejects duplicate version numbers.
+func sortedMigrations() ([]migration, error) {
+	list := append([]migration(nil), migrations...)
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	for i := 1; i < len(list); i++ {
+		if list[i].Version == list[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", list[i].Version)
+		}
+	}
+	return list, nil
+}
+
+// runMigration applies or reverts one step in its own transaction.
+func runMigration(db *sql.DB, m migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	step := m.Down
+	if up {
+		step = m.Up
+	}
+	if step == nil {
+		return fmt.Errorf("migration %d (%s) is not reversible", m.Version, m.Name)
+	}
+	if err := step(tx); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	if up {
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name)
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration in version order and returns
+// the versions it applied.
+func migrateUp(db *sql.DB) ([]int, error) {
+	list, err := sortedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var done []int
+	for _, m := range list {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := runMigration(db, m, true); err != nil {
+			return done, err
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// migrateDown reverts the most recent `steps` applied migrations and
+// returns the versions it reverted.
+func migrateDown(db *sql.DB, steps int) ([]int, error) {
+	list, err := sortedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var done []int
+	for i := len(list) - 1; i >= 0 && len(done) < steps; i-- {
+		m := list[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if err := runMigration(db, m, false); err != nil {
+			return done, err
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// Migrate implements `forumd migrate up|down [n]|status`.
+func Migrate(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: forumd migrate up|down [n]|status")
+	}
+	db, err := openRawDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		done, err := migrateUp(db)
+		for _, v := range done {
+			fmt.Fprintf(out, "applied %d\n", v)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Fprintln(out, "nothing to apply")
+		}
+		return nil
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+			steps = n
+		}
+		done, err := migrateDown(db, steps)
+		for _, v := range done {
+			fmt.Fprintf(out, "reverted %d\n", v)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Fprintln(out, "nothing to revert")
+		}
+		return nil
+	case "status":
+		list, err := sortedMigrations()
+		if err != nil {
+			return err
+		}
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		for _, m := range list {
+			if at, ok := applied[m.Version]; ok {
+				fmt.Fprintf(out, "%4d  %-28s  %s\n", m.Version, "applied "+at, m.Name)
+			} else {
+				fmt.Fprintf(out, "%4d  %-28s  %s\n", m.Version, "pending", m.Name)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// schema returns the database's tables, indexes and triggers, one per line.
+func schema(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query(`SELECT type, name, COALESCE(sql, '') FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var typ, name, def string
+		if err := rows.Scan(&typ, &name, &def); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, typ+" "+name+": "+def)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(out, "\n")
+}
+
+// TestMigrateUpDown applies every migration to an empty database, reverts
+// them all, and applies them again; the result must match the first run.
+func TestMigrateUpDown(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "forum.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	up, err := migrateUp(db)
+	if err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if len(up) != len(migrations) {
+		t.Fatalf("up applied %d migrations, want %d", len(up), len(migrations))
+	}
+	want := schema(t, db)
+
+	down, err := migrateDown(db, len(migrations))
+	if err != nil {
+		t.Fatalf("down after %v: %v", down, err)
+	}
+	if len(down) != len(migrations) {
+		t.Fatalf("down reverted %d migrations, want %d", len(down), len(migrations))
+	}
+	if got := schema(t, db); got != "table schema_migrations: "+schemaMigrationsDef(t, db) {
+		t.Errorf("schema left after reverting everything:\n%s", got)
+	}
+
+	if _, err := migrateUp(db); err != nil {
+		t.Fatalf("second up: %v", err)
+	}
+	if got := schema(t, db); got != want {
+		t.Errorf("schema after down and up again differs:\n%s\nwant\n%s", got, want)
+	}
+}
+
+func schemaMigrationsDef(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	var def string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE name = 'schema_migrations'`).Scan(&def); err != nil {
+		t.Fatal(err)
+	}
+	return def
+}
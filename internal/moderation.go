@@ -0,0 +1,507 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportReasons are the reason codes offered on the report form.
+var reportReasons = []struct {
+	Code  string
+	Label string
+}{
+	{"spam", "Spam or advertising"},
+	{"harassment", "Harassment or hate"},
+	{"spoiler", "Unmarked spoilers"},
+	{"off_topic", "Off-topic"},
+	{"inappropriate", "Inappropriate content"},
+	{"other", "Something else"},
+}
+
+// validReportReason reports whether code is one of reportReasons.
+func validReportReason(code string) bool {
+	for _, r := range reportReasons {
+		if r.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Moderation actions recorded in moderation_log.
+const (
+	ModDismiss = "dismiss"
+	ModHide    = "hide"
+	ModUnhide  = "unhide"
+	ModWarn    = "warn"
+	ModSuspend = "suspend"
+)
+
+// reportTarget describes the thing a report points at.
+type reportTarget struct {
+	Kind     string
+	ID       int64
+	PostID   int64 // owning post for posts and comments, 0 for users
+	AuthorID int64
+	Author   string
+	Label    string // post title, comment excerpt or username
+	Link     string
+	Hidden   bool
+}
+
+var errNoTarget = errors.New("report target not found")
+
+// loadReportTarget resolves kind/id to the reported content and its author.
+func loadReportTarget(db dbtx, kind string, id int64) (*reportTarget, error) {
+	t := &reportTarget{Kind: kind, ID: id}
+	var hiddenAt sql.NullString
+	var err error
+	switch kind {
+	case "post":
+		err = db.QueryRow(`
+			SELECT p.id, p.user_id, u.username, p.title, p.hidden_at
+			FROM posts p JOIN users u ON u.id = p.user_id WHERE p.id = ?`, id).
+			Scan(&t.PostID, &t.AuthorID, &t.Author, &t.Label, &hiddenAt)
+		t.Link = fmt.Sprintf("/post?id=%d", id)
+	case "comment":
+		err = db.QueryRow(`
+			SELECT c.post_id, c.user_id, u.username, substr(c.content, 1, 200), c.hidden_at
+			FROM comments c JOIN users u ON u.id = c.user_id WHERE c.id = ?`, id).
+			Scan(&t.PostID, &t.AuthorID, &t.Author, &t.Label, &hiddenAt)
+		t.Link = fmt.Sprintf("/post?id=%d#comment-%d", t.PostID, id)
+	case "user":
+		err = db.QueryRow(`SELECT id, username FROM users WHERE id = ?`, id).Scan(&t.AuthorID, &t.Author)
+		t.Label = t.Author
+		t.Link = "/u/" + t.Author
+	default:
+		return nil, errNoTarget
+	}
+	if err == sql.ErrNoRows {
+		return nil, errNoTarget
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Hidden = hiddenAt.Valid
+	return t, nil
+}
+
+// canModerateTarget: posts and comments can be handled by category
+// moderators of the post's categories; users only by forum-wide moderators.
+func (a *App) canModerateTarget(u *User, t *reportTarget) bool {
+	if t.Kind == "user" {
+		return u.Can(PermModerate)
+	}
+	return a.canModeratePost(u, t.PostID)
+}
+
+// logModeration appends one entry to the immutable moderation log.
+func logModeration(db dbtx, moderatorID int64, action string, t *reportTarget, reportID int64, note string) error {
+	var rid sql.NullInt64
+	if reportID > 0 {
+		rid = sql.NullInt64{Int64: reportID, Valid: true}
+	}
+	_, err := db.Exec(`
+		INSERT INTO moderation_log (moderator_id, action, target_kind, target_id, target_user_id, report_id, note)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, moderatorID, action, t.Kind, t.ID, t.AuthorID, rid, note)
+	if err != nil {
+		return err
+	}
+	if msg := moderationNotice(action, t, note); msg != "" {
+		return notify(db, t.AuthorID, moderatorID, NotifyModeration, msg, "/me/settings")
+	}
+	return nil
+}
+
+// setHidden hides or unhides a post or comment.
+func setHidden(db dbtx, t *reportTarget, moderatorID int64, hide bool) error {
+	table := "posts"
+	if t.Kind == "comment" {
+		table = "comments"
+	} else if t.Kind != "post" {
+		return errors.New("only posts and comments can be hidden")
+	}
+	var err error
+	if hide {
+		_, err = db.Exec(`UPDATE `+table+` SET hidden_at = CURRENT_TIMESTAMP, hidden_by = ? WHERE id = ?`, moderatorID, t.ID)
+	} else {
+		_, err = db.Exec(`UPDATE `+table+` SET hidden_at = NULL, hidden_by = NULL WHERE id = ?`, t.ID)
+	}
+	return err
+}
+
+// ReportGET — GET /report?kind=post|comment|user&id=123
+func (a *App) ReportGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermReport)
+	if !ok {
+		return
+	}
+	id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	t, err := loadReportTarget(a.db, r.URL.Query().Get("kind"), id)
+	if err == errNoTarget {
+		a.renderError(w, http.StatusNotFound, "Nothing to report here.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	data := map[string]any{
+		"Title":     "Report",
+		"User":      u,
+		"Target":    t,
+		"Reasons":   reportReasons,
+		"CSRFToken": a.generateCSRF(r),
+	}
+	a.render(w, "report.html", data)
+}
+
+// ReportPOST — POST /report
+// Form fields: kind, id, reason, details
+func (a *App) ReportPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermReport)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	id, _ := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	reason := r.Form.Get("reason")
+	details := strings.TrimSpace(r.Form.Get("details"))
+	if !validReportReason(reason) || len(details) > 1000 {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+	t, err := loadReportTarget(a.db, r.Form.Get("kind"), id)
+	if err == errNoTarget {
+		a.renderError(w, http.StatusNotFound, "Nothing to report here.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	// one open report per reporter and target is enough
+	var dup int
+	_ = a.db.QueryRow(`SELECT COUNT(*) FROM reports WHERE reporter_id = ? AND target_kind = ? AND target_id = ? AND status = 'open'`,
+		u.ID, t.Kind, t.ID).Scan(&dup)
+	if dup == 0 {
+		if _, err := a.db.Exec(`INSERT INTO reports (reporter_id, target_kind, target_id, reason, details) VALUES (?, ?, ?, ?, ?)`,
+			u.ID, t.Kind, t.ID, reason, details); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, t.Link, http.StatusSeeOther)
+}
+
+// requireModerator lets through forum-wide moderators and anyone who
+// moderates at least one category.
+func (a *App) requireModerator(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	if u, _ := a.currentUser(r); u != nil && !u.Can(PermModerate) && a.isCategoryModerator(u) {
+		return u, true
+	}
+	return a.authorize(w, r, PermModerate)
+}
+
+// canSuspend reports whether u may suspend the account targetID. Nobody
+// suspends themselves, and only admins suspend admins.
+func canSuspend(db dbtx, u *User, targetID int64) (bool, error) {
+	if targetID == u.ID {
+		return false, nil
+	}
+	var role string
+	if err := db.QueryRow(`SELECT role FROM users WHERE id = ?`, targetID).Scan(&role); err != nil {
+		return false, err
+	}
+	return role != RoleAdmin || u.Can(PermManageUsers), nil
+}
+
+// ModQueueGET — GET /mod/queue
+// Open reports the viewer is allowed to act on, oldest first.
+func (a *App) ModQueueGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.requireModerator(w, r)
+	if !ok {
+		return
+	}
+	// category moderators only get reports on posts and comments in their
+	// categories; filtering here rather than after the LIMIT keeps their
+	// reports from being crowded out by everyone else's
+	rows, err := a.db.Query(`
+		SELECT r.id, r.target_kind, r.target_id, r.reason, r.details, r.created_at, u.username
+		FROM reports r
+		JOIN users u ON u.id = r.reporter_id
+		WHERE r.status = 'open'
+		  AND (? OR EXISTS (
+		    SELECT 1 FROM category_moderators cm
+		    JOIN post_categories pc ON pc.category_id = cm.category_id
+		    WHERE cm.user_id = ? AND pc.post_id = CASE r.target_kind
+		      WHEN 'post' THEN r.target_id
+		      WHEN 'comment' THEN (SELECT post_id FROM comments WHERE id = r.target_id)
+		    END))
+		ORDER BY r.created_at ASC
+		LIMIT 200`, u.Can(PermModerate), u.ID)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	type queueItem struct {
+		ID        int64
+		Reason    string
+		Details   string
+		CreatedAt string
+		Reporter  string
+		Target    *reportTarget
+		CanSanction bool // warn/suspend need forum-wide moderation rights
+	}
+	var raw []queueItem
+	for rows.Next() {
+		var it queueItem
+		var kind string
+		var targetID int64
+		if err := rows.Scan(&it.ID, &kind, &targetID, &it.Reason, &it.Details, &it.CreatedAt, &it.Reporter); err == nil {
+			it.Target = &reportTarget{Kind: kind, ID: targetID}
+			raw = append(raw, it)
+		}
+	}
+	rows.Close()
+
+	var items []queueItem
+	for _, it := range raw {
+		t, err := loadReportTarget(a.db, it.Target.Kind, it.Target.ID)
+		if err != nil {
+			continue // target is gone; nothing left to moderate
+		}
+		if !a.canModerateTarget(u, t) {
+			continue
+		}
+		it.Target = t
+		it.CanSanction = u.Can(PermModerate)
+		items = append(items, it)
+	}
+
+	data := map[string]any{
+		"Title":     "Moderation queue",
+		"User":      u,
+		"Items":     items,
+		"CSRFToken": a.generateCSRF(r),
+	}
+	a.render(w, "mod_queue.html", data)
+}
+
+// ModActionPOST — POST /mod/action
+// Form fields: report_id, action=dismiss|hide|warn|suspend, note, days
+// Resolves every open report on the same target with one decision.
+func (a *App) ModActionPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.requireModerator(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	reportID, _ := strconv.ParseInt(r.Form.Get("report_id"), 10, 64)
+	action := r.Form.Get("action")
+	note := strings.TrimSpace(r.Form.Get("note"))
+
+	var kind string
+	var targetID int64
+	err := a.db.QueryRow(`SELECT target_kind, target_id FROM reports WHERE id = ? AND status = 'open'`, reportID).
+		Scan(&kind, &targetID)
+	if err == sql.ErrNoRows {
+		http.Redirect(w, r, "/mod/queue", http.StatusSeeOther) // already handled
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	t, err := loadReportTarget(a.db, kind, targetID)
+	if err != nil && err != errNoTarget {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		t = &reportTarget{Kind: kind, ID: targetID}
+		action = ModDismiss // content is gone; only dismissing makes sense
+	}
+	if !a.canModerateTarget(u, t) {
+		a.renderError(w, http.StatusForbidden, "You can't moderate this content.")
+		return
+	}
+	if (action == ModWarn || action == ModSuspend) && !u.Can(PermModerate) {
+		a.renderError(w, http.StatusForbidden, "Only moderators can warn or suspend members.")
+		return
+	}
+	if action == ModSuspend {
+		ok, err := canSuspend(a.db, u, t.AuthorID)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			a.renderError(w, http.StatusForbidden, "You can't suspend this account.")
+			return
+		}
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	switch action {
+	case ModDismiss, ModWarn:
+		// nothing to change besides the log
+	case ModHide:
+		err = setHidden(tx, t, u.ID, true)
+	case ModSuspend:
+		days, _ := strconv.Atoi(r.Form.Get("days"))
+		if days < 1 || days > 365 {
+			http.Error(w, "suspension must be 1-365 days", http.StatusBadRequest)
+			return
+		}
+		until := time.Now().Add(time.Duration(days) * 24 * time.Hour).Unix()
+		_, err = tx.Exec(`UPDATE users SET suspended_until = MAX(suspended_until, ?) WHERE id = ?`, until, t.AuthorID)
+		note = strings.TrimSpace(fmt.Sprintf("%d days. %s", days, note))
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`
+		UPDATE reports SET status = 'resolved', resolution = ?, resolved_by = ?, resolved_at = CURRENT_TIMESTAMP
+		WHERE target_kind = ? AND target_id = ? AND status = 'open'`, action, u.ID, t.Kind, t.ID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := logModeration(tx, u.ID, action, t, reportID, note); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/mod/queue", http.StatusSeeOther)
+}
+
+// ModUnhidePOST — POST /mod/unhide
+// Form fields: kind=post|comment, id
+func (a *App) ModUnhidePOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.requireModerator(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	id, _ := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	t, err := loadReportTarget(a.db, r.Form.Get("kind"), id)
+	if err != nil || t.Kind == "user" {
+		http.Error(w, "invalid target", http.StatusBadRequest)
+		return
+	}
+	if !a.canModerateTarget(u, t) {
+		a.renderError(w, http.StatusForbidden, "You can't moderate this content.")
+		return
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := setHidden(tx, t, u.ID, false); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := logModeration(tx, u.ID, ModUnhide, t, 0, ""); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, t.Link, http.StatusSeeOther)
+}
+
+// ModerationEntry is one row of the moderation log.
+type ModerationEntry struct {
+	ID         int64
+	Moderator  string
+	Action     string
+	TargetKind string
+	TargetID   int64
+	TargetUser string
+	Note       string
+	CreatedAt  string
+}
+
+// listModerationLog returns log entries newest first, optionally only those
+// about one user.
+func listModerationLog(db *sql.DB, targetUserID int64, limit int) ([]ModerationEntry, error) {
+	q := `
+		SELECT l.id, COALESCE(m.username, '?'), l.action, l.target_kind, l.target_id,
+		       COALESCE(t.username, '?'), l.note, l.created_at
+		FROM moderation_log l
+		LEFT JOIN users m ON m.id = l.moderator_id
+		LEFT JOIN users t ON t.id = l.target_user_id`
+	args := []any{}
+	if targetUserID > 0 {
+		q += ` WHERE l.target_user_id = ?`
+		args = append(args, targetUserID)
+	}
+	q += ` ORDER BY l.id DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ModerationEntry
+	for rows.Next() {
+		var e ModerationEntry
+		if err := rows.Scan(&e.ID, &e.Moderator, &e.Action, &e.TargetKind, &e.TargetID, &e.TargetUser, &e.Note, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// ModLogGET — GET /mod/log
+// The full audit trail; forum-wide moderators only.
+func (a *App) ModLogGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermModerate)
+	if !ok {
+		return
+	}
+	entries, err := listModerationLog(a.db, 0, 500)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	data := map[string]any{
+		"Title":   "Moderation log",
+		"User":    u,
+		"Entries": entries,
+	}
+	a.render(w, "mod_log.html", data)
+}
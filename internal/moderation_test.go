@@ -0,0 +1,31 @@
+package app
+
+import "testing"
+
+func TestCanSuspend(t *testing.T) {
+	db := newTestDB(t)
+	users := map[string]*User{}
+	for _, role := range []string{RoleMember, RoleModerator, RoleAdmin} {
+		id := mustExec(t, db, `INSERT INTO users(email, username, password_hash, role) VALUES(?,?,'x',?)`, role+"@x.y", role, role)
+		users[role] = &User{ID: id, Username: role, Role: role}
+	}
+	tests := []struct {
+		by, target string
+		want       bool
+	}{
+		{RoleModerator, RoleMember, true},
+		{RoleModerator, RoleModerator, false}, // themselves
+		{RoleModerator, RoleAdmin, false},
+		{RoleAdmin, RoleModerator, true},
+		{RoleAdmin, RoleAdmin, false},
+	}
+	for _, tt := range tests {
+		got, err := canSuspend(db, users[tt.by], users[tt.target].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s suspending %s: %v, want %v", tt.by, tt.target, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package app
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Notification kinds. Members can turn each one off.
+const (
+	NotifyPostReply    = "post_reply"
+	NotifyCommentReply = "comment_reply"
+	NotifyReaction     = "reaction"
+	NotifyMention      = "mention"
+	NotifyModeration   = "moderation"
+)
+
+// notificationKinds lists the kinds in the order the preferences show them.
+var notificationKinds = []struct{ Key, Label string }{
+	{NotifyPostReply, "Comments on my posts"},
+	{NotifyCommentReply, "Replies to my comments"},
+	{NotifyReaction, "Likes and dislikes on my posts, comments and quotes"},
+	{NotifyMention, "@mentions"},
+	{NotifyModeration, "Moderator actions on my content or account"},
+}
+
+// maxNotifications is how many notifications the page shows.
+const maxNotifications = 100
+
+// Notification is one entry of a member's notification center.
+type Notification struct {
+	ID        int64
+	Kind      string
+	Text      string
+	Link      string
+	Read      bool
+	CreatedAt string
+}
+
+// notify records a notification for userID unless it is about their own
+// action or they turned the kind off. An unread notification with the same
+// actor, kind and link isn't repeated, so toggling a like doesn't spam.
+func notify(db dbtx, userID, actorID int64, kind, text, link string) error {
+	if userID <= 0 || userID == actorID {
+		return nil
+	}
+	var skip int
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM notification_mutes WHERE user_id = ? AND kind = ?)
+		    OR EXISTS (SELECT 1 FROM notifications WHERE user_id = ? AND actor_id IS ? AND kind = ? AND link = ? AND read_at IS NULL)`,
+		userID, kind, userID, nullID(actorID), kind, link).Scan(&skip)
+	if err != nil || skip > 0 {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO notifications (user_id, actor_id, kind, text, link) VALUES (?, ?, ?, ?, ?)`,
+		userID, nullID(actorID), kind, text, link)
+	return err
+}
+
+// nullID stores 0 as NULL.
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id > 0}
+}
+
+// snippet shortens user text for notification messages.
+func snippet(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return strings.TrimSpace(string(r[:n])) + "…"
+}
+
+// listNotifications returns the newest notifications of a member.
+func listNotifications(db *sql.DB, userID int64) ([]Notification, error) {
+	rows, err := db.Query(`
+		SELECT id, kind, text, link, read_at IS NOT NULL, created_at
+		FROM notifications WHERE user_id = ?
+		ORDER BY id DESC LIMIT ?`, userID, maxNotifications)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Text, &n.Link, &n.Read, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// mutedKinds returns the kinds the member turned off.
+func mutedKinds(db *sql.DB, userID int64) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT kind FROM notification_mutes WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	muted := map[string]bool{}
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		muted[k] = true
+	}
+	return muted, rows.Err()
+}
+
+// NotificationsRouter handles everything under /me/notifications:
+//
+//	/me/notifications              the list and preferences
+//	/me/notifications/open?id=     mark read and follow the link
+//	/me/notifications/read         POST id, mark one read
+//	/me/notifications/read-all     POST
+//	/me/notifications/prefs        POST, one checkbox per kind
+func (a *App) NotificationsRouter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/notifications"), "/")
+	post := r.Method == http.MethodPost
+	switch {
+	case rest == "" && !post:
+		a.NotificationsGET(w, r)
+	case rest == "open" && !post:
+		a.NotificationOpenGET(w, r)
+	case rest == "read" && post:
+		a.NotificationReadPOST(w, r, false)
+	case rest == "read-all" && post:
+		a.NotificationReadPOST(w, r, true)
+	case rest == "prefs" && post:
+		a.NotificationPrefsPOST(w, r)
+	case post:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		a.renderError(w, http.StatusNotFound, "Page not found.")
+	}
+}
+
+// NotificationsGET — GET /me/notifications
+func (a *App) NotificationsGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	list, err := listNotifications(a.db, u.ID)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	muted, err := mutedKinds(a.db, u.ID)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	data := map[string]any{
+		"Title":         "Notifications",
+		"User":          u,
+		"Notifications": list,
+		"Kinds":         notificationKinds,
+		"Muted":         muted,
+		"Saved":         r.URL.Query().Get("saved") == "1",
+		"CSRFToken":     a.generateCSRF(r),
+	}
+	a.render(w, "notifications.html", data)
+}
+
+// NotificationOpenGET — GET /me/notifications/open?id=
+// Marks the notification read and redirects to what it is about.
+func (a *App) NotificationOpenGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	var link string
+	err := a.db.QueryRow(`SELECT link FROM notifications WHERE id = ? AND user_id = ?`, id, u.ID).Scan(&link)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Notification not found.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	_, _ = a.db.Exec(`UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE id = ? AND read_at IS NULL`, id)
+	if !isLocalPath(link) {
+		link = "/me/notifications"
+	}
+	http.Redirect(w, r, link, http.StatusSeeOther)
+}
+
+// NotificationReadPOST — POST /me/notifications/read (id) and
+// /me/notifications/read-all
+func (a *App) NotificationReadPOST(w http.ResponseWriter, r *http.Request, all bool) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if all {
+		_, err = a.db.Exec(`UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL`, u.ID)
+	} else {
+		id, _ := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+		_, err = a.db.Exec(`UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ? AND read_at IS NULL`, id, u.ID)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me/notifications", http.StatusSeeOther)
+}
+
+// NotificationPrefsPOST — POST /me/notifications/prefs
+// Form fields: one checkbox named after each kind; unchecked kinds are muted.
+func (a *App) NotificationPrefsPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM notification_mutes WHERE user_id = ?`, u.ID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	for _, k := range notificationKinds {
+		if r.Form.Get(k.Key) != "" {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO notification_mutes (user_id, kind) VALUES (?, ?)`, u.ID, k.Key); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me/notifications?saved=1", http.StatusSeeOther)
+}
+
+// notifyComment tells the post author about a new comment, and the parent
+// comment's author about a reply. Someone who is both only hears once.
+func notifyComment(db dbtx, actor *User, postID, commentID int64, parent sql.NullInt64) error {
+	var postAuthor int64
+	var title string
+	if err := db.QueryRow(`SELECT user_id, title FROM posts WHERE id = ?`, postID).Scan(&postAuthor, &title); err != nil {
+		return err
+	}
+	link := "/post?id=" + strconv.FormatInt(postID, 10) + "#comment-" + strconv.FormatInt(commentID, 10)
+	title = snippet(title, 60)
+	if parent.Valid {
+		var parentAuthor int64
+		if err := db.QueryRow(`SELECT user_id FROM comments WHERE id = ?`, parent.Int64).Scan(&parentAuthor); err != nil {
+			return err
+		}
+		if err := notify(db, parentAuthor, actor.ID, NotifyCommentReply,
+			actor.Username+" replied to your comment on “"+title+"”", link); err != nil {
+			return err
+		}
+		if parentAuthor == postAuthor {
+			return nil
+		}
+	}
+	return notify(db, postAuthor, actor.ID, NotifyPostReply, actor.Username+" commented on your post “"+title+"”", link)
+}
+
+// notifyReaction tells the author of a post, comment or quote that actor
+// liked (v=1) or disliked (v=-1) it.
+func notifyReaction(db dbtx, actor *User, kind string, id int64, v int) error {
+	var author int64
+	var label, link string
+	var err error
+	switch kind {
+	case "post":
+		err = db.QueryRow(`SELECT user_id, title FROM posts WHERE id = ?`, id).Scan(&author, &label)
+		link = "/post?id=" + strconv.FormatInt(id, 10)
+	case "comment":
+		var postID int64
+		err = db.QueryRow(`SELECT user_id, content, post_id FROM comments WHERE id = ?`, id).Scan(&author, &label, &postID)
+		link = "/post?id=" + strconv.FormatInt(postID, 10) + "#comment-" + strconv.FormatInt(id, 10)
+	case "quote":
+		err = db.QueryRow(`SELECT user_id, text FROM quotes WHERE id = ?`, id).Scan(&author, &label)
+		link = "/quotes/" + strconv.FormatInt(id, 10)
+	}
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	verb := " liked your "
+	if v < 0 {
+		verb = " disliked your "
+	}
+	return notify(db, author, actor.ID, NotifyReaction, actor.Username+verb+kind+" “"+snippet(label, 60)+"”", link)
+}
+
+// moderationNotice is the notification text for a moderator action on t.
+// Dismissed reports aren't news to the author, so they get "".
+func moderationNotice(action string, t *reportTarget, note string) string {
+	what := "your " + t.Kind
+	if t.Label != "" && t.Kind != "user" {
+		what += " “" + snippet(t.Label, 60) + "”"
+	}
+	var s string
+	switch action {
+	case ModHide:
+		s = "A moderator hid " + what + "."
+	case ModUnhide:
+		s = "A moderator made " + what + " visible again."
+	case ModDelete:
+		s = "A moderator removed " + what + "."
+	case ModRestore:
+		s = "A moderator restored " + what + "."
+	case ModWarn:
+		s = "A moderator sent you a warning"
+		if t.Kind != "user" {
+			s += " about " + what
+		}
+		s += "."
+	case ModSuspend:
+		s = "Your account was suspended."
+	default:
+		return ""
+	}
+	if note != "" {
+		s += " " + note
+	}
+	return s
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Password reset. /forgot emails a link holding a random token; only its
+// SHA-256 is stored, so a leaked database can't be used to take accounts
+// over. A token works once, for resetTokenTTL, and using it signs the
+// member out everywhere.
+
+const (
+	resetTokenTTL = time.Hour
+	// resetResendGap stops /forgot from being used to flood an inbox.
+	resetResendGap = 2 * time.Minute
+	// minPasswordLen applies to new passwords set through a reset.
+	minPasswordLen = 8
+)
+
+// newToken returns a random URL-safe token and the hash to store for it.
+func newToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken is how tokens are looked up.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// resetTokenUser returns the user a live reset token belongs to, or
+// sql.ErrNoRows if it is unknown, used or expired.
+func resetTokenUser(db dbtx, token string, now time.Time) (int64, error) {
+	var userID int64
+	err := db.QueryRow(`SELECT user_id FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`,
+		hashToken(token), now.Unix()).Scan(&userID)
+	return userID, err
+}
+
+// validNewPassword checks a password chosen on the reset form.
+func validNewPassword(pw, confirm string) string {
+	switch {
+	case utf8.RuneCountInString(pw) < minPasswordLen:
+		return "Pick a password of at least 8 characters."
+	case len(pw) > 72:
+		return "Passwords are limited to 72 bytes."
+	case pw != confirm:
+		return "The two passwords don't match."
+	}
+	return ""
+}
+
+// ForgotGET — GET /forgot
+func (a *App) ForgotGET(w http.ResponseWriter, r *http.Request) {
+	a.render(w, "forgot.html", nil)
+}
+
+// ForgotPOST — POST /forgot
+// Form fields: email
+// Always answers the same way, so the form can't be used to find out who
+// has an account.
+func (a *App) ForgotPOST(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(r.Form.Get("email"))
+	if email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "forgot.html", map[string]any{"Error": "Enter the email you signed up with."})
+		return
+	}
+	if err := a.sendPasswordReset(email, time.Now()); err != nil {
+		log.Printf("password reset for %s: %v", email, err)
+	}
+	a.render(w, "forgot.html", map[string]any{"Sent": true, "Email": email})
+}
+
+// sendPasswordReset queues a reset link for the account with this email, if
+// there is one and it hasn't been sent one in the last resetResendGap.
+func (a *App) sendPasswordReset(email string, now time.Time) error {
+	var userID int64
+	var username, addr string
+	err := a.db.QueryRow(`SELECT id, username, email FROM users WHERE email = ?`, email).Scan(&userID, &username, &addr)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var recent int
+	if err := a.db.QueryRow(`SELECT COUNT(*) FROM password_resets WHERE user_id = ? AND created_at > ?`,
+		userID, now.Add(-resetResendGap).Unix()).Scan(&recent); err != nil || recent > 0 {
+		return err
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// only the newest link works
+	if _, err := tx.Exec(`UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL`, now.Unix(), userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO password_resets (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)`,
+		userID, hash, now.Add(resetTokenTTL).Unix(), now.Unix()); err != nil {
+		return err
+	}
+	if err := a.queueMail(tx, addr, "password_reset", map[string]any{
+		"Username": username,
+		"Link":     a.siteURL + "/reset?token=" + token,
+		"Expires":  "1 hour",
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResetGET — GET /reset?token=...
+func (a *App) ResetGET(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if _, err := resetTokenUser(a.db, token, time.Now()); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "reset.html", map[string]any{"Invalid": true})
+		return
+	}
+	a.render(w, "reset.html", map[string]any{"Token": token})
+}
+
+// ResetPOST — POST /reset
+// Form fields: token, password, confirm
+// Sets the new password, burns the token and ends every session the member
+// has, then sends them to log in.
+func (a *App) ResetPOST(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	token := r.Form.Get("token")
+	pw := strings.TrimSpace(r.Form.Get("password"))
+	now := time.Now()
+	if msg := validNewPassword(pw, strings.TrimSpace(r.Form.Get("confirm"))); msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "reset.html", map[string]any{"Token": token, "Error": msg})
+		return
+	}
+	hash, err := hashPassword(pw)
+	if err != nil {
+		http.Error(w, "hash error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	userID, err := resetTokenUser(tx, token, now)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "reset.html", map[string]any{"Invalid": true})
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	// the used_at check makes a double submit lose the race cleanly
+	res, err := tx.Exec(`UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL`, now.Unix(), hashToken(token))
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "reset.html", map[string]any{"Invalid": true})
+		return
+	}
+	// a new password also lifts any login lockout and restarts the failure count
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ?, locked_until = ? WHERE id = ?`, hash, now.Unix(), userID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	// any other link still out there is void now too
+	if _, err := tx.Exec(`UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL`, now.Unix(), userID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	sessions, err := sessionTokens(tx, userID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	for _, s := range sessions {
+		a.dropCSRF(s)
+	}
+	clearSessionCookie(w)
+	http.Redirect(w, r, "/login?reset=1", http.StatusSeeOther)
+}
@@ -0,0 +1,457 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+// QR codes, for the two-factor setup page. This is a small ISO/IEC 18004
+// encoder: byte mode, error correction level M, versions 1 to 10 (up to
+// 213 bytes, plenty for an otpauth:// URI), drawn as inline SVG. Like the
+// Markdown renderer it covers what the site needs and nothing more.
+
+// qrVersion describes one symbol size at level M: each block carries ec
+// error correction codewords, and there are blocks1 blocks of data1 data
+// codewords followed by blocks2 blocks one codeword longer.
+type qrVersion struct {
+	ec, blocks1, data1, blocks2 int
+	align                       []int // alignment pattern centres
+}
+
+var qrVersions = []qrVersion{
+	1:  {10, 1, 16, 0, nil},
+	2:  {16, 1, 28, 0, []int{6, 18}},
+	3:  {26, 1, 44, 0, []int{6, 22}},
+	4:  {18, 2, 32, 0, []int{6, 26}},
+	5:  {24, 2, 43, 0, []int{6, 30}},
+	6:  {16, 4, 27, 0, []int{6, 34}},
+	7:  {18, 4, 31, 0, []int{6, 22, 38}},
+	8:  {22, 2, 38, 2, []int{6, 24, 42}},
+	9:  {22, 3, 36, 2, []int{6, 26, 46}},
+	10: {26, 4, 43, 1, []int{6, 28, 50}},
+}
+
+func (q qrVersion) dataCodewords() int {
+	return q.blocks1*q.data1 + q.blocks2*(q.data1+1)
+}
+
+var errQRTooLong = errors.New("qr: text too long")
+
+// qrCode is a finished symbol; modules[y][x] is true for dark.
+type qrCode struct {
+	size    int
+	modules [][]bool
+}
+
+// encodeQR picks the smallest version that fits text and the mask with the
+// lowest penalty score.
+func encodeQR(text string) (*qrCode, error) {
+	v := 1
+	for ; v < len(qrVersions); v++ {
+		if qrDataBits(v, len(text)) <= qrVersions[v].dataCodewords()*8 {
+			break
+		}
+	}
+	if v == len(qrVersions) {
+		return nil, errQRTooLong
+	}
+	codewords := qrCodewords(v, qrData(v, text))
+
+	var best *qrCode
+	bestScore := -1
+	for mask := 0; mask < 8; mask++ {
+		m := newQRMatrix(v)
+		m.drawFunctionPatterns()
+		m.drawCodewords(codewords)
+		m.applyMask(mask)
+		m.drawFormatBits(mask)
+		if s := m.penalty(); bestScore < 0 || s < bestScore {
+			best, bestScore = &qrCode{size: m.size, modules: m.modules}, s
+		}
+	}
+	return best, nil
+}
+
+// qrDataBits is the length of the encoded data before padding: mode,
+// character count and the bytes themselves.
+func qrDataBits(v, n int) int {
+	count := 8
+	if v >= 10 {
+		count = 16
+	}
+	return 4 + count + 8*n
+}
+
+// qrData encodes text in byte mode and pads it to the version's data
+// capacity.
+func qrData(v int, text string) []byte {
+	var bits qrBits
+	bits.append(0x4, 4)
+	if v >= 10 {
+		bits.append(len(text), 16)
+	} else {
+		bits.append(len(text), 8)
+	}
+	for i := 0; i < len(text); i++ {
+		bits.append(int(text[i]), 8)
+	}
+	capacity := qrVersions[v].dataCodewords() * 8
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	data := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			data[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return data
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, v>>i&1 == 1)
+	}
+}
+
+// qrCodewords splits data into blocks, adds each block's Reed-Solomon
+// codewords and interleaves the lot.
+func qrCodewords(v int, data []byte) []byte {
+	q := qrVersions[v]
+	divisor := rsDivisor(q.ec)
+	var blocks, ecs [][]byte
+	for i := 0; i < q.blocks1+q.blocks2; i++ {
+		n := q.data1
+		if i >= q.blocks1 {
+			n++
+		}
+		blocks = append(blocks, data[:n])
+		ecs = append(ecs, rsRemainder(data[:n], divisor))
+		data = data[n:]
+	}
+	var out []byte
+	for i := 0; i <= q.data1; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < q.ec; i++ {
+		for _, e := range ecs {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) with the QR polynomial x^8+x^4+x^3+x^2+1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor is the generator polynomial of the given degree, without its
+// leading 1.
+func rsDivisor(degree int) []byte {
+	d := make([]byte, degree)
+	d[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range d {
+			d[j] = gfMul(d[j], root)
+			if j+1 < len(d) {
+				d[j] ^= d[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return d
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	r := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ r[0]
+		copy(r, r[1:])
+		r[len(r)-1] = 0
+		for i, d := range divisor {
+			r[i] ^= gfMul(d, factor)
+		}
+	}
+	return r
+}
+
+// qrMatrix is a symbol being drawn. fixed marks the function pattern
+// modules that data and masks leave alone.
+type qrMatrix struct {
+	version int
+	size    int
+	modules [][]bool
+	fixed   [][]bool
+}
+
+func newQRMatrix(v int) *qrMatrix {
+	m := &qrMatrix{version: v, size: 17 + 4*v}
+	m.modules = make([][]bool, m.size)
+	m.fixed = make([][]bool, m.size)
+	for i := range m.modules {
+		m.modules[i] = make([]bool, m.size)
+		m.fixed[i] = make([]bool, m.size)
+	}
+	return m
+}
+
+func (m *qrMatrix) set(x, y int, dark bool) {
+	m.modules[y][x] = dark
+	m.fixed[y][x] = true
+}
+
+func (m *qrMatrix) drawFunctionPatterns() {
+	for i := 0; i < m.size; i++ {
+		m.set(6, i, i%2 == 0)
+		m.set(i, 6, i%2 == 0)
+	}
+	m.drawFinder(3, 3)
+	m.drawFinder(m.size-4, 3)
+	m.drawFinder(3, m.size-4)
+	align := qrVersions[m.version].align
+	last := len(align) - 1
+	for i, x := range align {
+		for j, y := range align {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue // these would sit on a finder
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					m.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	m.drawFormatBits(0) // reserves the area; redrawn once the mask is known
+	if m.version >= 7 {
+		rem := m.version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := m.version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := m.size-11+i%3, i/3
+			m.set(a, b, dark)
+			m.set(b, a, dark)
+		}
+	}
+}
+
+// drawFinder draws a finder pattern and its light separator around (cx, cy).
+func (m *qrMatrix) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= m.size || y < 0 || y >= m.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			m.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawFormatBits writes the level M and mask bits, twice, plus the dark
+// module next to them.
+func (m *qrMatrix) drawFormatBits(mask int) {
+	data := mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		m.set(8, i, bit(i))
+	}
+	m.set(8, 7, bit(6))
+	m.set(8, 8, bit(7))
+	m.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		m.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		m.set(m.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.set(8, m.size-15+i, bit(i))
+	}
+	m.set(8, m.size-8, true)
+}
+
+// drawCodewords lays the bits out in the zigzag two-column pattern, from the
+// bottom right corner. Modules left over (the remainder bits of versions 2
+// to 6) stay light.
+func (m *qrMatrix) drawCodewords(data []byte) {
+	i := 0
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < m.size; vert++ {
+			y := vert
+			if upward {
+				y = m.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if m.fixed[y][x] || i >= len(data)*8 {
+					continue
+				}
+				m.modules[y][x] = data[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func (m *qrMatrix) applyMask(mask int) {
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if m.fixed[y][x] {
+				continue
+			}
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip {
+				m.modules[y][x] = !m.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores a masked symbol by the standard's four rules: long runs,
+// 2x2 blocks, finder-like sequences and an unbalanced dark ratio.
+func (m *qrMatrix) penalty() int {
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return m.modules[x][y]
+		}
+		return m.modules[y][x]
+	}
+	score := 0
+	for _, t := range []bool{false, true} {
+		for y := 0; y < m.size; y++ {
+			run := 1
+			for x := 1; x <= m.size; x++ {
+				if x < m.size && at(x, y, t) == at(x-1, y, t) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+			for x := 0; x+11 <= m.size; x++ {
+				if qrFinderLike(func(i int) bool { return at(x+i, y, t) }) {
+					score += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if m.modules[y][x] {
+				dark++
+			}
+			if x+1 < m.size && y+1 < m.size {
+				c := m.modules[y][x]
+				if m.modules[y][x+1] == c && m.modules[y+1][x] == c && m.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	percent := dark * 100 / (m.size * m.size)
+	return score + abs(percent-50)/5*10
+}
+
+// qrFinderLike reports whether 11 modules read dark-light-dark x3-light-dark
+// with four light modules on one side.
+func qrFinderLike(at func(int) bool) bool {
+	core := [7]bool{true, false, true, true, true, false, true}
+	match := func(off int) bool {
+		for i, c := range core {
+			if at(off+i) != c {
+				return false
+			}
+		}
+		return true
+	}
+	light := func(from int) bool {
+		for i := from; i < from+4; i++ {
+			if at(i) {
+				return false
+			}
+		}
+		return true
+	}
+	return match(0) && light(7) || light(0) && match(4)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// qrSVG renders text as an inline SVG QR code with the standard four-module
+// quiet zone, or returns an error if the text doesn't fit.
+func qrSVG(text string) (template.HTML, error) {
+	qr, err := encodeQR(text)
+	if err != nil {
+		return "", err
+	}
+	n := qr.size + 8
+	var path strings.Builder
+	for y, row := range qr.modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	return template.HTML(fmt.Sprintf(
+		`<svg class="qr" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges" role="img" aria-label="QR code">`+
+			`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		n, n, n*4, n*4, path.String())), nil
+}
@@ -0,0 +1,316 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The encoder is checked by decoding its output with the small reader below.
+// The reader is written from the standard rather than from the encoder: it
+// has its own block and alignment tables, finds function patterns by region
+// instead of drawing them, and checks the Reed-Solomon codewords by their
+// syndromes instead of recomputing them.
+
+// qrTestBlocks is table 9 of ISO/IEC 18004 for level M: error correction
+// codewords per block, then (count, data codewords) per block group.
+var qrTestBlocks = map[int][]int{
+	1:  {10, 1, 16},
+	2:  {16, 1, 28},
+	3:  {26, 1, 44},
+	4:  {18, 2, 32},
+	5:  {24, 2, 43},
+	6:  {16, 4, 27},
+	7:  {18, 4, 31},
+	8:  {22, 2, 38, 2, 39},
+	9:  {22, 3, 36, 2, 37},
+	10: {26, 4, 43, 1, 44},
+}
+
+// qrTestAlign is annex E: alignment pattern row/column coordinates.
+var qrTestAlign = map[int][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// qrTestCapacity is the number of bytes each version holds at level M.
+var qrTestCapacity = []int{1: 14, 26, 42, 62, 84, 106, 122, 152, 180, 213}
+
+// isFunction reports whether (x, y) belongs to a function pattern, the
+// format or version information, or the dark module.
+func isFunction(v, size, x, y int) bool {
+	switch {
+	case x < 9 && y < 9, x >= size-8 && y < 9, x < 9 && y >= size-8:
+		return true // finders, separators and format information
+	case x == 6 || y == 6:
+		return true // timing
+	case v >= 7 && (x >= size-11 && x < size-8 && y < 6 || y >= size-11 && y < size-8 && x < 6):
+		return true // version information
+	}
+	align := qrTestAlign[v]
+	for i, cx := range align {
+		for j, cy := range align {
+			if (i == 0 && j == 0) || (i == 0 && j == len(align)-1) || (i == len(align)-1 && j == 0) {
+				continue
+			}
+			if abs(x-cx) <= 2 && abs(y-cy) <= 2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gfTables returns exp and log tables for GF(256) over 0x11D.
+func gfTables() (exp [512]byte, log [256]int) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+// decodeQR reads a level M, byte mode symbol back into its text.
+func decodeQR(modules [][]bool) (string, error) {
+	size := len(modules)
+	if size < 21 || (size-17)%4 != 0 {
+		return "", fmt.Errorf("bad size %d", size)
+	}
+	v := (size - 17) / 4
+	at := func(x, y int) bool { return modules[y][x] }
+
+	// format information, both copies, most significant bit first
+	var f1, f2 int
+	for _, p := range [][2]int{{0, 8}, {1, 8}, {2, 8}, {3, 8}, {4, 8}, {5, 8}, {7, 8}, {8, 8}, {8, 7}, {8, 5}, {8, 4}, {8, 3}, {8, 2}, {8, 1}, {8, 0}} {
+		f1 <<= 1
+		if at(p[0], p[1]) {
+			f1 |= 1
+		}
+	}
+	for i := 0; i < 7; i++ {
+		f2 <<= 1
+		if at(8, size-1-i) {
+			f2 |= 1
+		}
+	}
+	for i := 0; i < 8; i++ {
+		f2 <<= 1
+		if at(size-8+i, 8) {
+			f2 |= 1
+		}
+	}
+	if f1 != f2 {
+		return "", fmt.Errorf("format copies differ: %015b %015b", f1, f2)
+	}
+	format := f1 ^ 0x5412
+	poly := format
+	for i := 14; i >= 10; i-- {
+		if poly>>i&1 == 1 {
+			poly ^= 0x537 << (i - 10)
+		}
+	}
+	if poly != 0 {
+		return "", fmt.Errorf("format information %015b fails its BCH check", f1)
+	}
+	if level := format >> 13; level != 0 {
+		return "", fmt.Errorf("error correction level %02b, want M", level)
+	}
+	mask := format >> 10 & 7
+	if !at(8, size-8) {
+		return "", errors.New("dark module is light")
+	}
+
+	// data modules, in reading order, unmasked
+	var bits []bool
+	upward := true
+	for right := size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for k := 0; k < size; k++ {
+			y := k
+			if upward {
+				y = size - 1 - k
+			}
+			for _, x := range []int{right, right - 1} {
+				if isFunction(v, size, x, y) {
+					continue
+				}
+				i, j := y, x // the standard's row and column
+				var flip bool
+				switch mask {
+				case 0:
+					flip = (i+j)%2 == 0
+				case 1:
+					flip = i%2 == 0
+				case 2:
+					flip = j%3 == 0
+				case 3:
+					flip = (i+j)%3 == 0
+				case 4:
+					flip = (i/2+j/3)%2 == 0
+				case 5:
+					flip = (i*j)%2+(i*j)%3 == 0
+				case 6:
+					flip = ((i*j)%2+(i*j)%3)%2 == 0
+				case 7:
+					flip = ((i+j)%2+(i*j)%3)%2 == 0
+				}
+				bits = append(bits, at(x, y) != flip)
+			}
+		}
+		upward = !upward
+	}
+
+	// de-interleave into blocks
+	table := qrTestBlocks[v]
+	ec := table[0]
+	var sizes []int
+	for g := 1; g < len(table); g += 2 {
+		for n := 0; n < table[g]; n++ {
+			sizes = append(sizes, table[g+1])
+		}
+	}
+	total := 0
+	for _, n := range sizes {
+		total += n + ec
+	}
+	if len(bits) < total*8 {
+		return "", fmt.Errorf("only %d data modules", len(bits))
+	}
+	codewords := make([]byte, total)
+	for i := range codewords {
+		for k := 0; k < 8; k++ {
+			if bits[i*8+k] {
+				codewords[i] |= 0x80 >> k
+			}
+		}
+	}
+	blocks := make([][]byte, len(sizes))
+	pos := 0
+	for i := 0; i < sizes[len(sizes)-1]; i++ {
+		for b, n := range sizes {
+			if i < n {
+				blocks[b] = append(blocks[b], codewords[pos])
+				pos++
+			}
+		}
+	}
+	for i := 0; i < ec; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[pos])
+			pos++
+		}
+	}
+
+	// every block must evaluate to zero at α^0 … α^(ec-1)
+	exp, log := gfTables()
+	var data []byte
+	for b, block := range blocks {
+		for r := 0; r < ec; r++ {
+			var s byte
+			for _, c := range block {
+				if s != 0 {
+					s = exp[log[s]+r]
+				}
+				s ^= c
+			}
+			if s != 0 {
+				return "", fmt.Errorf("block %d: syndrome %d is %d", b, r, s)
+			}
+		}
+		data = append(data, block[:sizes[b]]...)
+	}
+
+	// byte mode segment
+	read := func(bitPos, n int) int {
+		x := 0
+		for k := bitPos; k < bitPos+n; k++ {
+			x <<= 1
+			if data[k/8]>>(7-k%8)&1 == 1 {
+				x |= 1
+			}
+		}
+		return x
+	}
+	if m := read(0, 4); m != 0x4 {
+		return "", fmt.Errorf("mode %04b, want byte mode", m)
+	}
+	countBits := 8
+	if v >= 10 {
+		countBits = 16
+	}
+	n := read(4, countBits)
+	start := 4 + countBits
+	if start+8*n > len(data)*8 {
+		return "", fmt.Errorf("count %d overruns the data", n)
+	}
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(read(start+8*i, 8))
+	}
+	return string(out), nil
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	texts := []string{
+		"",
+		"A",
+		"otpauth://totp/Literary%20Lions:ann?secret=JBSWY3DPEHPK3PXP&issuer=Literary%20Lions",
+		"héllo, wörld — ünïcode",
+	}
+	for v := 1; v < len(qrTestCapacity); v++ {
+		// both sides of every version boundary
+		for _, n := range []int{qrTestCapacity[v], qrTestCapacity[v] + 1} {
+			if n <= qrTestCapacity[len(qrTestCapacity)-1] {
+				texts = append(texts, strings.Repeat(string(rune('a'+v)), n))
+			}
+		}
+	}
+	for _, text := range texts {
+		qr, err := encodeQR(text)
+		if err != nil {
+			t.Errorf("encodeQR(%d bytes): %v", len(text), err)
+			continue
+		}
+		wantVersion := 1
+		for qrTestCapacity[wantVersion] < len(text) {
+			wantVersion++
+		}
+		if v := (qr.size - 17) / 4; v != wantVersion {
+			t.Errorf("encodeQR(%d bytes) used version %d, want %d", len(text), v, wantVersion)
+		}
+		got, err := decodeQR(qr.modules)
+		if err != nil {
+			t.Errorf("decoding %d bytes: %v", len(text), err)
+		} else if got != text {
+			t.Errorf("decoded %q, want %q", got, text)
+		}
+	}
+}
+
+func TestQRTooLong(t *testing.T) {
+	if _, err := encodeQR(strings.Repeat("x", qrTestCapacity[10]+1)); err != errQRTooLong {
+		t.Errorf("encodeQR(%d bytes) error = %v, want errQRTooLong", qrTestCapacity[10]+1, err)
+	}
+}
+
+func TestQRSVG(t *testing.T) {
+	svg, err := qrSVG("otpauth://totp/x?secret=ABC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 27 bytes need version 3: 29 modules, plus a four-module quiet zone each side
+	if !strings.HasPrefix(string(svg), `<svg class="qr" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 37 37"`) {
+		t.Errorf("unexpected svg header: %.100s", svg)
+	}
+}
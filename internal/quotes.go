@@ -0,0 +1,430 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Quote limits, in characters.
+const (
+	maxQuoteText       = 2000
+	maxQuoteLocation   = 40
+	maxQuoteCommentary = 2000
+)
+
+// Quote is a passage a member saved from a book.
+type Quote struct {
+	ID          int64
+	UserID      int64
+	Username    string
+	BookID      int64
+	BookTitle   string
+	BookAuthors string
+	Text        string
+	Location    string // page number or free-form position, "" if not given
+	Commentary  string
+	CreatedAt   string
+	Likes       int
+	Dislikes    int
+	MyReaction  int // the viewer's reaction: 1, -1 or 0
+}
+
+// Where renders the location for attributions: a bare number is a page.
+func (q Quote) Where() string {
+	if _, err := strconv.Atoi(q.Location); err == nil {
+		return "p. " + q.Location
+	}
+	return q.Location
+}
+
+// Shortcode is what members paste into a post to embed the quote.
+func (q Quote) Shortcode() string {
+	return fmt.Sprintf("[quote:%d]", q.ID)
+}
+
+// quoteColumns selects a Quote; the first placeholder is the viewer's id.
+const quoteColumns = `
+	q.id, q.user_id, u.username, b.id, b.title, b.authors, q.text, q.location, q.commentary, q.created_at,
+	(SELECT COUNT(*) FROM quote_reactions r WHERE r.quote_id = q.id AND r.value = 1) AS likes,
+	(SELECT COUNT(*) FROM quote_reactions r WHERE r.quote_id = q.id AND r.value = -1) AS dislikes,
+	COALESCE((SELECT r.value FROM quote_reactions r WHERE r.quote_id = q.id AND r.user_id = ?), 0)
+	FROM quotes q
+	JOIN users u ON u.id = q.user_id
+	JOIN books b ON b.id = q.book_id`
+
+func scanQuote(sc interface{ Scan(...any) error }) (Quote, error) {
+	var q Quote
+	err := sc.Scan(&q.ID, &q.UserID, &q.Username, &q.BookID, &q.BookTitle, &q.BookAuthors,
+		&q.Text, &q.Location, &q.Commentary, &q.CreatedAt, &q.Likes, &q.Dislikes, &q.MyReaction)
+	return q, err
+}
+
+// quoteFilter narrows listQuotes. Zero fields don't filter.
+type quoteFilter struct {
+	BookID   int64
+	Username string
+	Top      bool // most liked first instead of newest first
+	ViewerID int64
+	Limit    int
+}
+
+// listQuotes returns quotes matching f.
+func listQuotes(db *sql.DB, f quoteFilter) ([]Quote, error) {
+	var where []string
+	args := []any{f.ViewerID}
+	if f.BookID > 0 {
+		where = append(where, "q.book_id = ?")
+		args = append(args, f.BookID)
+	}
+	if f.Username != "" {
+		where = append(where, "u.username = ?")
+		args = append(args, f.Username)
+	}
+	query := `SELECT ` + quoteColumns
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	if f.Top {
+		query += ` ORDER BY likes - dislikes DESC, q.created_at DESC, q.id DESC`
+	} else {
+		query += ` ORDER BY q.created_at DESC, q.id DESC`
+	}
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	query += ` LIMIT ?`
+	args = append(args, f.Limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Quote
+	for rows.Next() {
+		q, err := scanQuote(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, q)
+	}
+	return list, rows.Err()
+}
+
+// getQuote loads one quote; viewerID fills MyReaction.
+func getQuote(db dbtx, id, viewerID int64) (*Quote, error) {
+	q, err := scanQuote(db.QueryRow(`SELECT `+quoteColumns+` WHERE q.id = ?`, viewerID, id))
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// Embeds. A line holding only [quote:N] renders as an empty placeholder
+// figure; expandQuotes fills it in at display time, so the cached HTML
+// doesn't go stale when a quote is deleted.
+var (
+	quoteShortcodeRe   = regexp.MustCompile(`^\[quote:(\d+)\]$`)
+	quotePlaceholderRe = regexp.MustCompile(`<figure data-quote="(\d+)"></figure>`)
+)
+
+// quoteEmbedID returns the quote id if the line is a quote shortcode.
+func quoteEmbedID(line string) (int64, bool) {
+	m := quoteShortcodeRe.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(m[1], 10, 64)
+	return id, err == nil && id > 0
+}
+
+var quoteEmbedTpl = template.Must(template.New("quote").Parse(
+	`{{ if . }}<figure class="quote-embed"><blockquote>{{ .Text }}</blockquote>` +
+		`<figcaption>— <a href="/books/{{ .BookID }}">{{ .BookTitle }}</a>{{ with .BookAuthors }}, {{ . }}{{ end }}{{ with .Where }}, {{ . }}{{ end }}` +
+		` · <a href="/quotes/{{ .ID }}">saved by {{ .Username }}</a></figcaption></figure>` +
+		`{{ else }}<figure class="quote-embed missing">This quote is no longer available.</figure>{{ end }}`))
+
+// expandQuotes replaces quote placeholders in rendered post or comment HTML
+// with the quotes themselves.
+func expandQuotes(db dbtx, h template.HTML) template.HTML {
+	expandQuotesIn(db, []*template.HTML{&h})
+	return h
+}
+
+// expandQuotesIn is expandQuotes for several pieces of HTML at once, such as
+// every comment in a thread, loading all the quotes in one query.
+func expandQuotesIn(db dbtx, hs []*template.HTML) {
+	var ids []any
+	seen := map[int64]bool{}
+	for _, h := range hs {
+		if !strings.Contains(string(*h), "<figure data-quote=") {
+			continue
+		}
+		for _, m := range quotePlaceholderRe.FindAllStringSubmatch(string(*h), -1) {
+			id, _ := strconv.ParseInt(m[1], 10, 64)
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	quotes := map[int64]*Quote{}
+	rows, err := db.Query(`SELECT `+quoteColumns+` WHERE q.id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, append([]any{0}, ids...)...)
+	if err == nil {
+		for rows.Next() {
+			q, err := scanQuote(rows)
+			if err != nil {
+				break
+			}
+			quotes[q.ID] = &q
+		}
+		rows.Close()
+	}
+	for _, h := range hs {
+		*h = template.HTML(quotePlaceholderRe.ReplaceAllStringFunc(string(*h), func(ph string) string {
+			id, _ := strconv.ParseInt(quotePlaceholderRe.FindStringSubmatch(ph)[1], 10, 64)
+			var b strings.Builder
+			_ = quoteEmbedTpl.Execute(&b, quotes[id])
+			return b.String()
+		}))
+	}
+}
+
+// quoteInput is a validated quote form.
+type quoteInput struct {
+	BookID                     int64
+	Text, Location, Commentary string
+}
+
+// parseQuoteForm validates the quote form; form keys are Book, Text,
+// Location and Commentary.
+func parseQuoteForm(db *sql.DB, form map[string]string) (quoteInput, error) {
+	in := quoteInput{Text: form["Text"], Location: form["Location"], Commentary: form["Commentary"]}
+	in.BookID, _ = strconv.ParseInt(form["Book"], 10, 64)
+	if in.BookID <= 0 {
+		return in, errors.New("Pick the book the quote is from.")
+	}
+	if _, err := getBook(db, in.BookID); err != nil {
+		return in, errors.New("That book doesn't exist.")
+	}
+	if in.Text == "" {
+		return in, errors.New("The quote itself is required.")
+	}
+	if utf8.RuneCountInString(in.Text) > maxQuoteText {
+		return in, fmt.Errorf("Quotes are limited to %d characters.", maxQuoteText)
+	}
+	if utf8.RuneCountInString(in.Location) > maxQuoteLocation {
+		return in, errors.New("Keep the page or location short, like 42 or loc. 1234.")
+	}
+	if utf8.RuneCountInString(in.Commentary) > maxQuoteCommentary {
+		return in, fmt.Errorf("Commentary is limited to %d characters.", maxQuoteCommentary)
+	}
+	return in, nil
+}
+
+// QuotesRouter handles everything under /quotes:
+//
+//	/quotes              all quotes (?book=, ?u=, ?sort=top)
+//	/quotes/new          save a quote
+//	/quotes/{id}         one quote and its shortcode
+//	/quotes/delete       POST
+func (a *App) QuotesRouter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/quotes"), "/")
+	post := r.Method == http.MethodPost
+	switch {
+	case rest == "" && !post:
+		a.QuoteListGET(w, r)
+	case rest == "new" && post:
+		a.QuoteNewPOST(w, r)
+	case rest == "new":
+		a.QuoteNewGET(w, r)
+	case rest == "delete" && post:
+		a.QuoteDeletePOST(w, r)
+	case post:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			a.renderError(w, http.StatusNotFound, "Quote not found.")
+			return
+		}
+		a.QuoteViewGET(w, r, id)
+	}
+}
+
+// QuoteListGET — GET /quotes?book=&u=&sort=top
+func (a *App) QuoteListGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+	var viewerID int64
+	if u != nil {
+		viewerID = u.ID
+	}
+	qs := r.URL.Query()
+	f := quoteFilter{Username: qs.Get("u"), Top: qs.Get("sort") == "top", ViewerID: viewerID}
+	var book *Book
+	if id, _ := strconv.ParseInt(qs.Get("book"), 10, 64); id > 0 {
+		var err error
+		if book, err = getBook(a.db, id); err != nil {
+			a.renderError(w, http.StatusNotFound, "Book not found.")
+			return
+		}
+		f.BookID = id
+	}
+	quotes, err := listQuotes(a.db, f)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	data := map[string]any{
+		"Title":     "Quotes",
+		"User":      u,
+		"Quotes":    quotes,
+		"Book":      book,
+		"Member":    f.Username,
+		"Top":       f.Top,
+		"CanCreate": u.Can(PermCreatePost),
+		"CSRFToken": a.generateCSRF(r),
+	}
+	a.render(w, "quotes.html", data)
+}
+
+// QuoteViewGET — GET /quotes/{id}
+func (a *App) QuoteViewGET(w http.ResponseWriter, r *http.Request, id int64) {
+	u, _ := a.currentUser(r)
+	var viewerID int64
+	if u != nil {
+		viewerID = u.ID
+	}
+	q, err := getQuote(a.db, id, viewerID)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Quote not found.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	data := map[string]any{
+		"Title":     "Quote from " + q.BookTitle,
+		"User":      u,
+		"Quote":     q,
+		"CanDelete": u != nil && (u.ID == q.UserID && u.Can(PermDeleteOwn) || u.Can(PermModerate)),
+		"CSRFToken": a.generateCSRF(r),
+	}
+	a.render(w, "quote.html", data)
+}
+
+// QuoteNewGET — GET /quotes/new?book=ID
+func (a *App) QuoteNewGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
+		return
+	}
+	a.render(w, "quote_new.html", a.quoteFormData(r, u, map[string]string{"Book": r.URL.Query().Get("book")}))
+}
+
+func (a *App) quoteFormData(r *http.Request, u *User, form map[string]string) map[string]any {
+	books, _ := listBooks(a.db, "")
+	return map[string]any{
+		"Title":     "Save a quote",
+		"User":      u,
+		"Books":     books,
+		"Form":      form,
+		"CSRFToken": a.generateCSRF(r),
+	}
+}
+
+// QuoteNewPOST — POST /quotes/new
+// Form fields: book, text, location, commentary
+func (a *App) QuoteNewPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	form := map[string]string{
+		"Book":       r.Form.Get("book"),
+		"Text":       strings.TrimSpace(r.Form.Get("text")),
+		"Location":   strings.TrimSpace(r.Form.Get("location")),
+		"Commentary": strings.TrimSpace(r.Form.Get("commentary")),
+	}
+	in, err := parseQuoteForm(a.db, form)
+	if err != nil {
+		data := a.quoteFormData(r, u, form)
+		data["Error"] = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "quote_new.html", data)
+		return
+	}
+	res, err := a.db.Exec(`INSERT INTO quotes (user_id, book_id, text, location, commentary) VALUES (?, ?, ?, ?, ?)`,
+		u.ID, in.BookID, in.Text, in.Location, in.Commentary)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	http.Redirect(w, r, fmt.Sprintf("/quotes/%d", id), http.StatusSeeOther)
+}
+
+// QuoteDeletePOST — POST /quotes/delete
+// Form fields: id
+// Authors can delete their own quotes, moderators any quote; posts that
+// embed it show a placeholder instead.
+func (a *App) QuoteDeletePOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermDeleteOwn)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	id, _ := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	q, err := getQuote(a.db, id, 0)
+	if err == sql.ErrNoRows {
+		http.Error(w, "quote not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if u.ID != q.UserID && !u.Can(PermModerate) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM quotes WHERE id = ?`, id); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if u.ID != q.UserID {
+		t := &reportTarget{Kind: "quote", ID: id, AuthorID: q.UserID, Author: q.Username}
+		if err := logModeration(tx, u.ID, ModDelete, t, 0, ""); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/quotes?book=%d", q.BookID), http.StatusSeeOther)
+}
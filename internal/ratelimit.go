@@ -0,0 +1,136 @@
+package app
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limiting. A RateLimiter answers "may this key act now?"; the keys
+// are things like "ip:203.0.113.7" or "user:42", so one limiter type covers
+// logins, signups and posting. TokenBucket keeps its state in memory, which
+// is enough for a single forumd; running several instances would want a
+// shared backend behind the same interface.
+
+// RateLimiter decides whether key may act at now. When it may not,
+// retryAfter says how long until it can.
+type RateLimiter interface {
+	Allow(key string, now time.Time) (ok bool, retryAfter time.Duration)
+	Reset(key string)
+}
+
+// TokenBucket is an in-memory RateLimiter. Each key starts with burst
+// tokens, spends one per action and gets one back every interval.
+type TokenBucket struct {
+	mu       sync.Mutex
+	burst    float64
+	interval time.Duration
+	buckets  map[string]*bucket
+	swept    time.Time
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// NewTokenBucket returns a limiter allowing burst actions at once and one
+// more per interval after that.
+func NewTokenBucket(burst int, interval time.Duration) *TokenBucket {
+	return &TokenBucket{burst: float64(burst), interval: interval, buckets: map[string]*bucket{}}
+}
+
+// Allow implements RateLimiter.
+func (tb *TokenBucket) Allow(key string, now time.Time) (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.sweep(now)
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &bucket{tokens: tb.burst, at: now}
+		tb.buckets[key] = b
+	}
+	b.tokens = tb.refilled(b, now)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) * float64(tb.interval))
+	return false, wait.Round(time.Second) + time.Second
+}
+
+// Reset implements RateLimiter.
+func (tb *TokenBucket) Reset(key string) {
+	tb.mu.Lock()
+	delete(tb.buckets, key)
+	tb.mu.Unlock()
+}
+
+func (tb *TokenBucket) refilled(b *bucket, now time.Time) float64 {
+	return math.Min(tb.burst, b.tokens+float64(now.Sub(b.at))/float64(tb.interval))
+}
+
+// sweep drops buckets that have filled up again (they behave exactly like
+// new ones), at most every few minutes, so memory tracks recent activity.
+func (tb *TokenBucket) sweep(now time.Time) {
+	if now.Sub(tb.swept) < 5*time.Minute {
+		return
+	}
+	tb.swept = now
+	for k, b := range tb.buckets {
+		if tb.refilled(b, now) >= tb.burst {
+			delete(tb.buckets, k)
+		}
+	}
+}
+
+// rateLimits are the limiters the handlers share.
+type rateLimits struct {
+	loginIP      RateLimiter // password attempts per client IP
+	loginAccount RateLimiter // password attempts per email address
+	register     RateLimiter // signups per client IP
+	post         RateLimiter // posts per member
+	comment      RateLimiter // comments per member
+}
+
+func defaultRateLimits() rateLimits {
+	return rateLimits{
+		loginIP:      NewTokenBucket(20, 30*time.Second),
+		loginAccount: NewTokenBucket(10, time.Minute),
+		register:     NewTokenBucket(5, 10*time.Minute),
+		post:         NewTokenBucket(10, 30*time.Second),
+		comment:      NewTokenBucket(20, 15*time.Second),
+	}
+}
+
+// waitText formats a retry delay for people: "40 seconds", "3 minutes".
+func waitText(d time.Duration) string {
+	if d < time.Minute {
+		s := int(math.Ceil(d.Seconds()))
+		if s == 1 {
+			return "1 second"
+		}
+		return strconv.Itoa(s) + " seconds"
+	}
+	m := int(math.Ceil(d.Minutes()))
+	if m == 1 {
+		return "1 minute"
+	}
+	return strconv.Itoa(m) + " minutes"
+}
+
+// limited checks key against l and, when it's over, answers 429 with a
+// Retry-After header and returns false. It spends a token, so handlers call
+// it once the request has passed validation; a rejected form doesn't count.
+func limited(w http.ResponseWriter, l RateLimiter, key string, what string) bool {
+	ok, wait := l.Allow(key, time.Now())
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "You're "+what+" too quickly. Try again in "+waitText(wait)+".", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	tb := NewTokenBucket(2, time.Minute)
+	t0 := time.Unix(1700000000, 0)
+	steps := []struct {
+		at   time.Duration
+		ok   bool
+		wait time.Duration // when refused
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 61 * time.Second},
+		{30 * time.Second, false, 31 * time.Second}, // half a token back
+		{60 * time.Second, true, 0},
+		{60 * time.Second, false, 61 * time.Second},
+		{10 * time.Minute, true, 0}, // refills to burst, not beyond
+		{10 * time.Minute, true, 0},
+		{10 * time.Minute, false, 61 * time.Second},
+	}
+	for i, s := range steps {
+		ok, wait := tb.Allow("user:1", t0.Add(s.at))
+		if ok != s.ok || wait != s.wait {
+			t.Errorf("step %d at +%s: Allow = %v, %s; want %v, %s", i, s.at, ok, wait, s.ok, s.wait)
+		}
+	}
+}
+
+func TestTokenBucketKeysAndReset(t *testing.T) {
+	tb := NewTokenBucket(1, time.Hour)
+	now := time.Unix(1700000000, 0)
+	if ok, _ := tb.Allow("ip:a", now); !ok {
+		t.Fatal("first action refused")
+	}
+	if ok, _ := tb.Allow("ip:a", now); ok {
+		t.Fatal("second action allowed")
+	}
+	if ok, _ := tb.Allow("ip:b", now); !ok {
+		t.Error("other key shares the bucket")
+	}
+	tb.Reset("ip:a")
+	if ok, _ := tb.Allow("ip:a", now); !ok {
+		t.Error("Reset didn't refill the bucket")
+	}
+}
@@ -0,0 +1,305 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Roles a user account can have. Stored in users.role.
+const (
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permission names one thing a user may do.
+type Permission string
+
+const (
+	PermCreatePost  Permission = "post.create"
+	PermComment     Permission = "comment.create"
+	PermReact       Permission = "react"
+	PermReport      Permission = "report"
+	PermDeleteOwn   Permission = "content.delete_own"
+	PermEditProfile Permission = "profile.edit"
+	PermModerate    Permission = "content.moderate" // forum-wide; see canModeratePost for per-category
+	PermManageUsers Permission = "users.manage"
+	PermAdminArea   Permission = "admin.view"
+)
+
+// rolePermissions maps each role to what it grants. Higher roles repeat the
+// lower ones so the table reads on its own.
+var rolePermissions = map[string][]Permission{
+	RoleMember:    {PermCreatePost, PermComment, PermReact, PermReport, PermDeleteOwn, PermEditProfile},
+	RoleModerator: {PermCreatePost, PermComment, PermReact, PermReport, PermDeleteOwn, PermEditProfile, PermModerate},
+	RoleAdmin:     {PermCreatePost, PermComment, PermReact, PermReport, PermDeleteOwn, PermEditProfile, PermModerate, PermManageUsers, PermAdminArea},
+}
+
+// suspendedPerms are the permissions a suspended account loses until the
+// suspension runs out.
+var suspendedPerms = map[Permission]bool{
+	PermCreatePost: true,
+	PermComment:    true,
+	PermReact:      true,
+	PermReport:     true,
+}
+
+// validRole reports whether role is one of the known roles.
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// IsSuspended reports whether a moderator has suspended the account.
+func (u *User) IsSuspended() bool {
+	return u != nil && u.SuspendedUntil > time.Now().Unix()
+}
+
+// SuspendedUntilText formats the suspension end for templates.
+func (u *User) SuspendedUntilText() string {
+	return time.Unix(u.SuspendedUntil, 0).UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// Can reports whether the user's role grants p. A nil user can do nothing,
+// a suspended user can't do anything in suspendedPerms, and one who hasn't
+// confirmed their email can't do anything in unverifiedPerms.
+func (u *User) Can(p Permission) bool {
+	if u == nil {
+		return false
+	}
+	if suspendedPerms[p] && u.IsSuspended() {
+		return false
+	}
+	if unverifiedPerms[p] && u.Unverified {
+		return false
+	}
+	for _, have := range rolePermissions[u.Role] {
+		if have == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff is true for moderators and admins; templates use it to show
+// moderation controls.
+func (u *User) IsStaff() bool {
+	return u.Can(PermModerate)
+}
+
+// authorize is the one gate every handler goes through. Anonymous visitors
+// are sent to /login (GET) or get a 401; logged-in users without p get a
+// 403 page. On success it returns the current user.
+func (a *App) authorize(w http.ResponseWriter, r *http.Request, p Permission) (*User, bool) {
+	u, _ := a.currentUser(r)
+	if u == nil {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		} else {
+			http.Error(w, "login required", http.StatusUnauthorized)
+		}
+		return nil, false
+	}
+	if !u.Can(p) {
+		msg := "You don't have permission to do that."
+		if suspendedPerms[p] && u.IsSuspended() {
+			msg = "Your account is suspended until " + u.SuspendedUntilText() + "."
+		} else if unverifiedPerms[p] && u.Unverified {
+			msg = "Confirm your email address first: open the link we sent to " + u.Email + ", or send a new one from Settings."
+		}
+		a.renderError(w, http.StatusForbidden, msg)
+		return nil, false
+	}
+	return u, true
+}
+
+// requirePerm wraps a handler so it only runs for users holding p.
+func (a *App) requirePerm(p Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := a.authorize(w, r, p); !ok {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// canModeratePost is true for forum-wide moderators and for category
+// moderators of any category the post is tagged with.
+func (a *App) canModeratePost(u *User, postID int64) bool {
+	if u == nil {
+		return false
+	}
+	if u.Can(PermModerate) {
+		return true
+	}
+	var n int
+	_ = a.db.QueryRow(`
+		SELECT COUNT(*) FROM category_moderators cm
+		JOIN post_categories pc ON pc.category_id = cm.category_id
+		WHERE cm.user_id = ? AND pc.post_id = ?`, u.ID, postID).Scan(&n)
+	return n > 0
+}
+
+// isCategoryModerator is true if the user moderates at least one category.
+func (a *App) isCategoryModerator(u *User) bool {
+	if u == nil {
+		return false
+	}
+	var n int
+	_ = a.db.QueryRow(`SELECT COUNT(*) FROM category_moderators WHERE user_id = ?`, u.ID).Scan(&n)
+	return n > 0
+}
+
+// SetUserRole changes a user's role, refusing to demote the last admin.
+func SetUserRole(db *sql.DB, userID int64, role string) error {
+	if !validRole(role) {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if role != RoleAdmin {
+		var current string
+		if err := tx.QueryRow(`SELECT role FROM users WHERE id = ?`, userID).Scan(&current); err != nil {
+			return err
+		}
+		var admins int
+		_ = tx.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ?`, RoleAdmin).Scan(&admins)
+		if current == RoleAdmin && admins <= 1 {
+			return errors.New("cannot demote the last admin")
+		}
+	}
+	if _, err := tx.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetRole implements `forumd role <username> <member|moderator|admin>`,
+// which is how the first admin gets created.
+func SetRole(args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: forumd role <username> member|moderator|admin")
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	u, err := GetUserByUsername(db, args[0])
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	if err := SetUserRole(db, u.ID, args[1]); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s is now %s\n", u.Username, args[1])
+	return nil
+}
+
+// AdminGET — GET /admin (mounted behind requirePerm(PermAdminArea))
+// Lists users with their roles and category moderator assignments.
+func (a *App) AdminGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+
+	type userRow struct {
+		ID         int64
+		Username   string
+		Email      string
+		Role       string
+		CreatedAt  string
+		Categories string // categories this user moderates
+	}
+	rows, err := a.db.Query(`
+		SELECT u.id, u.username, u.email, u.role, u.created_at,
+		       COALESCE((SELECT GROUP_CONCAT(c.name, ', ') FROM category_moderators cm
+		                 JOIN categories c ON c.id = cm.category_id WHERE cm.user_id = u.id), '')
+		FROM users u
+		ORDER BY CASE u.role WHEN 'admin' THEN 0 WHEN 'moderator' THEN 1 ELSE 2 END, u.username`)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	defer rows.Close()
+	var users []userRow
+	for rows.Next() {
+		var it userRow
+		if err := rows.Scan(&it.ID, &it.Username, &it.Email, &it.Role, &it.CreatedAt, &it.Categories); err == nil {
+			users = append(users, it)
+		}
+	}
+
+	data := map[string]any{
+		"Title":     "Admin",
+		"User":      u,
+		"Users":     users,
+		"Roles":     []string{RoleMember, RoleModerator, RoleAdmin},
+		"CSRFToken": a.generateCSRF(r),
+		"Error":     r.URL.Query().Get("err"),
+	}
+	a.render(w, "admin.html", data)
+}
+
+// AdminRolePOST — POST /admin/role
+// Form fields: user_id, role
+func (a *App) AdminRolePOST(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.authorize(w, r, PermManageUsers); !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	userID, _ := strconv.ParseInt(r.Form.Get("user_id"), 10, 64)
+	if err := SetUserRole(a.db, userID, r.Form.Get("role")); err != nil {
+		http.Redirect(w, r, "/admin?err="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// AdminCategoryModPOST — POST /admin/catmod
+// Form fields: user_id, category (name), action=add|remove
+func (a *App) AdminCategoryModPOST(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.authorize(w, r, PermManageUsers); !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	userID, _ := strconv.ParseInt(r.Form.Get("user_id"), 10, 64)
+	name := strings.TrimSpace(r.Form.Get("category"))
+	var catID int64
+	err := a.db.QueryRow(`SELECT id FROM categories WHERE name = ?`, name).Scan(&catID)
+	if err == sql.ErrNoRows {
+		http.Redirect(w, r, "/admin?err="+url.QueryEscape("no category named "+name), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if r.Form.Get("action") == "remove" {
+		_, err = a.db.Exec(`DELETE FROM category_moderators WHERE user_id = ? AND category_id = ?`, userID, catID)
+	} else {
+		_, err = a.db.Exec(`INSERT OR IGNORE INTO category_moderators (user_id, category_id) VALUES (?, ?)`, userID, catID)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,215 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// PostKindReview marks a new post as a review in the kind form field;
+// anything else is an ordinary discussion.
+const PostKindReview = "review"
+
+// reviewAspects are the optional per-aspect scores, in display order.
+var reviewAspects = []struct{ Key, Label string }{
+	{"prose", "Prose"},
+	{"plot", "Plot"},
+	{"characters", "Characters"},
+}
+
+// Review is the scored part of a review post. Scores are in half-stars like
+// shelf ratings; aspects are 0 when the reviewer skipped them.
+type Review struct {
+	Rating     Rating
+	Prose      Rating
+	Plot       Rating
+	Characters Rating
+}
+
+// Aspects pairs each aspect label with its score, for templates.
+func (rv Review) Aspects() []AspectScore {
+	return []AspectScore{
+		{reviewAspects[0].Key, reviewAspects[0].Label, rv.Prose},
+		{reviewAspects[1].Key, reviewAspects[1].Label, rv.Plot},
+		{reviewAspects[2].Key, reviewAspects[2].Label, rv.Characters},
+	}
+}
+
+// AspectScore is one labelled aspect score.
+type AspectScore struct {
+	Key   string
+	Label string
+	Score Rating
+}
+
+// parseReviewForm reads the rating fields of the post forms. The overall
+// rating is required; aspects are optional.
+func parseReviewForm(r *http.Request) (Review, error) {
+	var rv Review
+	var err error
+	if rv.Rating, err = parseRating(r.Form.Get("rating")); err != nil {
+		return rv, err
+	}
+	if rv.Rating == 0 {
+		return rv, errors.New("a review needs a rating")
+	}
+	dst := []*Rating{&rv.Prose, &rv.Plot, &rv.Characters}
+	for i, asp := range reviewAspects {
+		if *dst[i], err = parseRating(r.Form.Get(asp.Key)); err != nil {
+			return rv, err
+		}
+	}
+	return rv, nil
+}
+
+// nullRating stores an unset aspect as NULL so averages skip it.
+func nullRating(r Rating) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(r), Valid: r > 0}
+}
+
+// saveReview creates or replaces the scores of a review post.
+func saveReview(db dbtx, postID int64, rv Review) error {
+	_, err := db.Exec(`
+		INSERT INTO reviews (post_id, rating, prose, plot, characters) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(post_id) DO UPDATE SET
+		  rating = excluded.rating, prose = excluded.prose, plot = excluded.plot, characters = excluded.characters`,
+		postID, int(rv.Rating), nullRating(rv.Prose), nullRating(rv.Plot), nullRating(rv.Characters))
+	return err
+}
+
+// getReview returns the scores of a review post, or nil for a discussion.
+func getReview(db dbtx, postID int64) (*Review, error) {
+	var rv Review
+	err := db.QueryRow(`
+		SELECT rating, COALESCE(prose, 0), COALESCE(plot, 0), COALESCE(characters, 0)
+		FROM reviews WHERE post_id = ?`, postID).
+		Scan(&rv.Rating, &rv.Prose, &rv.Plot, &rv.Characters)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+// hasReviewed reports whether the user already has a live review of the
+// book; one review per member keeps the averages honest.
+func hasReviewed(db dbtx, userID, bookID int64) bool {
+	var n int
+	_ = db.QueryRow(`
+		SELECT COUNT(*) FROM reviews rv JOIN posts p ON p.id = rv.post_id
+		WHERE p.user_id = ? AND p.book_id = ? AND p.deleted_at IS NULL`, userID, bookID).Scan(&n)
+	return n > 0
+}
+
+// visibleReviews joins reviews to posts that anyone can see.
+const visibleReviews = `
+	reviews rv JOIN posts p ON p.id = rv.post_id AND p.hidden_at IS NULL AND p.deleted_at IS NULL`
+
+// HistogramBar is one whole-star bucket of a rating histogram.
+type HistogramBar struct {
+	Stars   int
+	Count   int
+	Percent int // of all reviews, for the bar width
+}
+
+// BookRatings summarizes the reviews of one book.
+type BookRatings struct {
+	Count     int
+	Average   float64 // in stars
+	Aspects   []AspectAverage
+	Histogram []HistogramBar // five stars first
+}
+
+// AspectAverage is the average of one aspect over the reviews that scored it.
+type AspectAverage struct {
+	Label   string
+	Average float64 // in stars, 0 if nobody scored it
+	Count   int
+}
+
+// bookRatings aggregates the visible reviews of a book. Half-star ratings
+// count towards the bucket of the star they round up to.
+func bookRatings(db dbtx, bookID int64) (*BookRatings, error) {
+	br := &BookRatings{}
+	var avg, prose, plot, chars sql.NullFloat64
+	var nProse, nPlot, nChars int
+	err := db.QueryRow(`
+		SELECT COUNT(*), AVG(rv.rating) / 2.0,
+		       AVG(rv.prose) / 2.0, COUNT(rv.prose),
+		       AVG(rv.plot) / 2.0, COUNT(rv.plot),
+		       AVG(rv.characters) / 2.0, COUNT(rv.characters)
+		FROM `+visibleReviews+` WHERE p.book_id = ?`, bookID).
+		Scan(&br.Count, &avg, &prose, &nProse, &plot, &nPlot, &chars, &nChars)
+	if err != nil {
+		return nil, err
+	}
+	br.Average = avg.Float64
+	br.Aspects = []AspectAverage{
+		{reviewAspects[0].Label, prose.Float64, nProse},
+		{reviewAspects[1].Label, plot.Float64, nPlot},
+		{reviewAspects[2].Label, chars.Float64, nChars},
+	}
+
+	counts := make([]int, 6)
+	rows, err := db.Query(`
+		SELECT (rv.rating + 1) / 2, COUNT(*) FROM `+visibleReviews+`
+		WHERE p.book_id = ? GROUP BY 1`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stars, n int
+		if err := rows.Scan(&stars, &n); err != nil {
+			return nil, err
+		}
+		if stars >= 1 && stars <= 5 {
+			counts[stars] = n
+		}
+	}
+	for s := 5; s >= 1; s-- {
+		bar := HistogramBar{Stars: s, Count: counts[s]}
+		if br.Count > 0 {
+			bar.Percent = counts[s] * 100 / br.Count
+		}
+		br.Histogram = append(br.Histogram, bar)
+	}
+	return br, rows.Err()
+}
+
+// TopRatedBook is one entry of the "top rated this month" list.
+type TopRatedBook struct {
+	BookID  int64
+	Title   string
+	Authors string
+	Average float64 // in stars
+	Reviews int
+}
+
+// topRatedThisMonth lists the books with the best average rating among
+// reviews posted since the start of the calendar month.
+func topRatedThisMonth(db *sql.DB, limit int) ([]TopRatedBook, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b.title, b.authors, AVG(rv.rating) / 2.0, COUNT(*)
+		FROM `+visibleReviews+`
+		JOIN books b ON b.id = p.book_id
+		WHERE p.created_at >= date('now', 'start of month')
+		GROUP BY b.id
+		ORDER BY AVG(rv.rating) DESC, COUNT(*) DESC, b.title
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []TopRatedBook
+	for rows.Next() {
+		var t TopRatedBook
+		if err := rows.Scan(&t.BookID, &t.Title, &t.Authors, &t.Average, &t.Reviews); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
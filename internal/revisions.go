@@ -0,0 +1,323 @@
+package app
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PostEditGET — GET /posts/edit?id=123
+// Shows the edit form to the post's author.
+func (a *App) PostEditGET(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		a.renderError(w, http.StatusNotFound, "Post not found.")
+		return
+	}
+
+	var post struct {
+		ID         int64
+		UserID     int64
+		Title      string
+		Content    string
+		Categories string
+		SpoilerChapter int
+		BookID         int64
+	}
+	err = a.db.QueryRow(`SELECT id, user_id, title, content, COALESCE(spoiler_chapter, 0), COALESCE(book_id, 0) FROM posts WHERE id = ? AND deleted_at IS NULL`, id).
+		Scan(&post.ID, &post.UserID, &post.Title, &post.Content, &post.SpoilerChapter, &post.BookID)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Post not found.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	if post.UserID != u.ID {
+		a.renderError(w, http.StatusForbidden, "Only the author can edit this post.")
+		return
+	}
+	cats, _ := postCategoryNames(a.db, id)
+	post.Categories = strings.Join(cats, ", ")
+
+	books, _ := listBooks(a.db, "")
+	review, _ := getReview(a.db, id)
+	data := map[string]any{
+		"Title": "Edit Post", "User": u, "Post": post, "Books": books,
+		"Review": review, "RatingChoices": ratingChoices,
+		"CSRFToken": a.generateCSRF(r),
+	}
+	a.render(w, "edit_post.html", data)
+}
+
+// PostEditPOST — POST /posts/edit?id=123
+// Archives the current version into post_revisions, then saves the edit.
+func (a *App) PostEditPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermCreatePost)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	title := strings.TrimSpace(r.Form.Get("title"))
+	content := strings.TrimSpace(r.Form.Get("content"))
+	catsRaw := strings.TrimSpace(r.Form.Get("categories"))
+	if title == "" || content == "" {
+		http.Error(w, "title and content required", http.StatusBadRequest)
+		return
+	}
+	spoiler, err := parseSpoilerChapter(r.Form.Get("spoiler_chapter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bookID, err := parseBookID(a.db, r.Form.Get("book"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var authorID int64
+	var oldTitle, oldContent string
+	err = tx.QueryRow(`SELECT user_id, title, content FROM posts WHERE id = ? AND deleted_at IS NULL`, id).
+		Scan(&authorID, &oldTitle, &oldContent)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Post not found.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if authorID != u.ID {
+		a.renderError(w, http.StatusForbidden, "Only the author can edit this post.")
+		return
+	}
+	oldCats, err := postCategoryNames(tx, id)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	// the spoiler tag, book link and review scores are metadata, not
+	// content: changing them alone doesn't make a revision
+	if _, err := tx.Exec(`UPDATE posts SET spoiler_chapter = ?, book_id = ? WHERE id = ?`, spoiler, bookID, id); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	review, err := getReview(tx, id)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if review != nil {
+		rv, err := parseReviewForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !bookID.Valid {
+			http.Error(w, "a review needs a book", http.StatusBadRequest)
+			return
+		}
+		if err := saveReview(tx, id, rv); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	back := "/post?id=" + strconv.FormatInt(id, 10)
+	if title == oldTitle && content == oldContent && normalizeCategories(catsRaw) == strings.Join(oldCats, ", ") {
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther) // content unchanged, no revision
+		return
+	}
+
+	// archive the version being replaced; it was written at updated_at, or
+	// at created_at if it has never been edited
+	var version int
+	_ = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM post_revisions WHERE post_id = ?`, id).Scan(&version)
+	if _, err := tx.Exec(`
+		INSERT INTO post_revisions (post_id, version, title, content, categories, created_at)
+		SELECT id, ?, title, content, ?, COALESCE(updated_at, created_at) FROM posts WHERE id = ?`,
+		version, strings.Join(oldCats, ", "), id); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	contentHTML := renderMarkdown(content)
+	if _, err := tx.Exec(`UPDATE posts SET title = ?, content = ?, content_html = ?, content_masked = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		title, content, contentHTML, maskSpoilers(content), id); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := setPostCategories(tx, id, catsRaw); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	// people added in the edit hear about it; removed ones drop off
+	if err := recordMentions(tx, u, "post", id, contentHTML); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// normalizeCategories renders a raw comma-separated list the same way
+// postCategoryNames output is joined, for change detection.
+func normalizeCategories(raw string) string {
+	seen := map[string]bool{}
+	var names []string
+	for _, c := range strings.Split(raw, ",") {
+		name := strings.TrimSpace(c)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// postVersion is one version of a post in its revision history.
+type postVersion struct {
+	Version    int
+	Title      string
+	Content    string
+	Categories string
+	CreatedAt  string
+}
+
+// revisionView is a version as shown on the history page, diffed against
+// the one before it.
+type revisionView struct {
+	Version    int
+	CreatedAt  string
+	IsCurrent  bool
+	Title      template.HTML
+	Content    template.HTML
+	Categories template.HTML
+}
+
+// diffRevisions diffs each version, oldest first, against the one before it
+// and returns the views newest first. Spoilers are masked in both versions,
+// since the diff shows the Markdown source rather than rendered spoilers.
+func diffRevisions(versions []postVersion) []revisionView {
+	var list []revisionView
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		prev := v // the first version has nothing to diff against
+		if i > 0 {
+			prev = versions[i-1]
+		}
+		list = append(list, revisionView{
+			Version:    v.Version,
+			CreatedAt:  v.CreatedAt,
+			IsCurrent:  i == len(versions)-1,
+			Title:      diffHTML(prev.Title, v.Title),
+			Content:    diffHTML(maskSpoilers(prev.Content), maskSpoilers(v.Content)),
+			Categories: diffHTML(prev.Categories, v.Categories),
+		})
+	}
+	return list
+}
+
+// PostRevisionsGET — GET /posts/revisions?id=123
+// Lists every version of a post, newest first, each diffed against the one
+// before it.
+func (a *App) PostRevisionsGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		a.renderError(w, http.StatusNotFound, "Post not found.")
+		return
+	}
+
+	var cur postVersion
+	var authorID int64
+	var hidden, deleted bool
+	var chapter int
+	err = a.db.QueryRow(`
+		SELECT title, content, COALESCE(updated_at, created_at), user_id,
+		       hidden_at IS NOT NULL, deleted_at IS NOT NULL, COALESCE(spoiler_chapter, 0)
+		FROM posts WHERE id = ?`, id).
+		Scan(&cur.Title, &cur.Content, &cur.CreatedAt, &authorID, &hidden, &deleted, &chapter)
+	if err == sql.ErrNoRows {
+		a.renderError(w, http.StatusNotFound, "Post not found.")
+		return
+	}
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	// the history shows everything the post ever said, so it follows the
+	// same rules as the post itself: hidden posts are for moderators,
+	// deleted ones for moderators and the author, and spoilers are gated
+	canModerate := a.canModeratePost(u, id)
+	isAuthor := u != nil && u.ID == authorID
+	if hidden && !canModerate || deleted && !canModerate && !isAuthor {
+		a.renderError(w, http.StatusNotFound, "Post not found.")
+		return
+	}
+	if a.spoilerGate(w, r, u, id, cur.Title, chapter, isAuthor) {
+		return
+	}
+	cats, _ := postCategoryNames(a.db, id)
+	cur.Categories = strings.Join(cats, ", ")
+
+	rows, err := a.db.Query(`
+		SELECT version, title, content, categories, created_at
+		FROM post_revisions WHERE post_id = ? ORDER BY version`, id)
+	if err != nil {
+		a.renderError(w, http.StatusInternalServerError, "Database error.")
+		return
+	}
+	defer rows.Close()
+	var versions []postVersion
+	for rows.Next() {
+		var v postVersion
+		if err := rows.Scan(&v.Version, &v.Title, &v.Content, &v.Categories, &v.CreatedAt); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	cur.Version = len(versions) + 1
+	versions = append(versions, cur)
+
+	data := map[string]any{
+		"Title":     "Revisions — " + cur.Title,
+		"User":      u,
+		"PostID":    id,
+		"PostTitle": cur.Title,
+		"Revisions": diffRevisions(versions),
+	}
+	a.render(w, "post_revisions.html", data)
+}
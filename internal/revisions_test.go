@@ -0,0 +1,32 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffRevisions(t *testing.T) {
+	versions := []postVersion{
+		{Version: 1, Title: "Dune", Content: "Paul ||dies|| at the end", Categories: "Sci-Fi"},
+		{Version: 2, Title: "Dune", Content: "Paul ||becomes emperor|| at the end\n[spoiler]\nAlia\n[/spoiler]", Categories: "Sci-Fi"},
+		{Version: 3, Title: "Dune!", Content: "Paul ||becomes emperor|| at the end", Categories: "Sci-Fi, Classics"},
+	}
+	list := diffRevisions(versions)
+	if len(list) != 3 || list[0].Version != 3 || !list[0].IsCurrent || list[2].Version != 1 || list[2].IsCurrent {
+		t.Fatalf("versions out of order: %+v", list)
+	}
+	for _, v := range list {
+		for _, secret := range []string{"dies", "emperor", "Alia"} {
+			if strings.Contains(string(v.Content), secret) {
+				t.Errorf("version %d diff shows spoiler %q: %s", v.Version, secret, v.Content)
+			}
+		}
+	}
+	// changing the text inside a spoiler is no visible change
+	if got, want := string(list[1].Content), "Paul ░░░░ at the end<ins>\n░░░░</ins>"; got != want {
+		t.Errorf("version 2 diff = %q, want %q", got, want)
+	}
+	if got := string(list[0].Title); got != "<del>Dune</del><ins>Dune!</ins>" {
+		t.Errorf("version 3 title diff = %q", got)
+	}
+}
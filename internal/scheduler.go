@@ -0,0 +1,33 @@
+package app
+
+import (
+	"context"
+	"time"
+)
+
+// schedulerInterval is how often the background jobs run.
+const schedulerInterval = time.Minute
+
+// RunScheduler runs the background jobs right away and then every
+// schedulerInterval until ctx is done. Jobs log their own errors; one
+// failing doesn't stop the others.
+func (a *App) RunScheduler(ctx context.Context) {
+	jobs := []func(now time.Time){
+		a.openClubMilestonesJob,
+		a.sendMailJob,
+		a.pruneMailJob,
+		a.pruneLoginAttemptsJob,
+	}
+	t := time.NewTicker(schedulerInterval)
+	defer t.Stop()
+	for {
+		for _, job := range jobs {
+			job(time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// markers FTS5 wraps around matched terms; they are swapped for <mark> only
+// after the snippet has been HTML-escaped.
+const (
+	hlStart = "\x02"
+	hlEnd   = "\x03"
+)
+
+// SearchResult is one ranked hit from the search index.
+type SearchResult struct {
+	Kind      string // "post" or "comment"
+	RefID     int64
+	PostID    int64
+	PostTitle string
+	Title     template.HTML // highlighted post title (posts only)
+	Snippet   template.HTML
+	Username  string
+	CreatedAt string
+}
+
+// SearchFilter narrows a search to one category and/or one author.
+type SearchFilter struct {
+	CategoryID int64
+	Author     string
+}
+
+// ftsQuery turns free text into an FTS5 query: every word becomes a quoted
+// term (so punctuation can't break the syntax) and the last one matches as a
+// prefix, which makes half-typed titles still find something.
+func ftsQuery(q string) string {
+	words := strings.Fields(q)
+	if len(words) == 0 {
+		return ""
+	}
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		terms = append(terms, `"`+strings.ReplaceAll(w, `"`, `""`)+`"`)
+	}
+	terms[len(terms)-1] += "*"
+	return strings.Join(terms, " ")
+}
+
+// highlightHTML escapes an FTS5 snippet and turns the match markers into
+// <mark> tags.
+func highlightHTML(s string) template.HTML {
+	s = template.HTMLEscapeString(s)
+	s = strings.ReplaceAll(s, hlStart, "<mark>")
+	s = strings.ReplaceAll(s, hlEnd, "</mark>")
+	return template.HTML(s)
+}
+
+// SearchContent runs a ranked full-text search over posts and comments.
+// Title matches weigh more than body matches.
+func SearchContent(db *sql.DB, q string, f SearchFilter, limit int) ([]SearchResult, error) {
+	match := ftsQuery(q)
+	if match == "" {
+		return nil, nil
+	}
+	query := `
+SELECT s.kind, s.ref_id, s.post_id, p.title,
+       highlight(search_fts, 0, ?, ?),
+       snippet(search_fts, 1, ?, ?, '…', 24),
+       u.username,
+       CASE s.kind WHEN 'post' THEN p.created_at ELSE c.created_at END
+FROM search_fts s
+JOIN posts p ON p.id = s.post_id
+LEFT JOIN comments c ON s.kind = 'comment' AND c.id = s.ref_id
+JOIN users u ON u.id = CASE s.kind WHEN 'post' THEN p.user_id ELSE c.user_id END
+WHERE search_fts MATCH ?
+  AND p.hidden_at IS NULL AND p.deleted_at IS NULL
+  AND (c.id IS NULL OR (c.hidden_at IS NULL AND c.deleted_at IS NULL))`
+	args := []any{hlStart, hlEnd, hlStart, hlEnd, match}
+	if f.CategoryID > 0 {
+		query += ` AND EXISTS (SELECT 1 FROM post_categories pc WHERE pc.post_id = s.post_id AND pc.category_id = ?)`
+		args = append(args, f.CategoryID)
+	}
+	if f.Author != "" {
+		query += ` AND u.username = ?`
+		args = append(args, f.Author)
+	}
+	query += ` ORDER BY bm25(search_fts, 10.0, 1.0) LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []SearchResult
+	for rows.Next() {
+		var res SearchResult
+		var title, snippet string
+		if err := rows.Scan(&res.Kind, &res.RefID, &res.PostID, &res.PostTitle, &title, &snippet, &res.Username, &res.CreatedAt); err != nil {
+			return nil, err
+		}
+		res.Title = highlightHTML(title)
+		res.Snippet = highlightHTML(snippet)
+		list = append(list, res)
+	}
+	return list, rows.Err()
+}
+
+// SearchGET — GET /search?q=...&cat=<id>&author=<username>
+func (a *App) SearchGET(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	catIDStr := r.URL.Query().Get("cat")
+	author := strings.TrimSpace(r.URL.Query().Get("author"))
+
+	type catItem struct {
+		ID   int64
+		Name string
+	}
+	var cats []catItem
+	if rowsC, _ := a.db.Query(`SELECT id, name FROM categories ORDER BY name`); rowsC != nil {
+		defer rowsC.Close()
+		for rowsC.Next() {
+			var it catItem
+			if err := rowsC.Scan(&it.ID, &it.Name); err == nil {
+				cats = append(cats, it)
+			}
+		}
+	}
+
+	var results []SearchResult
+	if q != "" {
+		f := SearchFilter{Author: author}
+		f.CategoryID, _ = strconv.ParseInt(catIDStr, 10, 64)
+		var err error
+		results, err = SearchContent(a.db, q, f, 50)
+		if err != nil {
+			a.renderError(w, http.StatusInternalServerError, "Search failed.")
+			return
+		}
+	}
+
+	data := map[string]any{
+		"Title":        "Search",
+		"User":         u,
+		"Query":        q,
+		"Categories":   cats,
+		"FilterCat":    catIDStr,
+		"FilterAuthor": author,
+		"Results":      results,
+	}
+	a.render(w, "search.html", data)
+}
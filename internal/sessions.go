@@ -0,0 +1,228 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sessions. Each login records the browser's user agent and IP so members
+// can recognise their devices on /me/sessions and sign any of them out.
+// last_seen_at is refreshed by currentUser, but at most once per
+// sessionTouchInterval, so ordinary page views don't each cost a write.
+
+const (
+	sessionTouchInterval = 5 * time.Minute
+	maxUserAgentLen      = 255
+)
+
+// clientIP is the address a request came from. Behind reverse proxies set
+// TRUST_PROXY to how many there are (usually 1). Each proxy appends the
+// address it saw to X-Forwarded-For, so the client is that many entries from
+// the right; anything further left was sent by the client and can be forged.
+func clientIP(r *http.Request) string {
+	if hops, err := strconv.Atoi(os.Getenv("TRUST_PROXY")); err == nil && hops > 0 {
+		var fwd []string
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(h, ",") {
+				if ip = strings.TrimSpace(ip); ip != "" {
+					fwd = append(fwd, ip)
+				}
+			}
+		}
+		if len(fwd) > 0 {
+			return fwd[max(len(fwd)-hops, 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SessionInfo is one row of /me/sessions.
+type SessionInfo struct {
+	Handle    string // stands in for the token, which never leaves the cookie
+	UserAgent string
+	Device    string
+	IP        string
+	CreatedAt string
+	LastSeen  string
+	Current   bool
+}
+
+// sessionHandle identifies a session in forms without exposing its token.
+func sessionHandle(token string) string {
+	return hashToken(token)[:16]
+}
+
+// describeUserAgent turns a user agent into something like
+// "Firefox on Linux". Anything it doesn't recognise is just "Browser".
+func describeUserAgent(ua string) string {
+	browser := "Browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			return browser + " on " + o.name
+		}
+	}
+	return browser
+}
+
+// touchSession records that a session was just used, unless it already
+// was within sessionTouchInterval.
+func (a *App) touchSession(token string, lastSeen int64, now time.Time) {
+	if now.Unix()-lastSeen < int64(sessionTouchInterval/time.Second) {
+		return
+	}
+	_, _ = a.db.Exec(`UPDATE sessions SET last_seen_at = ? WHERE token = ?`, now.Unix(), token)
+}
+
+// listSessions returns the member's live sessions, most recently used
+// first; current is the token of the session making the request.
+func (a *App) listSessions(userID int64, current string) ([]SessionInfo, error) {
+	rows, err := a.db.Query(`
+		SELECT token, user_agent, ip, created_at, COALESCE(last_seen_at, 0) FROM sessions
+		WHERE user_id = ? AND expires_at > ?
+		ORDER BY COALESCE(last_seen_at, 0) DESC, created_at DESC`, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []SessionInfo
+	for rows.Next() {
+		var s SessionInfo
+		var token string
+		var lastSeen int64
+		if err := rows.Scan(&token, &s.UserAgent, &s.IP, &s.CreatedAt, &lastSeen); err != nil {
+			return nil, err
+		}
+		s.Handle = sessionHandle(token)
+		s.Device = describeUserAgent(s.UserAgent)
+		s.Current = token == current
+		if lastSeen > 0 {
+			s.LastSeen = time.Unix(lastSeen, 0).UTC().Format(time.RFC3339)
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// sessionTokens returns the tokens of every session userID has, so their
+// CSRF tokens can be dropped along with them.
+func sessionTokens(db dbtx, userID int64) ([]string, error) {
+	rows, err := db.Query(`SELECT token FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// SessionsRouter handles /me/sessions and its POST actions: revoke (one
+// device) and revoke-others (everywhere but here).
+func (a *App) SessionsRouter(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	c, _ := r.Cookie(sessionCookieName)
+	current := c.Value
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/sessions"), "/")
+	if rest == "" {
+		list, err := a.listSessions(u.ID, current)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		a.render(w, "sessions.html", map[string]any{
+			"Title":     "Sessions",
+			"User":      u,
+			"Sessions":  list,
+			"CSRFToken": a.generateCSRF(r),
+			"Done":      r.URL.Query().Get("done"),
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	switch rest {
+	case "revoke":
+		handle := r.Form.Get("session")
+		tokens, err := sessionTokens(a.db, u.ID)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		var target string
+		for _, token := range tokens {
+			if sessionHandle(token) == handle {
+				target = token
+			}
+		}
+		if target == "" {
+			a.renderError(w, http.StatusNotFound, "That session has already ended.")
+			return
+		}
+		if err := deleteSession(a.db, target); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		a.dropCSRF(target)
+		if target == current {
+			clearSessionCookie(w)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/me/sessions?done=one", http.StatusSeeOther)
+
+	case "revoke-others":
+		tokens, err := sessionTokens(a.db, u.ID)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := a.db.Exec(`DELETE FROM sessions WHERE user_id = ? AND token <> ?`, u.ID, current); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		for _, token := range tokens {
+			if token != current {
+				a.dropCSRF(token)
+			}
+		}
+		http.Redirect(w, r, "/me/sessions?done=others", http.StatusSeeOther)
+
+	default:
+		a.renderError(w, http.StatusNotFound, "Page not found.")
+	}
+}
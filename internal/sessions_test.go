@@ -0,0 +1,37 @@
+package app
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		trust string
+		fwd   []string // X-Forwarded-For header lines
+		want  string
+	}{
+		{"", []string{"1.1.1.1"}, "10.0.0.1"},
+		{"0", []string{"1.1.1.1"}, "10.0.0.1"},
+		{"yes", []string{"1.1.1.1"}, "10.0.0.1"},
+		{"1", nil, "10.0.0.1"},
+		{"1", []string{"1.1.1.1"}, "1.1.1.1"},
+		// a forged entry from the client sits left of the one the proxy added
+		{"1", []string{"6.6.6.6, 1.1.1.1"}, "1.1.1.1"},
+		{"1", []string{"6.6.6.6", "1.1.1.1"}, "1.1.1.1"},
+		{"2", []string{"6.6.6.6, 1.1.1.1, 192.168.0.2"}, "1.1.1.1"},
+		{"3", []string{"1.1.1.1, 192.168.0.2"}, "1.1.1.1"},
+		{"1", []string{" , "}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Setenv("TRUST_PROXY", tt.trust)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		for _, f := range tt.fwd {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("TRUST_PROXY=%q X-Forwarded-For %q: clientIP = %q, want %q", tt.trust, tt.fwd, got, tt.want)
+		}
+	}
+}
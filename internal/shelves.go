@@ -0,0 +1,304 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shelf statuses, in the order the profile tab lists them.
+const (
+	ShelfReading   = "reading"
+	ShelfWant      = "want"
+	ShelfFinished  = "finished"
+	ShelfAbandoned = "abandoned"
+)
+
+var shelfStatuses = []string{ShelfReading, ShelfWant, ShelfFinished, ShelfAbandoned}
+
+// shelfLabels are the headings used for each status.
+var shelfLabels = map[string]string{
+	ShelfReading:   "Currently reading",
+	ShelfWant:      "Want to read",
+	ShelfFinished:  "Finished",
+	ShelfAbandoned: "Abandoned",
+}
+
+// dateLayout is how shelf dates are stored and entered.
+const dateLayout = "2006-01-02"
+
+// Rating is a star rating counted in half-stars (1..10); 0 means unrated.
+type Rating int
+
+// ratingChoices are the options of the rating select, best first.
+var ratingChoices = []Rating{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+
+// String renders the rating as stars, e.g. "★★★½".
+func (r Rating) String() string {
+	if r <= 0 {
+		return ""
+	}
+	s := strings.Repeat("★", int(r)/2)
+	if r%2 == 1 {
+		s += "½"
+	}
+	return s
+}
+
+// Stars is the rating as a number of stars, e.g. "3.5"; the form value
+// parseRating reads back.
+func (r Rating) Stars() string {
+	return strconv.FormatFloat(float64(r)/2, 'f', -1, 64)
+}
+
+// parseRating reads a rating given in stars ("4", "3.5"); blank or 0 is
+// unrated.
+func parseRating(s string) (Rating, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > 5 || f*2 != float64(int(f*2)) {
+		return 0, errors.New("ratings go from ½ to 5 stars in half-star steps")
+	}
+	return Rating(f * 2), nil
+}
+
+// ShelfEntry is one book on a member's shelves.
+type ShelfEntry struct {
+	BookID       int64
+	BookTitle    string
+	BookAuthors  string
+	CoverPath    string
+	Status       string
+	StartedOn    string // YYYY-MM-DD or ""
+	FinishedOn   string
+	Progress     int
+	ProgressUnit string // "percent" or "page"
+	Rating       Rating
+	UpdatedAt    string
+}
+
+// ProgressText is the reading progress as shown next to a book.
+func (e ShelfEntry) ProgressText() string {
+	if e.Progress <= 0 {
+		return ""
+	}
+	if e.ProgressUnit == "page" {
+		return fmt.Sprintf("page %d", e.Progress)
+	}
+	return fmt.Sprintf("%d%%", e.Progress)
+}
+
+// Shelf is one status group on the profile tab.
+type Shelf struct {
+	Status  string
+	Label   string
+	Entries []ShelfEntry
+}
+
+const shelfEntryColumns = `
+	s.book_id, b.title, b.authors, b.cover_path, s.status,
+	COALESCE(s.started_on, ''), COALESCE(s.finished_on, ''), s.progress, s.progress_unit,
+	COALESCE(s.rating, 0), s.updated_at`
+
+func scanShelfEntry(sc interface{ Scan(...any) error }) (ShelfEntry, error) {
+	var e ShelfEntry
+	err := sc.Scan(&e.BookID, &e.BookTitle, &e.BookAuthors, &e.CoverPath, &e.Status,
+		&e.StartedOn, &e.FinishedOn, &e.Progress, &e.ProgressUnit, &e.Rating, &e.UpdatedAt)
+	return e, err
+}
+
+// getShelfEntry returns the user's shelf entry for a book, or nil.
+func getShelfEntry(db dbtx, userID, bookID int64) (*ShelfEntry, error) {
+	e, err := scanShelfEntry(db.QueryRow(`
+		SELECT `+shelfEntryColumns+`
+		FROM shelf_entries s JOIN books b ON b.id = s.book_id
+		WHERE s.user_id = ? AND s.book_id = ?`, userID, bookID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// listShelves returns a user's books grouped by status. Empty shelves are
+// included so the tab can show every heading.
+func listShelves(db *sql.DB, userID int64) ([]Shelf, int, error) {
+	rows, err := db.Query(`
+		SELECT `+shelfEntryColumns+`
+		FROM shelf_entries s JOIN books b ON b.id = s.book_id
+		WHERE s.user_id = ?
+		ORDER BY COALESCE(s.finished_on, s.started_on, '') DESC, s.updated_at DESC`, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	byStatus := map[string][]ShelfEntry{}
+	total := 0
+	for rows.Next() {
+		e, err := scanShelfEntry(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		byStatus[e.Status] = append(byStatus[e.Status], e)
+		total++
+	}
+	shelves := make([]Shelf, 0, len(shelfStatuses))
+	for _, s := range shelfStatuses {
+		shelves = append(shelves, Shelf{Status: s, Label: shelfLabels[s], Entries: byStatus[s]})
+	}
+	return shelves, total, rows.Err()
+}
+
+// hasFinishedBook is true when the user has the post's book on their
+// finished shelf; such readers skip spoiler warnings for it.
+func hasFinishedBook(db dbtx, userID, postID int64) bool {
+	var n int
+	_ = db.QueryRow(`
+		SELECT COUNT(*) FROM shelf_entries s JOIN posts p ON p.book_id = s.book_id
+		WHERE s.user_id = ? AND p.id = ? AND s.status = ?`, userID, postID, ShelfFinished).Scan(&n)
+	return n > 0
+}
+
+// shelfInput is a validated shelf form.
+type shelfInput struct {
+	Status       string
+	StartedOn    sql.NullString
+	FinishedOn   sql.NullString
+	Progress     int
+	ProgressUnit string
+	Rating       sql.NullInt64
+}
+
+// parseShelfForm validates the shelf form and fills in the obvious: a book
+// you're reading was started today, a finished one was finished today and
+// is 100% read.
+func parseShelfForm(r *http.Request, now time.Time) (shelfInput, error) {
+	in := shelfInput{
+		Status:       r.Form.Get("status"),
+		ProgressUnit: r.Form.Get("unit"),
+	}
+	if _, ok := shelfLabels[in.Status]; !ok {
+		return in, errors.New("unknown shelf")
+	}
+	if in.ProgressUnit != "page" {
+		in.ProgressUnit = "percent"
+	}
+	for _, f := range []struct {
+		field string
+		dst   *sql.NullString
+	}{{"started_on", &in.StartedOn}, {"finished_on", &in.FinishedOn}} {
+		v := strings.TrimSpace(r.Form.Get(f.field))
+		if v == "" {
+			continue
+		}
+		d, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return in, errors.New("dates must look like 2024-03-31")
+		}
+		if d.After(now) {
+			return in, errors.New("dates can't be in the future")
+		}
+		*f.dst = sql.NullString{String: v, Valid: true}
+	}
+	if v := strings.TrimSpace(r.Form.Get("progress")); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 0 || (in.ProgressUnit == "percent" && p > 100) || p > 100000 {
+			return in, errors.New("progress must be a page number or a percentage up to 100")
+		}
+		in.Progress = p
+	}
+	rating, err := parseRating(r.Form.Get("rating"))
+	if err != nil {
+		return in, err
+	}
+	if rating > 0 {
+		in.Rating = sql.NullInt64{Int64: int64(rating), Valid: true}
+	}
+
+	today := now.Format(dateLayout)
+	switch in.Status {
+	case ShelfReading:
+		if !in.StartedOn.Valid {
+			in.StartedOn = sql.NullString{String: today, Valid: true}
+		}
+	case ShelfFinished:
+		if !in.FinishedOn.Valid {
+			in.FinishedOn = sql.NullString{String: today, Valid: true}
+		}
+		if in.ProgressUnit == "percent" {
+			in.Progress = 100
+		}
+	}
+	// dates are ISO strings, so they compare correctly as text
+	if in.StartedOn.Valid && in.FinishedOn.Valid && in.FinishedOn.String < in.StartedOn.String {
+		return in, errors.New("the finish date is before the start date")
+	}
+	return in, nil
+}
+
+// ShelfPOST — POST /shelf
+// Form fields: book_id, status, started_on, finished_on, progress, unit=percent|page,
+// rating (stars, halves allowed)
+// Adds the book to the user's shelves or updates its entry.
+func (a *App) ShelfPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	bookID, err := parseBookID(a.db, r.Form.Get("book_id"))
+	if err != nil || !bookID.Valid {
+		http.Error(w, "unknown book", http.StatusBadRequest)
+		return
+	}
+	back := fmt.Sprintf("/books/%d", bookID.Int64)
+	in, err := parseShelfForm(r, time.Now())
+	if err != nil {
+		http.Redirect(w, r, back+"?err="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	if _, err := a.db.Exec(`
+		INSERT INTO shelf_entries (user_id, book_id, status, started_on, finished_on, progress, progress_unit, rating)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, book_id) DO UPDATE SET
+		  status = excluded.status, started_on = excluded.started_on, finished_on = excluded.finished_on,
+		  progress = excluded.progress, progress_unit = excluded.progress_unit, rating = excluded.rating,
+		  updated_at = CURRENT_TIMESTAMP`,
+		u.ID, bookID.Int64, in.Status, in.StartedOn, in.FinishedOn, in.Progress, in.ProgressUnit, in.Rating); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// ShelfRemovePOST — POST /shelf/remove
+// Form fields: book_id
+func (a *App) ShelfRemovePOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	bookID, _ := strconv.ParseInt(r.Form.Get("book_id"), 10, 64)
+	if _, err := a.db.Exec(`DELETE FROM shelf_entries WHERE user_id = ? AND book_id = ?`, u.ID, bookID); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", bookID), http.StatusSeeOther)
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// restoreWindowSQL is how long an author can undo their own deletion, as a
+// SQLite datetime modifier. Moderators can restore at any time.
+const restoreWindowSQL = "-30 days"
+
+// Moderation log actions for deletions made by moderators.
+const (
+	ModDelete  = "delete"
+	ModRestore = "restore"
+)
+
+// deletionState is what the delete/restore handlers need to know about a
+// post or comment.
+type deletionState struct {
+	Deleted      bool
+	DeletedBy    int64
+	WithinWindow bool // deleted recently enough for the author to restore
+}
+
+// loadDeletionState reads the soft-delete columns of a post or comment.
+func loadDeletionState(db dbtx, t *reportTarget) (deletionState, error) {
+	table := "posts"
+	if t.Kind == "comment" {
+		table = "comments"
+	}
+	var s deletionState
+	var by sql.NullInt64
+	err := db.QueryRow(`
+		SELECT deleted_at IS NOT NULL, deleted_by, COALESCE(deleted_at >= datetime('now', ?), 0)
+		FROM `+table+` WHERE id = ?`, restoreWindowSQL, t.ID).
+		Scan(&s.Deleted, &by, &s.WithinWindow)
+	s.DeletedBy = by.Int64
+	return s, err
+}
+
+// canRestore: moderators always; the author only for their own deletion and
+// only inside the restore window.
+func canRestore(u *User, t *reportTarget, s deletionState, canModerate bool) bool {
+	if !s.Deleted || u == nil {
+		return false
+	}
+	if canModerate {
+		return true
+	}
+	return u.ID == t.AuthorID && s.DeletedBy == t.AuthorID && s.WithinWindow
+}
+
+// ContentDeletePOST — POST /delete
+// Form fields: kind=post|comment, id
+// Marks the content deleted; replies, reactions and revisions are kept.
+func (a *App) ContentDeletePOST(w http.ResponseWriter, r *http.Request) {
+	a.setDeleted(w, r, true)
+}
+
+// ContentRestorePOST — POST /restore
+// Form fields: kind=post|comment, id
+func (a *App) ContentRestorePOST(w http.ResponseWriter, r *http.Request) {
+	a.setDeleted(w, r, false)
+}
+
+// setDeleted is the shared body of ContentDeletePOST and ContentRestorePOST.
+func (a *App) setDeleted(w http.ResponseWriter, r *http.Request, del bool) {
+	u, ok := a.authorize(w, r, PermDeleteOwn)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	kind := r.Form.Get("kind")
+	id, _ := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+	if kind != "post" && kind != "comment" {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+	t, err := loadReportTarget(a.db, kind, id)
+	if err == errNoTarget {
+		a.renderError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	state, err := loadDeletionState(a.db, t)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	isAuthor := u.ID == t.AuthorID
+	canModerate := a.canModerateTarget(u, t)
+
+	if del {
+		if !isAuthor && !canModerate {
+			a.renderError(w, http.StatusForbidden, "You can only delete your own posts and comments.")
+			return
+		}
+		if state.Deleted {
+			http.Redirect(w, r, t.Link, http.StatusSeeOther)
+			return
+		}
+	} else if !canRestore(u, t, state, canModerate) {
+		a.renderError(w, http.StatusForbidden, "This can no longer be restored.")
+		return
+	}
+
+	table := "posts"
+	if kind == "comment" {
+		table = "comments"
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if del {
+		_, err = tx.Exec(`UPDATE `+table+` SET deleted_at = CURRENT_TIMESTAMP, deleted_by = ? WHERE id = ?`, u.ID, id)
+	} else {
+		_, err = tx.Exec(`UPDATE `+table+` SET deleted_at = NULL, deleted_by = NULL WHERE id = ?`, id)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	// moderators acting on someone else's content leave an audit trail
+	if !isAuthor {
+		action := ModDelete
+		if !del {
+			action = ModRestore
+		}
+		if err := logModeration(tx, u.ID, action, t, 0, ""); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, t.Link, http.StatusSeeOther)
+}
@@ -0,0 +1,246 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Spoiler markup. ||text|| and [spoiler]text[/spoiler] inside a paragraph
+// render as a blurred span that reveals on click; [spoiler] on its own line
+// starts a collapsed block that runs until a line ending in [/spoiler].
+const (
+	spoilerOpen  = "[spoiler]"
+	spoilerClose = "[/spoiler]"
+)
+
+// maxSpoilerChapter bounds the "spoilers up to chapter N" field.
+const maxSpoilerChapter = 9999
+
+// renderInlineSpoiler renders open…close at s[i] as a spoiler span. It
+// returns the index after the closing marker, or 0 if there is none.
+func renderInlineSpoiler(b *strings.Builder, s string, i int, open, close string) int {
+	if !strings.HasPrefix(s[i:], open) {
+		return 0
+	}
+	end := strings.Index(s[i+len(open):], close)
+	if end <= 0 {
+		return 0
+	}
+	b.WriteString(`<span class="spoiler" tabindex="0">`)
+	renderInline(b, s[i+len(open):i+len(open)+end])
+	b.WriteString(`</span>`)
+	return i + len(open) + end + len(close)
+}
+
+// isSpoilerStart reports whether a line opens a spoiler block: it starts
+// with [spoiler] and either doesn't close it or closes it at the very end.
+func isSpoilerStart(line string) bool {
+	t := strings.TrimSpace(line)
+	if !strings.HasPrefix(t, spoilerOpen) {
+		return false
+	}
+	rest := t[len(spoilerOpen):]
+	return !strings.Contains(rest, spoilerClose) || strings.Index(rest, spoilerClose) == len(rest)-len(spoilerClose)
+}
+
+// spoilerBlockEnd returns the index of the line that closes the spoiler
+// block starting at lines[i], or -1 when lines[i] doesn't start a block or
+// the block is never closed.
+func spoilerBlockEnd(lines []string, i int) int {
+	if !isSpoilerStart(lines[i]) {
+		return -1
+	}
+	if strings.HasSuffix(strings.TrimSpace(lines[i]), spoilerClose) {
+		return i
+	}
+	for j := i + 1; j < len(lines); j++ {
+		if strings.HasSuffix(strings.TrimRight(lines[j], " "), spoilerClose) {
+			return j
+		}
+	}
+	return -1
+}
+
+// renderSpoilerBlock renders the spoiler block starting at lines[i] and
+// returns the index of the first line after it. It returns i unchanged when
+// lines[i] doesn't start a block or the block is never closed.
+func renderSpoilerBlock(b *strings.Builder, lines []string, i int) int {
+	end := spoilerBlockEnd(lines, i)
+	if end < 0 {
+		return i
+	}
+	first := strings.TrimPrefix(strings.TrimSpace(lines[i]), spoilerOpen)
+	var inner []string
+	if end == i {
+		inner = append(inner, strings.TrimSuffix(first, spoilerClose))
+	} else {
+		inner = append(inner, first)
+		inner = append(inner, lines[i+1:end]...)
+		inner = append(inner, strings.TrimSuffix(strings.TrimRight(lines[end], " "), spoilerClose))
+	}
+	b.WriteString("<details class=\"spoiler\"><summary>Spoiler</summary>\n")
+	renderBlocks(b, inner, false)
+	b.WriteString("</details>\n")
+	return end + 1
+}
+
+// spoilerMask stands in for spoiler text wherever raw Markdown is shown or
+// indexed. The FTS tokenizer treats it as punctuation, so it isn't indexed.
+const spoilerMask = "░░░░"
+
+// maskSpoilers replaces every spoiler in Markdown source with spoilerMask,
+// for the places that use the source rather than the rendered HTML: the
+// search index and snippets, and comment listings on profiles.
+func maskSpoilers(s string) string {
+	lines := strings.Split(s, "\n")
+	out := lines[:0:0]
+	for i := 0; i < len(lines); i++ {
+		if end := spoilerBlockEnd(lines, i); end >= 0 {
+			out = append(out, spoilerMask)
+			i = end
+			continue
+		}
+		out = append(out, lines[i])
+	}
+	s = strings.Join(out, "\n")
+	s = maskInlineSpoilers(s, "||", "||")
+	return maskInlineSpoilers(s, spoilerOpen, spoilerClose)
+}
+
+// maskInlineSpoilers masks open…close spans. Like the renderer, it doesn't
+// let a span run across paragraphs.
+func maskInlineSpoilers(s, open, close string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, open)
+		if i < 0 {
+			break
+		}
+		rest := s[i+len(open):]
+		end := strings.Index(rest, close)
+		if end <= 0 || strings.Contains(rest[:end], "\n\n") {
+			b.WriteString(s[:i+len(open)])
+			s = rest
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(spoilerMask)
+		s = rest[end+len(close):]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// parseSpoilerChapter reads the optional "spoilers up to chapter" form
+// field. Blank or 0 means no warning.
+func parseSpoilerChapter(s string) (sql.NullInt64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return sql.NullInt64{}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > maxSpoilerChapter {
+		return sql.NullInt64{}, errors.New("spoiler chapter must be a number between 0 and " + strconv.Itoa(maxSpoilerChapter))
+	}
+	if n == 0 {
+		return sql.NullInt64{}, nil
+	}
+	return sql.NullInt64{Int64: int64(n), Valid: true}, nil
+}
+
+// readingProgress returns the furthest chapter the user has recorded for
+// any category (book) the post is tagged with, or reached in a club read of
+// the post's book, and whether they recorded anything at all.
+func readingProgress(db dbtx, userID, postID int64) (int, bool) {
+	var chapter sql.NullInt64
+	_ = db.QueryRow(`
+		SELECT MAX(chapter) FROM (
+		  SELECT rp.chapter FROM reading_progress rp
+		  JOIN post_categories pc ON pc.category_id = rp.category_id
+		  WHERE rp.user_id = ? AND pc.post_id = ?
+		  UNION ALL
+		  SELECT m.up_to_chapter FROM club_section_reads sr
+		  JOIN club_milestones m ON m.id = sr.milestone_id
+		  JOIN club_reads cr ON cr.id = m.club_read_id
+		  JOIN posts p ON p.book_id = cr.book_id
+		  WHERE sr.user_id = ? AND p.id = ? AND m.up_to_chapter IS NOT NULL
+		)`, userID, postID, userID, postID).Scan(&chapter)
+	return int(chapter.Int64), chapter.Valid
+}
+
+// spoilerGate renders the warning page shown instead of a post that
+// discusses chapters the viewer hasn't reached. It returns false when the
+// viewer may see the post: they wrote it, clicked through, or have read far
+// enough.
+func (a *App) spoilerGate(w http.ResponseWriter, r *http.Request, u *User, postID int64, title string, chapter int, isAuthor bool) bool {
+	if chapter <= 0 || isAuthor || r.URL.Query().Get("spoilers") == "ok" {
+		return false
+	}
+	progress, recorded := 0, false
+	if u != nil {
+		progress, recorded = readingProgress(a.db, u.ID, postID)
+		if recorded && progress >= chapter || hasFinishedBook(a.db, u.ID, postID) {
+			return false
+		}
+	}
+	books, _ := postCategoryNames(a.db, postID)
+	data := map[string]any{
+		"Title":     "Spoiler warning",
+		"User":      u,
+		"PostID":    postID,
+		"Link":      r.URL.Path + "?id=" + strconv.FormatInt(postID, 10), // the post or its history
+		"CSRFToken": a.generateCSRF(r),
+		"PostTitle": title,
+		"Chapter":   chapter,
+		"Progress":  progress,
+		"Recorded":  recorded,
+		"Books":     books,
+	}
+	a.render(w, "spoiler_gate.html", data)
+	return true
+}
+
+// ProgressPOST — POST /progress
+// Form fields: category (name), chapter, next
+// Records how far the user has read in a book, so spoiler-tagged posts up
+// to that chapter open without a warning.
+func (a *App) ProgressPOST(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	chapter, err := strconv.Atoi(strings.TrimSpace(r.Form.Get("chapter")))
+	if err != nil || chapter < 0 || chapter > maxSpoilerChapter {
+		http.Error(w, "invalid chapter", http.StatusBadRequest)
+		return
+	}
+	var catID int64
+	err = a.db.QueryRow(`SELECT id FROM categories WHERE name = ?`, strings.TrimSpace(r.Form.Get("category"))).Scan(&catID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "unknown book", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := a.db.Exec(`
+		INSERT INTO reading_progress (user_id, category_id, chapter) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, category_id) DO UPDATE SET chapter = excluded.chapter, updated_at = CURRENT_TIMESTAMP`,
+		u.ID, catID, chapter); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	next := r.Form.Get("next")
+	if !isLocalPath(next) {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
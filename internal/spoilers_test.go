@@ -0,0 +1,59 @@
+package app
+
+import "testing"
+
+func TestMaskSpoilers(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"no spoilers here", "no spoilers here"},
+		{"Snape ||kills Dumbledore|| in book six", "Snape ░░░░ in book six"},
+		{"a [spoiler]b[/spoiler] c ||d|| e", "a ░░░░ c ░░░░ e"},
+		{"empty |||| stays", "empty |||| stays"},
+		{"unclosed ||spoiler", "unclosed ||spoiler"},
+		{"no ||run\n\nacross|| paragraphs", "no ||run\n\nacross|| paragraphs"},
+		{"one ||line\nbreak|| is fine", "one ░░░░ is fine"},
+		{"before\n[spoiler]\nRosebud\nwas the sled\n[/spoiler]\nafter", "before\n░░░░\nafter"},
+		{"[spoiler]one line[/spoiler]\nafter", "░░░░\nafter"},
+		{"last\n[spoiler]\nnever closed", "last\n[spoiler]\nnever closed"},
+	}
+	for _, tt := range tests {
+		if got := maskSpoilers(tt.in); got != tt.want {
+			t.Errorf("maskSpoilers(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestSearchIndexSkipsSpoilers checks that the search triggers index the
+// masked text stored with each post and comment.
+func TestSearchIndexSkipsSpoilers(t *testing.T) {
+	db := newTestDB(t)
+	user := mustExec(t, db, `INSERT INTO users(email, username, password_hash) VALUES('a@b.c','ann','x')`)
+	content := "the butler ||Rosebud|| did it"
+	post := mustExec(t, db, `INSERT INTO posts(user_id, title, content, content_masked) VALUES(?,?,?,?)`,
+		user, "t", content, maskSpoilers(content))
+	mustExec(t, db, `INSERT INTO comments(post_id, user_id, content, content_masked) VALUES(?,?,?,?)`,
+		post, user, content, maskSpoilers(content))
+
+	count := func(q string) int {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM search_fts WHERE search_fts MATCH ?`, q).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count("butler"); n != 2 {
+		t.Errorf("%d hits for butler, want 2", n)
+	}
+	if n := count("rosebud"); n != 0 {
+		t.Errorf("%d hits for a spoiler", n)
+	}
+
+	content = "now ||butler|| is the spoiler, Rosebud isn't"
+	if _, err := db.Exec(`UPDATE posts SET content = ?, content_masked = ? WHERE id = ?`, content, maskSpoilers(content), post); err != nil {
+		t.Fatal(err)
+	}
+	if n := count("rosebud"); n != 1 {
+		t.Errorf("%d hits for rosebud after the edit, want 1", n)
+	}
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+)
+
+// maxCommentDepth is the deepest nesting level (top-level comments are 0).
+// Replies to a comment at this depth become its siblings instead.
+const maxCommentDepth = 5
+
+// errBadParent is returned when a reply points at a comment that doesn't
+// exist or belongs to another post.
+var errBadParent = errors.New("parent comment not found on this post")
+
+// CommentNode is one comment in a post's reply tree.
+type CommentNode struct {
+	ID              int64
+	ParentID        int64 // 0 for top-level comments
+	PostID          int64
+	Depth           int
+	Username        string
+	AvatarPath      string
+	Content         string
+	ContentHTML     template.HTML // rendered Markdown; blanked together with Content
+	CreatedAt       string
+	Likes           int
+	Dislikes        int
+	Children        []*CommentNode
+	Descendants     int  // size of the whole subthread below this comment
+	CanReply        bool // viewer is logged in
+	Hidden          bool // hidden by a moderator; Content is blanked unless CanModerate
+	CanModerate     bool
+	IsMine          bool // viewer wrote this comment
+	Deleted         bool // soft-deleted; Content is blanked unless IsMine or CanModerate
+	DeletedByAuthor bool
+	CanRestore      bool
+	CSRFToken       string // for the comment's forms; the template can't reach the page's
+}
+
+// CanDelete is true when the viewer may soft-delete this comment.
+func (n *CommentNode) CanDelete() bool {
+	return !n.Deleted && (n.IsMine || n.CanModerate)
+}
+
+// resolveReplyParent checks that parentID is a comment on postID and returns
+// the parent and depth the new reply should be stored with. Replies below
+// maxCommentDepth are re-parented onto the deepest allowed ancestor.
+func resolveReplyParent(db dbtx, postID, parentID int64) (sql.NullInt64, int, error) {
+	if parentID <= 0 {
+		return sql.NullInt64{}, 0, nil
+	}
+	var parentPost int64
+	var grandParent sql.NullInt64
+	var depth int
+	err := db.QueryRow(`SELECT post_id, parent_id, depth FROM comments WHERE id = ?`, parentID).
+		Scan(&parentPost, &grandParent, &depth)
+	if err == sql.ErrNoRows || (err == nil && parentPost != postID) {
+		return sql.NullInt64{}, 0, errBadParent
+	}
+	if err != nil {
+		return sql.NullInt64{}, 0, err
+	}
+	if depth >= maxCommentDepth {
+		return grandParent, depth, nil
+	}
+	return sql.NullInt64{Int64: parentID, Valid: true}, depth + 1, nil
+}
+
+// loadCommentTree fetches every comment on a post, with reaction counts, in
+// a single query and assembles the reply tree in memory. It returns the
+// top-level comments and the total number of comments. Hidden comments keep
+// their place in the tree so replies to them still make sense. csrf is the
+// viewer's form token.
+func loadCommentTree(db *sql.DB, postID int64, viewer *User, canModerate bool, csrf string) ([]*CommentNode, int, error) {
+	rows, err := db.Query(`
+		SELECT c.id, COALESCE(c.parent_id, 0), c.depth, c.user_id, u.username, COALESCE(u.avatar_path,''), c.content, c.content_html, c.created_at,
+		       c.hidden_at IS NOT NULL,
+		       c.deleted_at IS NOT NULL, COALESCE(c.deleted_by = c.user_id, 0), COALESCE(c.deleted_at >= datetime('now', ?), 0),
+		       COALESCE(SUM(CASE WHEN cr.value=1 THEN 1 END),0),
+		       COALESCE(SUM(CASE WHEN cr.value=-1 THEN 1 END),0)
+		FROM comments c
+		JOIN users u ON u.id = c.user_id
+		LEFT JOIN comment_reactions cr ON cr.comment_id = c.id
+		WHERE c.post_id = ?
+		GROUP BY c.id
+		ORDER BY c.created_at ASC, c.id ASC`, restoreWindowSQL, postID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var all []*CommentNode
+	stale := map[int64]template.HTML{} // rendered here; written back below
+	byID := map[int64]*CommentNode{}
+	for rows.Next() {
+		n := &CommentNode{PostID: postID, CanReply: viewer != nil, CanModerate: canModerate, CSRFToken: csrf}
+		var authorID int64
+		var inRestoreWindow, isStale bool
+		var contentHTML sql.NullString
+		if err := rows.Scan(&n.ID, &n.ParentID, &n.Depth, &authorID, &n.Username, &n.AvatarPath, &n.Content, &contentHTML, &n.CreatedAt, &n.Hidden,
+			&n.Deleted, &n.DeletedByAuthor, &inRestoreWindow, &n.Likes, &n.Dislikes); err != nil {
+			return nil, 0, err
+		}
+		if n.ContentHTML, isStale = cachedHTML(n.Content, contentHTML); isStale {
+			stale[n.ID] = n.ContentHTML
+		}
+		n.IsMine = viewer != nil && viewer.ID == authorID
+		if n.Hidden && !canModerate {
+			n.Content, n.ContentHTML = "", ""
+		}
+		if n.Deleted {
+			n.CanRestore = canModerate || (n.IsMine && n.DeletedByAuthor && inRestoreWindow)
+			if !canModerate && !n.IsMine {
+				n.Content, n.ContentHTML = "", ""
+			}
+		}
+		all = append(all, n)
+		byID[n.ID] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+	for id, h := range stale {
+		_, _ = db.Exec(`UPDATE comments SET content_html = ? WHERE id = ?`, string(h), id)
+	}
+
+	// quotes and mentions are resolved for the whole thread at once rather
+	// than a query or two per comment
+	var shown []*template.HTML
+	for _, n := range all {
+		if n.ContentHTML != "" {
+			shown = append(shown, &n.ContentHTML)
+		}
+	}
+	expandQuotesIn(db, shown)
+	linkMentionsIn(db, shown)
+
+	var roots []*CommentNode
+	for _, n := range all {
+		if p, ok := byID[n.ParentID]; ok {
+			p.Children = append(p.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+	for _, n := range roots {
+		countDescendants(n)
+	}
+	return roots, len(all), nil
+}
+
+// countDescendants fills Descendants for n and its subtree.
+func countDescendants(n *CommentNode) int {
+	total := 0
+	for _, c := range n.Children {
+		total += 1 + countDescendants(c)
+	}
+	n.Descendants = total
+	return total
+}
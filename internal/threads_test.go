@@ -0,0 +1,139 @@
+package app
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB returns a fully migrated database in a temporary directory.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "forum.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrateUp(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+// mustExec runs a statement and returns the inserted row id.
+func mustExec(t *testing.T, db *sql.DB, query string, args ...any) int64 {
+	t.Helper()
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// addReply stores a comment the way CommentPOST does and returns its id.
+func addReply(t *testing.T, db *sql.DB, postID, userID, parentID int64) int64 {
+	t.Helper()
+	parent, depth, err := resolveReplyParent(db, postID, parentID)
+	if err != nil {
+		t.Fatalf("resolveReplyParent(%d): %v", parentID, err)
+	}
+	return mustExec(t, db, `INSERT INTO comments(post_id, user_id, content, parent_id, depth) VALUES(?,?,?,?,?)`,
+		postID, userID, "reply", parent, depth)
+}
+
+func TestResolveReplyParent(t *testing.T) {
+	db := newTestDB(t)
+	user := mustExec(t, db, `INSERT INTO users(email, username, password_hash) VALUES('a@b.c','ann','x')`)
+	post := mustExec(t, db, `INSERT INTO posts(user_id, title, content) VALUES(?,?,?)`, user, "t", "c")
+	other := mustExec(t, db, `INSERT INTO posts(user_id, title, content) VALUES(?,?,?)`, user, "t2", "c2")
+
+	// Build a chain down to maxCommentDepth: ids[d] sits at depth d.
+	ids := []int64{addReply(t, db, post, user, 0)}
+	for d := 1; d <= maxCommentDepth; d++ {
+		ids = append(ids, addReply(t, db, post, user, ids[d-1]))
+	}
+	for d, id := range ids {
+		var parent sql.NullInt64
+		var depth int
+		if err := db.QueryRow(`SELECT parent_id, depth FROM comments WHERE id = ?`, id).Scan(&parent, &depth); err != nil {
+			t.Fatal(err)
+		}
+		if depth != d || (d > 0 && parent.Int64 != ids[d-1]) {
+			t.Errorf("comment at level %d stored with parent %v depth %d", d, parent, depth)
+		}
+	}
+
+	// A reply to the deepest comment becomes its sibling.
+	parent, depth, err := resolveReplyParent(db, post, ids[maxCommentDepth])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parent.Valid || parent.Int64 != ids[maxCommentDepth-1] || depth != maxCommentDepth {
+		t.Errorf("reply at max depth: parent %v depth %d, want parent %d depth %d",
+			parent, depth, ids[maxCommentDepth-1], maxCommentDepth)
+	}
+
+	if _, _, err := resolveReplyParent(db, other, ids[0]); err != errBadParent {
+		t.Errorf("parent on another post: err = %v, want errBadParent", err)
+	}
+	if _, _, err := resolveReplyParent(db, post, 9999); err != errBadParent {
+		t.Errorf("missing parent: err = %v, want errBadParent", err)
+	}
+	if parent, depth, err := resolveReplyParent(db, post, 0); err != nil || parent.Valid || depth != 0 {
+		t.Errorf("top-level comment: got %v, %d, %v", parent, depth, err)
+	}
+}
+
+// loadTree wraps loadCommentTree for a logged-out viewer.
+func loadTree(t *testing.T, db *sql.DB, postID int64) ([]*CommentNode, int) {
+	t.Helper()
+	roots, total, err := loadCommentTree(db, postID, nil, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roots, total
+}
+
+func TestLoadCommentTree(t *testing.T) {
+	db := newTestDB(t)
+	user := mustExec(t, db, `INSERT INTO users(email, username, password_hash) VALUES('a@b.c','ann','x')`)
+	post := mustExec(t, db, `INSERT INTO posts(user_id, title, content) VALUES(?,?,?)`, user, "t", "c")
+
+	first := addReply(t, db, post, user, 0)
+	second := addReply(t, db, post, user, 0)
+	deep := first
+	for d := 1; d <= maxCommentDepth+2; d++ {
+		deep = addReply(t, db, post, user, deep)
+	}
+	addReply(t, db, post, user, second)
+
+	roots, total := loadTree(t, db, post)
+	if total != 2+maxCommentDepth+2+1 {
+		t.Errorf("total = %d", total)
+	}
+	if len(roots) != 2 || roots[0].ID != first || roots[1].ID != second {
+		t.Fatalf("roots = %v", roots)
+	}
+	if roots[0].Descendants != maxCommentDepth+2 || roots[1].Descendants != 1 {
+		t.Errorf("descendants = %d, %d", roots[0].Descendants, roots[1].Descendants)
+	}
+
+	// Walk the first thread: nothing may nest deeper than maxCommentDepth,
+	// and the two replies past the limit end up as siblings at the bottom.
+	level := roots[:1]
+	for d := 0; d < maxCommentDepth; d++ {
+		if len(level) != 1 || level[0].Depth != d {
+			t.Fatalf("depth %d: %d comments", d, len(level))
+		}
+		level = level[0].Children
+	}
+	if len(level) != 3 {
+		t.Fatalf("deepest level has %d comments, want 3", len(level))
+	}
+	for _, n := range level {
+		if n.Depth != maxCommentDepth || len(n.Children) != 0 {
+			t.Errorf("comment %d at depth %d with %d children", n.ID, n.Depth, len(n.Children))
+		}
+	}
+}
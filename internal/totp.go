@@ -0,0 +1,422 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication. Members can add an RFC 6238 authenticator app
+// (30-second steps, 6 digits, SHA-1, which is what every app supports) from
+// /me/settings/2fa. Once it is on, a correct password at /login only starts
+// a short-lived challenge; the session is created after /login/2fa accepts
+// a current code or one of the ten single-use recovery codes. Recovery codes
+// are stored as SHA-256 hashes like reset tokens.
+
+const (
+	totpIssuer = "Literary Lions"
+	totpPeriod = 30
+	// totpSkew is how many steps either side of now are accepted, for
+	// phones whose clocks drift.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	loginChallengeCookie = "login_2fa"
+	loginChallengeTTL    = 5 * time.Minute
+	// maxChallengeAttempts bounds code guesses per password entry.
+	maxChallengeAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode is the RFC 4226 HOTP value of secret at counter step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+// checkTOTP returns the step a code matches within totpSkew of now, or -1.
+// Steps at or before lastStep were already used and don't count.
+func checkTOTP(secretB32, code string, now time.Time, lastStep int64) int64 {
+	secret, err := totpEncoding.DecodeString(secretB32)
+	code = strings.ReplaceAll(code, " ", "")
+	if err != nil || len(code) != 6 {
+		return -1
+	}
+	cur := now.Unix() / totpPeriod
+	for s := cur - totpSkew; s <= cur+totpSkew; s++ {
+		if s > lastStep && hmac.Equal([]byte(totpCode(secret, s)), []byte(code)) {
+			return s
+		}
+	}
+	return -1
+}
+
+// totpURI is the otpauth:// provisioning URI authenticator apps import,
+// usually from a QR code.
+func totpURI(username, secretB32 string) string {
+	// apps want %20 for spaces, not the + url.Values would write
+	issuer := url.PathEscape(totpIssuer)
+	return "otpauth://totp/" + issuer + ":" + url.PathEscape(username) +
+		"?secret=" + secretB32 + "&issuer=" + issuer + "&algorithm=SHA1&digits=6&period=30"
+}
+
+// groupSecret spaces a secret in fours for typing it in by hand.
+func groupSecret(s string) string {
+	var parts []string
+	for len(s) > 4 {
+		parts = append(parts, s[:4])
+		s = s[4:]
+	}
+	return strings.Join(append(parts, s), " ")
+}
+
+// twoFactorState is a member's 2FA setup as stored on users.
+type twoFactorState struct {
+	Secret    string // base32; set while enrolling and once enabled
+	Enabled   bool
+	LastStep  int64
+	CodesLeft int
+}
+
+func loadTwoFactor(db dbtx, userID int64) (twoFactorState, error) {
+	var st twoFactorState
+	err := db.QueryRow(`
+		SELECT COALESCE(totp_secret, ''), totp_enabled_at IS NOT NULL, totp_last_step,
+		       (SELECT COUNT(*) FROM recovery_codes rc WHERE rc.user_id = users.id AND rc.used_at IS NULL)
+		FROM users WHERE id = ?`, userID).Scan(&st.Secret, &st.Enabled, &st.LastStep, &st.CodesLeft)
+	return st, err
+}
+
+// newRecoveryCodes replaces a member's recovery codes and returns the new
+// ones in plain text, to be shown once.
+func newRecoveryCodes(db dbtx, userID int64) ([]string, error) {
+	if _, err := db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		if _, err := db.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, hashToken(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// useSecondFactor accepts a TOTP code or an unused recovery code for the
+// member and burns it. It reports whether the code was good.
+func useSecondFactor(db dbtx, userID int64, code string, now time.Time) (bool, error) {
+	st, err := loadTwoFactor(db, userID)
+	if err != nil || !st.Enabled {
+		return false, err
+	}
+	code = strings.ToLower(strings.TrimSpace(code))
+	if step := checkTOTP(st.Secret, code, now, st.LastStep); step >= 0 {
+		// only one request can move last_step past a given code, so two
+		// logins racing with the same code can't both get in
+		res, err := db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)`,
+			step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+	if len(code) == 10 {
+		code = code[:5] + "-" + code[5:]
+	}
+	res, err := db.Exec(`UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		userID, hashToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// startLoginChallenge records that userID got their password right and
+// sets the cookie /login/2fa continues from.
+func startLoginChallenge(w http.ResponseWriter, db *sql.DB, userID int64, now time.Time) error {
+	token, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`DELETE FROM login_challenges WHERE user_id = ? OR expires_at < ?`, userID, now.Unix()); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`INSERT INTO login_challenges (token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		hash, userID, now.Add(loginChallengeTTL).Unix()); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    token,
+		Path:     "/login",
+		Expires:  now.Add(loginChallengeTTL),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// loginChallengeUser returns the user behind a live challenge cookie, or
+// sql.ErrNoRows.
+func loginChallengeUser(r *http.Request, db *sql.DB, now time.Time) (userID int64, hash string, err error) {
+	c, err := r.Cookie(loginChallengeCookie)
+	if err != nil || c.Value == "" {
+		return 0, "", sql.ErrNoRows
+	}
+	hash = hashToken(c.Value)
+	err = db.QueryRow(`SELECT user_id FROM login_challenges WHERE token_hash = ? AND expires_at > ? AND attempts < ?`,
+		hash, now.Unix(), maxChallengeAttempts).Scan(&userID)
+	return userID, hash, err
+}
+
+func clearLoginChallengeCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    "",
+		Path:     "/login",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// LoginTwoFactorGET — GET /login/2fa
+func (a *App) LoginTwoFactorGET(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := loginChallengeUser(r, a.db, time.Now()); err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	a.render(w, "login_2fa.html", nil)
+}
+
+// LoginTwoFactorPOST — POST /login/2fa
+// Form fields: code (authenticator or recovery code)
+func (a *App) LoginTwoFactorPOST(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	userID, hash, err := loginChallengeUser(r, a.db, now)
+	if err != nil {
+		clearLoginChallengeCookie(w)
+		a.render(w, "login.html", map[string]any{"Error": "That took too long or had too many tries. Log in again."})
+		return
+	}
+	// wrong codes count towards the same delays and lockout as passwords
+	var email string
+	if err := a.db.QueryRow(`SELECT email FROM users WHERE id = ?`, userID).Scan(&email); err != nil {
+		a.render(w, "login_2fa.html", map[string]any{"Error": "Database error"})
+		return
+	}
+	ip := clientIP(r)
+	wait, locked, err := a.loginWait(userID, now)
+	if err != nil {
+		a.render(w, "login_2fa.html", map[string]any{"Error": "Database error"})
+		return
+	}
+	if locked {
+		_, _ = a.db.Exec(`DELETE FROM login_challenges WHERE token_hash = ?`, hash)
+		clearLoginChallengeCookie(w)
+		recordLoginAttempt(a.db, userID, email, ip, false, "locked", now)
+		a.loginRefused(w, "login.html", "This account is locked after too many failed logins. Try again in "+waitText(wait)+" or reset your password.", wait)
+		return
+	}
+	if wait > 0 {
+		recordLoginAttempt(a.db, userID, email, ip, false, "throttled", now)
+		a.loginRefused(w, "login_2fa.html", "Too many wrong codes. Wait "+waitText(wait)+" before trying again.", wait)
+		return
+	}
+	ok, err := useSecondFactor(a.db, userID, r.Form.Get("code"), now)
+	if err != nil {
+		a.render(w, "login_2fa.html", map[string]any{"Error": "Database error"})
+		return
+	}
+	if !ok {
+		a.loginFailed(userID, email, ip, "bad_2fa", now)
+		_, _ = a.db.Exec(`UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = ?`, hash)
+		w.WriteHeader(http.StatusBadRequest)
+		a.render(w, "login_2fa.html", map[string]any{"Error": "That code didn't work. Codes change every 30 seconds."})
+		return
+	}
+	_, _ = a.db.Exec(`DELETE FROM login_challenges WHERE token_hash = ?`, hash)
+	clearLoginChallengeCookie(w)
+
+	token, exp, err := createSession(a.db, userID, r)
+	if err != nil {
+		a.render(w, "login.html", map[string]any{"Error": "Session error"})
+		return
+	}
+	a.loginSucceeded(userID, email, ip, now)
+	setSessionCookie(w, token, exp)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// TwoFactorRouter handles /me/settings/2fa and its POST actions: start,
+// confirm, recovery and disable.
+func (a *App) TwoFactorRouter(w http.ResponseWriter, r *http.Request) {
+	u, ok := a.authorize(w, r, PermEditProfile)
+	if !ok {
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/settings/2fa"), "/")
+	if rest == "" {
+		a.twoFactorPage(w, r, u, nil, "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	st, err := loadTwoFactor(a.db, u.ID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	switch rest {
+	case "start":
+		// a fresh secret each time, so an abandoned setup can't be reused
+		if st.Enabled {
+			break
+		}
+		b := make([]byte, 20)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, "random error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := a.db.Exec(`UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?`, totpEncoding.EncodeToString(b), u.ID); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+	case "confirm":
+		if st.Enabled || st.Secret == "" {
+			break
+		}
+		step := checkTOTP(st.Secret, r.Form.Get("code"), now, st.LastStep)
+		if step < 0 {
+			a.twoFactorPage(w, r, u, nil, "That code didn't match. Check the time on your phone and try the next one.")
+			return
+		}
+		tx, err := a.db.Begin()
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`UPDATE users SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = ? WHERE id = ?`, step, u.ID); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		codes, err := newRecoveryCodes(tx, u.ID)
+		if err != nil || tx.Commit() != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		a.twoFactorPage(w, r, u, codes, "")
+		return
+
+	case "recovery":
+		if !st.Enabled {
+			break
+		}
+		if ok, err := useSecondFactor(a.db, u.ID, r.Form.Get("code"), now); err != nil || !ok {
+			a.twoFactorPage(w, r, u, nil, "Enter a current code from your app to make new recovery codes.")
+			return
+		}
+		codes, err := newRecoveryCodes(a.db, u.ID)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		a.twoFactorPage(w, r, u, codes, "")
+		return
+
+	case "disable":
+		if !st.Enabled && st.Secret == "" {
+			break
+		}
+		var hash []byte
+		_ = a.db.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, u.ID).Scan(&hash)
+		if checkPassword(hash, strings.TrimSpace(r.Form.Get("password"))) != nil {
+			a.twoFactorPage(w, r, u, nil, "Wrong password.")
+			return
+		}
+		if st.Enabled {
+			if ok, err := useSecondFactor(a.db, u.ID, r.Form.Get("code"), now); err != nil || !ok {
+				a.twoFactorPage(w, r, u, nil, "Enter a current code from your app (or a recovery code) to turn two-factor off.")
+				return
+			}
+		}
+		if _, err := a.db.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = ?`, u.ID); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		_, _ = a.db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, u.ID)
+
+	default:
+		a.renderError(w, http.StatusNotFound, "Page not found.")
+		return
+	}
+	http.Redirect(w, r, "/me/settings/2fa", http.StatusSeeOther)
+}
+
+// twoFactorPage renders the 2FA settings; codes are freshly made recovery
+// codes to show once.
+func (a *App) twoFactorPage(w http.ResponseWriter, r *http.Request, u *User, codes []string, errMsg string) {
+	st, err := loadTwoFactor(a.db, u.ID)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"Title":     "Two-factor authentication",
+		"User":      u,
+		"CSRFToken": a.generateCSRF(r),
+		"State":     st,
+		"Codes":     codes,
+		"Error":     errMsg,
+	}
+	if st.Secret != "" && !st.Enabled {
+		data["Secret"] = groupSecret(st.Secret)
+		uri := totpURI(u.Username, st.Secret)
+		data["URI"] = template.URL(uri)
+		if qr, err := qrSVG(uri); err == nil {
+			data["QR"] = qr
+		}
+	}
+	if errMsg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	a.render(w, "twofactor.html", data)
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key from RFC 6238 appendix B, base32-encoded.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCheckTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B lists 8-digit codes; 6-digit codes are their last
+	// six digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got := checkTOTP(rfc6238Secret, tt.code, time.Unix(tt.unix, 0), 0)
+		if want := tt.unix / totpPeriod; got != want {
+			t.Errorf("checkTOTP(%q at %d) = %d, want step %d", tt.code, tt.unix, got, want)
+		}
+	}
+}
+
+func TestCheckTOTPRejects(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		at       time.Time
+		lastStep int64
+		want     int64
+	}{
+		{"spaces allowed", rfc6238Secret, "050 471", now, 0, step},
+		{"one step of drift", rfc6238Secret, "050471", now.Add(totpPeriod * time.Second), 0, step},
+		{"too far off", rfc6238Secret, "050471", now.Add(2 * totpPeriod * time.Second), 0, -1},
+		{"already used", rfc6238Secret, "050471", now, step, -1},
+		{"wrong code", rfc6238Secret, "123456", now, 0, -1},
+		{"short code", rfc6238Secret, "05047", now, 0, -1},
+		{"bad secret", "not base32!", "050471", now, 0, -1},
+	}
+	for _, tt := range tests {
+		if got := checkTOTP(tt.secret, tt.code, tt.at, tt.lastStep); got != tt.want {
+			t.Errorf("%s: checkTOTP = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Email verification. New accounts start unverified and can read, report
+// and edit their profile, but not post, comment or react until they open
+// the link emailed at signup. The link is signed with a key kept in
+// app_secrets rather than stored, and covers the address, so it stops
+// working if the email changes. Accounts that existed before verification
+// was introduced count as verified.
+
+const (
+	verifyLinkTTL = 48 * time.Hour
+	// verifyResendGap rate-limits the resend button.
+	verifyResendGap = 5 * time.Minute
+)
+
+// unverifiedPerms are the permissions an account without a confirmed email
+// doesn't get yet.
+var unverifiedPerms = map[Permission]bool{
+	PermCreatePost: true,
+	PermComment:    true,
+	PermReact:      true,
+}
+
+// loadSecret returns the named key from app_secrets, creating a random one
+// the first time.
+func loadSecret(db *sql.DB, name string) ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO app_secrets (name, value) VALUES (?, ?)`, name, b); err != nil {
+		return nil, err
+	}
+	var key []byte
+	err := db.QueryRow(`SELECT value FROM app_secrets WHERE name = ?`, name).Scan(&key)
+	return key, err
+}
+
+// validEmail accepts a bare address like reader@example.org.
+func validEmail(s string) bool {
+	a, err := mail.ParseAddress(s)
+	return err == nil && a.Address == s && len(s) <= 254
+}
+
+// verifySignature signs a user id, address and expiry.
+func (a *App) verifySignature(userID int64, email string, expires int64) string {
+	mac := hmac.New(sha256.New, a.verifyKey)
+	mac.Write([]byte(strconv.FormatInt(userID, 10) + "|" + strings.ToLower(email) + "|" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sendVerification queues the verification email and notes when it went
+// out, for the resend limit.
+func (a *App) sendVerification(userID int64, username, email string, now time.Time) error {
+	expires := now.Add(verifyLinkTTL).Unix()
+	q := url.Values{}
+	q.Set("u", strconv.FormatInt(userID, 10))
+	q.Set("e", strconv.FormatInt(expires, 10))
+	q.Set("sig", a.verifySignature(userID, email, expires))
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET verification_sent_at = ? WHERE id = ?`, now.Unix(), userID); err != nil {
+		return err
+	}
+	if err := a.queueMail(tx, email, "verify_email", map[string]any{
+		"Username": username,
+		"Link":     a.siteURL + "/verify?" + q.Encode(),
+		"Expires":  "48 hours",
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyGET — GET /verify?u=&e=&sig=
+// Works without being logged in, so the link can be opened on any device.
+func (a *App) VerifyGET(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	userID, _ := strconv.ParseInt(q.Get("u"), 10, 64)
+	expires, _ := strconv.ParseInt(q.Get("e"), 10, 64)
+	var email string
+	var verified sql.NullString
+	err := a.db.QueryRow(`SELECT email, email_verified_at FROM users WHERE id = ?`, userID).Scan(&email, &verified)
+	if err == nil && !verified.Valid {
+		want := a.verifySignature(userID, email, expires)
+		if !hmac.Equal([]byte(want), []byte(q.Get("sig"))) || time.Now().Unix() > expires {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		a.renderError(w, http.StatusBadRequest, "This verification link is invalid or has expired. Log in and send a new one from Settings.")
+		return
+	}
+	if !verified.Valid {
+		if _, err := a.db.Exec(`UPDATE users SET email_verified_at = CURRENT_TIMESTAMP WHERE id = ? AND email_verified_at IS NULL`, userID); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if u, _ := a.currentUser(r); u != nil {
+		http.Redirect(w, r, "/me/settings?verify=done", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/login?verified=1", http.StatusSeeOther)
+}
+
+// VerifyResendPOST — POST /verify/resend
+// Sends a fresh link, at most once per verifyResendGap.
+func (a *App) VerifyResendPOST(w http.ResponseWriter, r *http.Request) {
+	u, _ := a.currentUser(r)
+	if u == nil {
+		http.Error(w, "login required", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil || !a.checkCSRF(r) {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	if !u.Unverified {
+		http.Redirect(w, r, "/me/settings", http.StatusSeeOther)
+		return
+	}
+	now := time.Now()
+	var sentAt sql.NullInt64
+	_ = a.db.QueryRow(`SELECT verification_sent_at FROM users WHERE id = ?`, u.ID).Scan(&sentAt)
+	if sentAt.Valid && now.Unix()-sentAt.Int64 < int64(verifyResendGap/time.Second) {
+		wait := (sentAt.Int64 + int64(verifyResendGap/time.Second) - now.Unix() + 59) / 60
+		http.Redirect(w, r, "/me/settings?err="+url.QueryEscape("We just sent a link. You can ask for another in "+strconv.FormatInt(wait, 10)+" min."), http.StatusSeeOther)
+		return
+	}
+	if err := a.sendVerification(u.ID, u.Username, u.Email, now); err != nil {
+		log.Printf("verification email for user %d: %v", u.ID, err)
+		http.Error(w, "could not send email", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me/settings?verify=sent", http.StatusSeeOther)
+}